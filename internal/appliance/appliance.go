@@ -0,0 +1,225 @@
+// Package appliance imports virtual machines which were exported to files,
+// such as OVA and OVF bundles, the directory of a virtual machine copied off
+// an ESXi datastore, a libvirt domain or Hyper-V disk images, without a
+// running hypervisor.
+package appliance
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vexxhost/migratekit/internal/machine"
+	"github.com/vexxhost/migratekit/internal/source"
+)
+
+type Appliance struct {
+	Machine *machine.VirtualMachine
+
+	// Images are the disk images, by the key of their disk
+	Images map[int32]*source.Image
+}
+
+type Options struct {
+	// ID identifies the virtual machine in the metadata of its volumes,
+	// it is derived from the path of the source unless the source has a
+	// unique ID of its own
+	ID string
+
+	// Hardware of a virtual machine imported from disk images, which do not
+	// describe it.  The name defaults to the one of the image or directory.
+	Name         string
+	Firmware     machine.Firmware
+	GuestID      string
+	MacAddresses []string
+}
+
+// Open reads the description of a virtual machine from an OVA, an OVF
+// descriptor, a VMX file, a libvirt domain XML, disk images or a directory
+// holding one of those.
+func Open(ctx context.Context, path string, opts *Options) (*Appliance, error) {
+	a, err := open(ctx, path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.ID != "" {
+		a.Machine.ID = opts.ID
+	}
+
+	return a, nil
+}
+
+// importID derives an ID for a virtual machine whose source does not have a
+// unique one, such as the ID of the virtual system of an OVF descriptor which
+// is usually the name of the virtual machine.  It is only stable as long as
+// the source is imported from the same path.
+func importID(path string, name string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	sum := sha256.Sum256([]byte(path + "\x00" + name))
+	return fmt.Sprintf("%s-%x", name, sum[:8])
+}
+
+func open(ctx context.Context, path string, opts *Options) (*Appliance, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		descriptor, err := findDescriptor(path)
+		if errors.Is(err, errNoDescriptor) {
+			return openImages(ctx, path, opts)
+		} else if err != nil {
+			return nil, err
+		}
+
+		path = descriptor
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	if _, ok := imageFormats[ext]; ok {
+		return openImages(ctx, path, opts)
+	}
+
+	switch ext {
+	case ".ova":
+		return openOva(path)
+	case ".ovf":
+		return parseOvf(path)
+	case ".vmx":
+		return parseVmx(path)
+	case ".xml":
+		return parseDomain(ctx, path)
+	default:
+		return nil, fmt.Errorf("unsupported file: %s, expected an OVA, OVF, VMX, libvirt domain XML or disk image file", path)
+	}
+}
+
+var errNoDescriptor = errors.New("no descriptor found")
+
+// findDescriptor returns the OVF descriptor, the VMX file or the libvirt
+// domain XML in a directory
+func findDescriptor(dir string) (string, error) {
+	for _, pattern := range []string{"*.ovf", "*.vmx", "*.xml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return "", err
+		}
+
+		if len(matches) > 1 {
+			return "", fmt.Errorf("multiple %s files found in %s", pattern, dir)
+		} else if len(matches) == 1 {
+			return matches[0], nil
+		}
+	}
+
+	return "", errNoDescriptor
+}
+
+// ovaEntry is where the data of a file is stored in an OVA
+type ovaEntry struct {
+	offset int64
+	size   int64
+}
+
+// openOva reads the OVF descriptor of an OVA, which is a tar archive.  The
+// disks are not extracted, they are read in place from where their files are
+// stored in the archive.
+func openOva(path string) (*Appliance, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var descriptor []byte
+	entries := map[string]ovaEntry{}
+
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		// The data of sparse files is not stored contiguously
+		if header.Typeflag != tar.TypeReg || header.PAXRecords["GNU.sparse.major"] != "" {
+			continue
+		}
+
+		// archive/tar does not buffer, so the file is positioned at the start
+		// of the data of the entry
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+
+		// The files of an OVA are all at its top level
+		name := filepath.Base(header.Name)
+		entries[name] = ovaEntry{offset: offset, size: header.Size}
+
+		if strings.ToLower(filepath.Ext(name)) == ".ovf" {
+			if descriptor != nil {
+				return nil, fmt.Errorf("multiple OVF descriptors found in %s", path)
+			}
+
+			descriptor, err = io.ReadAll(reader)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if descriptor == nil {
+		return nil, fmt.Errorf("no OVF descriptor found in %s", path)
+	}
+
+	a, err := readOvf(bytes.NewReader(descriptor), func(href string) (*source.Image, error) {
+		entry, ok := entries[href]
+		if !ok {
+			return nil, fmt.Errorf("file %s not found in %s", href, path)
+		}
+
+		return &source.Image{
+			Path:   path,
+			Format: "vmdk",
+			Offset: entry.offset,
+			Size:   entry.size,
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a.Machine.ID = importID(path, a.Machine.ID)
+	return a, nil
+}
+
+func (a *Appliance) VirtualMachine() *machine.VirtualMachine {
+	return a.Machine
+}
+
+// Disk reads the image of a disk, the changes since an earlier import are
+// known if it is a qcow2 image with a dirty bitmap.  A new bitmap is added to
+// such images on every migration cycle.
+func (a *Appliance) Disk(ctx context.Context, disk *machine.Disk) (*source.Disk, error) {
+	image, ok := a.Images[disk.Key]
+	if !ok {
+		return nil, fmt.Errorf("disk %d has no image", disk.Key)
+	}
+
+	return image.Disk(ctx, disk)
+}
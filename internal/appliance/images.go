@@ -0,0 +1,147 @@
+package appliance
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/vexxhost/migratekit/internal/machine"
+	"github.com/vexxhost/migratekit/internal/source"
+)
+
+// imageFormats are the qemu formats of disk images by their extension, VMDK
+// files are left out since they are imported through their VMX file.
+var imageFormats = map[string]string{
+	".qcow2": "qcow2",
+	".vhdx":  "vhdx",
+	".vhd":   "vpc",
+	".raw":   "raw",
+	".img":   "raw",
+}
+
+// hyperVDisks is the directory Hyper-V exports the disks of a virtual
+// machine to
+const hyperVDisks = "Virtual Hard Disks"
+
+// openImages imports a virtual machine from a single disk image or from the
+// disk images in a directory, such as a Hyper-V export.  The images are
+// sorted by name with the boot disk expected first, the hardware is taken
+// from the options since the images do not describe it.
+func openImages(ctx context.Context, path string, opts *Options) (*Appliance, error) {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	files := []string{path}
+
+	if info, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		name = filepath.Base(path)
+
+		dir := path
+		if info, err := os.Stat(filepath.Join(path, hyperVDisks)); err == nil && info.IsDir() {
+			dir = filepath.Join(path, hyperVDisks)
+		}
+
+		files, err = findImages(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Name != "" {
+		name = opts.Name
+	}
+
+	vm := &machine.VirtualMachine{
+		ID:       importID(path, name),
+		Name:     name,
+		CPUs:     1,
+		Firmware: machine.FirmwareBIOS,
+		GuestID:  opts.GuestID,
+	}
+
+	if opts.Firmware != "" {
+		vm.Firmware = opts.Firmware
+	}
+
+	for _, address := range opts.MacAddresses {
+		mac, err := net.ParseMAC(address)
+		if err != nil {
+			return nil, err
+		}
+
+		vm.NICs = append(vm.NICs, &machine.NIC{
+			MacAddress: mac.String(),
+			Label:      fmt.Sprintf("Network adapter %d", len(vm.NICs)+1),
+		})
+	}
+
+	a := &Appliance{
+		Machine: vm,
+		Images:  map[int32]*source.Image{},
+	}
+
+	for index, file := range files {
+		format, ok := imageFormats[strings.ToLower(filepath.Ext(file))]
+		if !ok {
+			return nil, fmt.Errorf("unsupported disk image: %s", file)
+		}
+
+		err := a.addImage(ctx, int32(index), &source.Image{Path: file, Format: format})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// findImages returns the disk images in a directory, sorted by name.  Hyper-V
+// checkpoints are refused since the differencing disks can not be read.
+func findImages(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if ext == ".avhdx" || ext == ".avhd" {
+			return nil, fmt.Errorf("%s is a Hyper-V checkpoint, delete the checkpoints of the virtual machine before exporting it", entry.Name())
+		}
+
+		if _, ok := imageFormats[ext]; ok && !entry.IsDir() {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no OVF descriptor, VMX file, libvirt domain XML or disk image found in %s", dir)
+	}
+
+	slices.Sort(files)
+	return files, nil
+}
+
+// addImage adds a disk read from an image, its capacity and change ID are
+// read from the image.
+func (a *Appliance) addImage(ctx context.Context, key int32, image *source.Image) error {
+	info, err := image.Inspect(ctx)
+	if err != nil {
+		return err
+	}
+
+	disk := &machine.Disk{
+		Key:             key,
+		CapacityInBytes: info.VirtualSize,
+		ChangeID:        image.ChangeID(info),
+	}
+
+	a.Machine.Disks = append(a.Machine.Disks, disk)
+	a.Images[disk.Key] = image
+	return nil
+}
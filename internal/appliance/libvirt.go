@@ -0,0 +1,221 @@
+package appliance
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/vexxhost/migratekit/internal/machine"
+	"github.com/vexxhost/migratekit/internal/source"
+)
+
+// domain is the part of a libvirt domain XML, as written by "virsh dumpxml",
+// which describes the hardware of the virtual machine
+type domain struct {
+	Name   string `xml:"name"`
+	UUID   string `xml:"uuid"`
+	Title  string `xml:"title"`
+	Memory struct {
+		Value int64  `xml:",chardata"`
+		Unit  string `xml:"unit,attr"`
+	} `xml:"memory"`
+	VCPU int32 `xml:"vcpu"`
+	OS   struct {
+		Firmware string `xml:"firmware,attr"`
+		Loader   struct {
+			Type   string `xml:"type,attr"`
+			Secure string `xml:"secure,attr"`
+		} `xml:"loader"`
+		Features []domainFeature `xml:"firmware>feature"`
+	} `xml:"os"`
+	GuestOS struct {
+		ID string `xml:"id,attr"`
+	} `xml:"metadata>libosinfo>os"`
+	Disks      []domainDisk `xml:"devices>disk"`
+	Interfaces []struct {
+		MAC struct {
+			Address string `xml:"address,attr"`
+		} `xml:"mac"`
+		Source struct {
+			Network string `xml:"network,attr"`
+			Bridge  string `xml:"bridge,attr"`
+		} `xml:"source"`
+		Alias struct {
+			Name string `xml:"name,attr"`
+		} `xml:"alias"`
+	} `xml:"devices>interface"`
+}
+
+type domainFeature struct {
+	Name    string `xml:"name,attr"`
+	Enabled string `xml:"enabled,attr"`
+}
+
+type domainDisk struct {
+	Type   string `xml:"type,attr"`
+	Device string `xml:"device,attr"`
+	Driver struct {
+		Type string `xml:"type,attr"`
+	} `xml:"driver"`
+	Source struct {
+		File string `xml:"file,attr"`
+		Dev  string `xml:"dev,attr"`
+	} `xml:"source"`
+	Target struct {
+		Dev string `xml:"dev,attr"`
+	} `xml:"target"`
+	Boot struct {
+		Order int `xml:"order,attr"`
+	} `xml:"boot"`
+}
+
+// memoryUnits are the units of the memory of a domain, in bytes
+var memoryUnits = map[string]int64{
+	"b":     1,
+	"bytes": 1,
+	"kb":    1000,
+	"k":     1 << 10,
+	"kib":   1 << 10,
+	"mb":    1000 * 1000,
+	"m":     1 << 20,
+	"mib":   1 << 20,
+	"gb":    1000 * 1000 * 1000,
+	"g":     1 << 30,
+	"gib":   1 << 30,
+	"tb":    1000 * 1000 * 1000 * 1000,
+	"t":     1 << 40,
+	"tib":   1 << 40,
+}
+
+// parseDomain reads the hardware of a virtual machine from a libvirt domain
+// XML, its disks are the images it references which must not be in use.  The
+// disks with a boot order come first, the others in the order they are
+// listed in.
+func parseDomain(ctx context.Context, path string) (*Appliance, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var d domain
+	if err := xml.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+
+	if d.Name == "" {
+		return nil, fmt.Errorf("%s is not a libvirt domain XML", path)
+	}
+
+	vm := &machine.VirtualMachine{
+		ID:       d.UUID,
+		Name:     d.Name,
+		CPUs:     max(d.VCPU, 1),
+		Firmware: machine.FirmwareBIOS,
+		GuestID:  d.GuestOS.ID,
+
+		GuestFullName: d.Title,
+	}
+
+	if vm.ID == "" {
+		vm.ID = importID(path, vm.Name)
+	}
+
+	unit := strings.ToLower(d.Memory.Unit)
+	if unit == "" {
+		unit = "kib"
+	}
+
+	size, ok := memoryUnits[unit]
+	if !ok {
+		return nil, fmt.Errorf("unsupported memory unit: %s", d.Memory.Unit)
+	}
+
+	vm.MemoryMB = d.Memory.Value * size / 1024 / 1024
+
+	if d.OS.Firmware == "efi" || d.OS.Loader.Type == "pflash" {
+		vm.Firmware = machine.FirmwareEFI
+	}
+
+	vm.SecureBoot = d.OS.Loader.Secure == "yes" || slices.ContainsFunc(d.OS.Features, func(f domainFeature) bool {
+		return f.Name == "secure-boot" && f.Enabled == "yes"
+	})
+
+	for _, iface := range d.Interfaces {
+		mac, err := net.ParseMAC(iface.MAC.Address)
+		if err != nil {
+			return nil, fmt.Errorf("interface %s has an invalid MAC address: %w", iface.Alias.Name, err)
+		}
+
+		vm.NICs = append(vm.NICs, &machine.NIC{
+			MacAddress: mac.String(),
+			Label:      iface.Alias.Name,
+			Summary:    iface.Source.Network + iface.Source.Bridge,
+		})
+	}
+
+	disks := slices.DeleteFunc(d.Disks, func(disk domainDisk) bool {
+		return disk.Device != "" && disk.Device != "disk"
+	})
+
+	slices.SortStableFunc(disks, func(a, b domainDisk) int {
+		switch {
+		case a.Boot.Order == b.Boot.Order:
+			return 0
+		case a.Boot.Order == 0:
+			return 1
+		case b.Boot.Order == 0:
+			return -1
+		default:
+			return a.Boot.Order - b.Boot.Order
+		}
+	})
+
+	a := &Appliance{
+		Machine: vm,
+		Images:  map[int32]*source.Image{},
+	}
+
+	for index, disk := range disks {
+		image, err := domainImage(disk)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := a.addImage(ctx, int32(index), image); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(vm.Disks) == 0 {
+		return nil, errors.New("libvirt domain has no disks")
+	}
+
+	return a, nil
+}
+
+// domainImage returns the image of a disk of a domain, only local files and
+// block devices can be read.
+func domainImage(disk domainDisk) (*source.Image, error) {
+	format := disk.Driver.Type
+	if format == "" {
+		format = "raw"
+	}
+
+	if format != "qcow2" && format != "raw" {
+		return nil, fmt.Errorf("disk %s has an unsupported format: %s", disk.Target.Dev, format)
+	}
+
+	switch disk.Type {
+	case "file":
+		return &source.Image{Path: disk.Source.File, Format: format}, nil
+	case "block":
+		return &source.Image{Path: disk.Source.Dev, Format: format}, nil
+	default:
+		return nil, fmt.Errorf("disk %s is of type %s, only file and block disks are supported", disk.Target.Dev, disk.Type)
+	}
+}
@@ -0,0 +1,221 @@
+package appliance
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vexxhost/migratekit/internal/machine"
+	"github.com/vexxhost/migratekit/internal/source"
+	"github.com/vmware/govmomi/ovf"
+)
+
+// parseOvf reads an OVF descriptor, the images of its disks are next to it.
+func parseOvf(path string) (*Appliance, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	a, err := readOvf(file, func(href string) (*source.Image, error) {
+		return &source.Image{
+			Path:   filepath.Join(filepath.Dir(path), href),
+			Format: "vmdk",
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a.Machine.ID = importID(path, a.Machine.ID)
+	return a, nil
+}
+
+// readOvf reads the hardware of the virtual system of an OVF descriptor, the
+// disks are numbered in the order they are listed in and image returns the
+// image of the file a disk references.  The ID of the virtual machine is the
+// one of the virtual system, which is not unique.
+func readOvf(r io.Reader, image func(href string) (*source.Image, error)) (*Appliance, error) {
+	envelope, err := ovf.Unmarshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	system := envelope.VirtualSystem
+	if system == nil {
+		return nil, errors.New("OVF descriptor has no virtual system, collections of virtual systems are not supported")
+	}
+
+	if len(system.VirtualHardware) == 0 {
+		return nil, errors.New("OVF descriptor has no virtual hardware")
+	}
+
+	vm := &machine.VirtualMachine{
+		ID:       system.ID,
+		Name:     system.ID,
+		CPUs:     1,
+		Firmware: machine.FirmwareBIOS,
+	}
+
+	if system.Name != nil && *system.Name != "" {
+		vm.Name = *system.Name
+	}
+
+	if guest := system.OperatingSystem; guest != nil {
+		if guest.OSType != nil {
+			vm.GuestID = *guest.OSType
+		}
+
+		if guest.Description != nil {
+			vm.GuestFullName = *guest.Description
+		}
+	}
+
+	a := &Appliance{
+		Machine: vm,
+		Images:  map[int32]*source.Image{},
+	}
+
+	hardware := system.VirtualHardware[0]
+	for _, config := range hardware.Config {
+		switch config.Key {
+		case "firmware":
+			if config.Value == "efi" {
+				vm.Firmware = machine.FirmwareEFI
+			}
+		case "bootOptions.efiSecureBootEnabled":
+			vm.SecureBoot = config.Value == "true"
+		}
+	}
+
+	for _, item := range hardware.Item {
+		if item.ResourceType == nil || item.Configuration != nil {
+			continue
+		}
+
+		switch *item.ResourceType {
+		case ovf.Processor:
+			if item.VirtualQuantity != nil {
+				vm.CPUs = int32(*item.VirtualQuantity)
+			}
+		case ovf.Memory:
+			if item.VirtualQuantity != nil {
+				units := "byte * 2^20"
+				if item.AllocationUnits != nil {
+					units = *item.AllocationUnits
+				}
+
+				vm.MemoryMB = ovf.ParseCapacityAllocationUnits(units) * int64(*item.VirtualQuantity) / 1024 / 1024
+			}
+		case ovf.DiskDrive:
+			disk, file, err := ovfDisk(envelope, item, int32(len(vm.Disks)))
+			if err != nil {
+				return nil, err
+			}
+
+			img, err := image(file)
+			if err != nil {
+				return nil, err
+			}
+
+			vm.Disks = append(vm.Disks, disk)
+			a.Images[disk.Key] = img
+		case ovf.EthernetAdapter:
+			if item.Address == nil || *item.Address == "" {
+				log.WithFields(log.Fields{
+					"nic": item.ElementName,
+				}).Warn("Network adapter has no MAC address in the OVF descriptor, skipping it")
+				continue
+			}
+
+			mac, err := net.ParseMAC(*item.Address)
+			if err != nil {
+				return nil, err
+			}
+
+			nic := &machine.NIC{
+				MacAddress: mac.String(),
+				Label:      item.ElementName,
+			}
+
+			if len(item.Connection) > 0 {
+				nic.Summary = item.Connection[0]
+			}
+
+			vm.NICs = append(vm.NICs, nic)
+		}
+	}
+
+	if len(vm.Disks) == 0 {
+		return nil, errors.New("OVF descriptor has no disks")
+	}
+
+	return a, nil
+}
+
+// ovfDisk returns a disk drive of an OVF descriptor and the file of its
+// image, relative to the descriptor.
+func ovfDisk(envelope *ovf.Envelope, item ovf.ResourceAllocationSettingData, key int32) (*machine.Disk, string, error) {
+	if len(item.HostResource) != 1 || envelope.Disk == nil {
+		return nil, "", fmt.Errorf("disk %s has no image", item.ElementName)
+	}
+
+	// Host resources reference disks as "ovf:/disk/<id>"
+	diskID := strings.TrimPrefix(item.HostResource[0], "ovf:/disk/")
+
+	var desc *ovf.VirtualDiskDesc
+	for i := range envelope.Disk.Disks {
+		if envelope.Disk.Disks[i].DiskID == diskID {
+			desc = &envelope.Disk.Disks[i]
+		}
+	}
+
+	if desc == nil || desc.FileRef == nil {
+		return nil, "", fmt.Errorf("disk %s has no image", item.ElementName)
+	}
+
+	if desc.ParentRef != nil {
+		return nil, "", fmt.Errorf("disk %s is a delta disk, which is not supported", item.ElementName)
+	}
+
+	var file *ovf.File
+	for i := range envelope.References {
+		if envelope.References[i].ID == *desc.FileRef {
+			file = &envelope.References[i]
+		}
+	}
+
+	if file == nil {
+		return nil, "", fmt.Errorf("file %s of disk %s is not referenced", *desc.FileRef, item.ElementName)
+	}
+
+	if file.Compression != nil && *file.Compression != "" {
+		return nil, "", fmt.Errorf("file %s is compressed, which is not supported", file.Href)
+	}
+
+	if file.ChunkSize != nil {
+		return nil, "", fmt.Errorf("file %s is split into chunks, which is not supported", file.Href)
+	}
+
+	units := "byte"
+	if desc.CapacityAllocationUnits != nil {
+		units = *desc.CapacityAllocationUnits
+	}
+
+	capacity, err := strconv.ParseInt(desc.Capacity, 10, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("disk %s has an invalid capacity: %s", item.ElementName, desc.Capacity)
+	}
+
+	return &machine.Disk{
+		Key:             key,
+		CapacityInBytes: capacity * ovf.ParseCapacityAllocationUnits(units),
+	}, file.Href, nil
+}
@@ -0,0 +1,64 @@
+package appliance
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// vmdkCapacity returns the capacity of a VMDK, which is the sum of the
+// extents listed in its descriptor or the capacity in the header of a
+// monolithic sparse VMDK.
+func vmdkCapacity(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 20)
+	_, err = io.ReadFull(file, header)
+	if err != nil {
+		return 0, err
+	}
+
+	if bytes.HasPrefix(header, []byte("KDMV")) {
+		return int64(binary.LittleEndian.Uint64(header[12:20])) * 512, nil
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	// Descriptors are small, this avoids reading through a flat extent
+	var sectors int64
+	scanner := bufio.NewScanner(io.LimitReader(file, 1024*1024))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+
+		switch fields[0] {
+		case "RW", "RDONLY", "NOACCESS":
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid extent in %s: %s", path, scanner.Text())
+			}
+
+			sectors += size
+		}
+	}
+
+	if sectors == 0 {
+		return 0, fmt.Errorf("no extents found in %s, it must be a VMDK descriptor", path)
+	}
+
+	return sectors * 512, nil
+}
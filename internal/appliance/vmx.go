@@ -0,0 +1,230 @@
+package appliance
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/vexxhost/migratekit/internal/machine"
+	"github.com/vexxhost/migratekit/internal/source"
+)
+
+// vmxDisk matches the file of a disk, such as "scsi0:1.fileName"
+var vmxDisk = regexp.MustCompile(`^((scsi|sata|nvme|ide)(\d+):(\d+))\.filename$`)
+
+// vmxBuses is the order in which the disks are listed when the VMX file does
+// not set the boot order, the first disk is expected to be the boot disk.
+var vmxBuses = []string{"scsi", "nvme", "sata", "ide"}
+
+type vmxDevice struct {
+	name       string
+	bus        string
+	controller int
+	unit       int
+	file       string
+}
+
+// parseVmx reads the hardware of a virtual machine from its VMX file, as
+// found in the directory of a virtual machine on a datastore.
+func parseVmx(path string) (*Appliance, error) {
+	config, err := readVmx(path)
+	if err != nil {
+		return nil, err
+	}
+
+	vm := &machine.VirtualMachine{
+		ID:       strings.ReplaceAll(config["uuid.bios"], " ", ""),
+		Name:     config["displayname"],
+		CPUs:     1,
+		Firmware: machine.FirmwareBIOS,
+		GuestID:  config["guestos"],
+	}
+
+	if vm.Name == "" {
+		vm.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	if vm.ID == "" {
+		vm.ID = importID(path, vm.Name)
+	}
+
+	if value, ok := config["numvcpus"]; ok {
+		cpus, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid numvcpus: %s", value)
+		}
+
+		vm.CPUs = int32(cpus)
+	}
+
+	if value, ok := config["memsize"]; ok {
+		vm.MemoryMB, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid memsize: %s", value)
+		}
+	}
+
+	if config["firmware"] == "efi" {
+		vm.Firmware = machine.FirmwareEFI
+	}
+
+	vm.SecureBoot = strings.EqualFold(config["uefi.secureboot.enabled"], "true")
+
+	a := &Appliance{
+		Machine: vm,
+		Images:  map[int32]*source.Image{},
+	}
+
+	devices, err := vmxDevices(config, filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	for index, device := range devices {
+		capacity, err := vmdkCapacity(device.file)
+		if err != nil {
+			return nil, err
+		}
+
+		disk := &machine.Disk{
+			Key:             int32(index),
+			CapacityInBytes: capacity,
+		}
+
+		vm.Disks = append(vm.Disks, disk)
+		a.Images[disk.Key] = &source.Image{Path: device.file, Format: "vmdk"}
+	}
+
+	for index := 0; ; index++ {
+		prefix := fmt.Sprintf("ethernet%d.", index)
+		if _, ok := config[prefix+"present"]; !ok {
+			break
+		}
+
+		if !strings.EqualFold(config[prefix+"present"], "true") {
+			continue
+		}
+
+		address := config[prefix+"generatedaddress"]
+		if config[prefix+"addresstype"] == "static" {
+			address = config[prefix+"address"]
+		}
+
+		mac, err := net.ParseMAC(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC address of ethernet%d: %s", index, address)
+		}
+
+		vm.NICs = append(vm.NICs, &machine.NIC{
+			MacAddress: mac.String(),
+			Label:      fmt.Sprintf("Network adapter %d", index+1),
+			Summary:    config[prefix+"networkname"],
+		})
+	}
+
+	return a, nil
+}
+
+// readVmx reads the keys and values of a VMX file, the keys are lowercased
+// since VMware treats them case insensitively.
+func readVmx(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+
+		config[strings.ToLower(strings.TrimSpace(key))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+
+	return config, scanner.Err()
+}
+
+// vmxDevices returns the disks of a VMX file in boot order, CD-ROM drives and
+// devices which are not present are skipped.
+func vmxDevices(config map[string]string, dir string) ([]*vmxDevice, error) {
+	var devices []*vmxDevice
+	for key, value := range config {
+		match := vmxDisk.FindStringSubmatch(key)
+		if match == nil {
+			continue
+		}
+
+		name := match[1]
+		if strings.EqualFold(config[name+".present"], "false") {
+			continue
+		}
+
+		if strings.Contains(config[name+".devicetype"], "cdrom") || !strings.HasSuffix(strings.ToLower(value), ".vmdk") {
+			continue
+		}
+
+		controller, _ := strconv.Atoi(match[3])
+		unit, _ := strconv.Atoi(match[4])
+
+		// Files on other datastores are referenced by their absolute path
+		// on the ESXi host, they are expected to be copied next to the VMX
+		file := value
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
+			file = filepath.Join(dir, filepath.Base(value))
+		}
+
+		devices = append(devices, &vmxDevice{
+			name:       name,
+			bus:        match[2],
+			controller: controller,
+			unit:       unit,
+			file:       file,
+		})
+	}
+
+	if len(devices) == 0 {
+		return nil, errors.New("VMX file has no disks")
+	}
+
+	boot := strings.Split(strings.ToLower(config["bios.hddorder"]), ",")
+	slices.SortFunc(devices, func(a, b *vmxDevice) int {
+		for _, device := range boot {
+			if a.name == device {
+				return -1
+			} else if b.name == device {
+				return 1
+			}
+		}
+
+		if a.bus != b.bus {
+			return slices.Index(vmxBuses, a.bus) - slices.Index(vmxBuses, b.bus)
+		}
+
+		if a.controller != b.controller {
+			return a.controller - b.controller
+		}
+
+		return a.unit - b.unit
+	})
+
+	return devices, nil
+}
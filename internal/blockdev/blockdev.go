@@ -0,0 +1,71 @@
+package blockdev
+
+import (
+	"errors"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrNotSupported is returned when the file is not a block device or the
+// device does not support the operation.
+var ErrNotSupported = errors.New("operation not supported by device")
+
+func ioctlRange(fd *os.File, request uintptr, start, length int64) error {
+	r := [2]uint64{uint64(start), uint64(length)}
+
+	conn, err := fd.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var errno unix.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = unix.Syscall(unix.SYS_IOCTL, fd, request, uintptr(unsafe.Pointer(&r)))
+	})
+	if err != nil {
+		return err
+	}
+
+	switch errno {
+	case 0:
+		return nil
+	case unix.ENOTTY, unix.EOPNOTSUPP, unix.EINVAL:
+		return ErrNotSupported
+	default:
+		return errno
+	}
+}
+
+// ZeroOut zeroes a range of the block device, the kernel will unmap the
+// range instead of writing zeroes if the device supports it.
+func ZeroOut(fd *os.File, start, length int64) error {
+	return ioctlRange(fd, unix.BLKZEROOUT, start, length)
+}
+
+// PunchHole deallocates a range of a regular file, which then reads as
+// zeroes, without changing its size.
+func PunchHole(fd *os.File, start, length int64) error {
+	conn, err := fd.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var errno error
+	err = conn.Control(func(fd uintptr) {
+		errno = unix.Fallocate(int(fd), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, start, length)
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case errno == nil:
+		return nil
+	case errors.Is(errno, unix.EOPNOTSUPP), errors.Is(errno, unix.ENODEV):
+		return ErrNotSupported
+	default:
+		return errno
+	}
+}
@@ -0,0 +1,125 @@
+package blockdev
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrAmbiguousDevice is returned when more than one block device has the
+	// serial that is looked for.
+	ErrAmbiguousDevice = errors.New("multiple block devices match the serial")
+	// ErrSizeMismatch is returned when the block device with the serial does
+	// not have the expected size.
+	ErrSizeMismatch = errors.New("block device size does not match")
+)
+
+// virtio-blk truncates serials to 20 characters
+const virtioBlkSerialLength = 20
+
+const sysBlock = "/sys/block"
+
+// serials returns all the serials known for a block device, from sysfs for
+// virtio-blk and SCSI devices and from the udev database.
+func serials(name string) []string {
+	var result []string
+
+	if data, err := os.ReadFile(filepath.Join(sysBlock, name, "serial")); err == nil {
+		result = append(result, strings.TrimSpace(string(data)))
+	}
+
+	// The unit serial number VPD page has a 4 byte header
+	if data, err := os.ReadFile(filepath.Join(sysBlock, name, "device", "vpd_pg80")); err == nil && len(data) > 4 {
+		result = append(result, strings.TrimSpace(strings.Trim(string(data[4:]), "\x00")))
+	}
+
+	if dev, err := os.ReadFile(filepath.Join(sysBlock, name, "dev")); err == nil {
+		data, err := os.ReadFile(filepath.Join("/run/udev/data", "b"+strings.TrimSpace(string(dev))))
+		if err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				if serial, ok := strings.CutPrefix(line, "E:ID_SERIAL_SHORT="); ok {
+					result = append(result, serial)
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+func matchesSerial(serials []string, serial string) bool {
+	for _, s := range serials {
+		if s == "" {
+			continue
+		}
+
+		if s == serial || (len(s) == virtioBlkSerialLength && strings.HasPrefix(serial, s)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Size returns the size of a block device in bytes, given its name in sysfs.
+func Size(name string) (int64, error) {
+	data, err := os.ReadFile(filepath.Join(sysBlock, name, "size"))
+	if err != nil {
+		return 0, err
+	}
+
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	// sysfs always reports the size in 512 byte sectors
+	return sectors * 512, nil
+}
+
+// FindBySerial returns the path of the block device with the serial, or an
+// empty string if there is none.  If size is not zero, the device must be of
+// that size in bytes.
+func FindBySerial(serial string, size int64) (string, error) {
+	entries, err := os.ReadDir(sysBlock)
+	if err != nil {
+		return "", err
+	}
+
+	var matches []string
+	for _, entry := range entries {
+		if matchesSerial(serials(entry.Name()), serial) {
+			matches = append(matches, entry.Name())
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", nil
+	case 1:
+	default:
+		return "", fmt.Errorf("%w %s: %s", ErrAmbiguousDevice, serial, strings.Join(matches, ", "))
+	}
+
+	if size != 0 {
+		deviceSize, err := Size(matches[0])
+		if err != nil {
+			return "", err
+		}
+
+		// The capacity of SCSI devices is only known once they are scanned
+		if deviceSize == 0 {
+			return "", nil
+		}
+
+		if deviceSize != size {
+			return "", fmt.Errorf("%w: %s is %d bytes, expected %d bytes", ErrSizeMismatch, matches[0], deviceSize, size)
+		}
+	}
+
+	return filepath.Join("/dev", matches[0]), nil
+}
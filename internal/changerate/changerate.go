@@ -0,0 +1,134 @@
+package changerate
+
+import (
+	"time"
+)
+
+type Cycle struct {
+	StartedAt    time.Time
+	Duration     time.Duration
+	ChangedBytes int64
+	FullCopy     bool
+}
+
+// History keeps the most recent migration cycles in order to estimate how
+// fast data changes on the source and how long it takes to copy it over.
+type History struct {
+	Window int
+	Cycles []Cycle
+}
+
+func NewHistory(window int) *History {
+	return &History{
+		Window: window,
+	}
+}
+
+func (h *History) Add(cycle Cycle) {
+	h.Cycles = append(h.Cycles, cycle)
+
+	if h.Window > 0 && len(h.Cycles) > h.Window {
+		h.Cycles = h.Cycles[len(h.Cycles)-h.Window:]
+	}
+}
+
+func (h *History) incremental() []Cycle {
+	var cycles []Cycle
+	for _, cycle := range h.Cycles {
+		if !cycle.FullCopy {
+			cycles = append(cycles, cycle)
+		}
+	}
+
+	return cycles
+}
+
+// ChangeRate returns the rate at which data changes on the source in bytes
+// per second, measured over the time elapsed between consecutive cycles.
+func (h *History) ChangeRate() (float64, bool) {
+	var changed int64
+	var elapsed time.Duration
+
+	for i := 1; i < len(h.Cycles); i++ {
+		if h.Cycles[i].FullCopy {
+			continue
+		}
+
+		changed += h.Cycles[i].ChangedBytes
+		elapsed += h.Cycles[i].StartedAt.Sub(h.Cycles[i-1].StartedAt)
+	}
+
+	if elapsed <= 0 {
+		return 0, false
+	}
+
+	return float64(changed) / elapsed.Seconds(), true
+}
+
+// CopyCost fits the duration of incremental cycles against the amount of
+// changed data, returning the fixed overhead of a cycle (snapshots, attaching
+// volumes, ...) and the time it takes to copy a single byte.
+func (h *History) CopyCost() (time.Duration, float64, bool) {
+	cycles := h.incremental()
+	if len(cycles) == 0 {
+		return 0, 0, false
+	}
+
+	n := float64(len(cycles))
+	var sumX, sumY, sumXY, sumXX float64
+	for _, cycle := range cycles {
+		x := float64(cycle.ChangedBytes)
+		y := cycle.Duration.Seconds()
+
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+
+	if denominator := n*sumXX - sumX*sumX; len(cycles) > 1 && denominator > 0 {
+		slope := (n*sumXY - sumX*sumY) / denominator
+		intercept := (sumY - slope*sumX) / n
+
+		if slope > 0 && intercept >= 0 {
+			return time.Duration(intercept * float64(time.Second)), slope, true
+		}
+	}
+
+	// Not enough distinct samples for a fit, attribute the whole duration
+	// to the copy itself which over-estimates rather than under-estimates.
+	if sumX == 0 {
+		return time.Duration(sumY / n * float64(time.Second)), 0, true
+	}
+
+	return 0, sumY / sumX, true
+}
+
+// EstimateCutover estimates how long the source virtual machine will be
+// offline during a cutover which starts one interval after the last cycle.
+//
+// The cutover runs a cycle while the source is still running, which copies
+// the changes accumulated since the last cycle, then shuts it down and runs
+// a final cycle which copies whatever changed during the previous one.  The
+// estimate covers that final cycle only, it excludes the guest shutdown and
+// virt-v2v.
+func (h *History) EstimateCutover(interval time.Duration) (time.Duration, bool) {
+	rate, ok := h.ChangeRate()
+	if !ok {
+		return 0, false
+	}
+
+	overhead, perByte, ok := h.CopyCost()
+	if !ok {
+		return 0, false
+	}
+
+	cycleDuration := func(changed float64) float64 {
+		return overhead.Seconds() + perByte*changed
+	}
+
+	preShutdown := cycleDuration(rate * interval.Seconds())
+	final := cycleDuration(rate * preShutdown)
+
+	return time.Duration(final * float64(time.Second)), true
+}
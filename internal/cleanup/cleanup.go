@@ -0,0 +1,97 @@
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type Func func(ctx context.Context) error
+
+type entry struct {
+	name string
+	fn   Func
+}
+
+// Stack runs cleanup functions in the reverse order they were pushed in.  The
+// functions are called with a context which is not cancelled along with the
+// parent context, so that they still run once the process is interrupted.
+type Stack struct {
+	mu      sync.Mutex
+	entries []*entry
+}
+
+// Push adds a cleanup function to the stack, the returned function runs it
+// early and removes it from the stack.  It does nothing if the cleanup has
+// already run.
+func (s *Stack) Push(name string, fn Func) Func {
+	e := &entry{name: name, fn: fn}
+
+	s.mu.Lock()
+	s.entries = append(s.entries, e)
+	s.mu.Unlock()
+
+	return func(ctx context.Context) error {
+		if !s.remove(e) {
+			return nil
+		}
+
+		return e.run(ctx)
+	}
+}
+
+func (s *Stack) remove(e *entry) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, other := range s.entries {
+		if other == e {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Stack) pop() *entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.entries) == 0 {
+		return nil
+	}
+
+	e := s.entries[len(s.entries)-1]
+	s.entries = s.entries[:len(s.entries)-1]
+
+	return e
+}
+
+// Run runs all the cleanup functions on the stack, it keeps going if one of
+// them fails and returns all the errors.
+func (s *Stack) Run(ctx context.Context) error {
+	var errs []error
+	for e := s.pop(); e != nil; e = s.pop() {
+		if err := e.run(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (e *entry) run(ctx context.Context) error {
+	log.WithFields(log.Fields{
+		"cleanup": e.name,
+	}).Debug("Running cleanup")
+
+	if err := e.fn(context.WithoutCancel(ctx)); err != nil {
+		return fmt.Errorf("failed to %s: %w", e.name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+// Package config reads the migratekit configuration file, which holds named
+// vCenters, OpenStack clouds and profiles combining them with default
+// migration options so that they do not have to be repeated on every run.
+//
+// Every option is named after the flag it sets, without the leading dashes:
+//
+//	default-profile: production
+//
+//	vcenters:
+//	  vcenter-a:
+//	    vmware-endpoint: vcenter-a.example.com
+//	    vmware-username: migration@vsphere.local
+//	    vmware-password-command: vault kv get -field=password secret/vcenter-a
+//
+//	clouds:
+//	  production:
+//	    os-cloud: production
+//	    volume-type: ssd
+//	    disk-bus-type: scsi
+//
+//	profiles:
+//	  production:
+//	    vcenter: vcenter-a
+//	    cloud: production
+//	    availability-zone: nova
+//	    security-groups: [default]
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+var ErrProfileNotFound = errors.New("profile not found")
+
+// Values are options by the name of their flag, a list sets a flag which
+// can be repeated once for every element.
+type Values map[string]interface{}
+
+type Profile struct {
+	// VCenter and Cloud name the entries of the file whose options the
+	// profile starts from
+	VCenter string `yaml:"vcenter"`
+	Cloud   string `yaml:"cloud"`
+
+	// Values override the options of the vCenter and the cloud
+	Values Values `yaml:",inline"`
+}
+
+type File struct {
+	// DefaultProfile is used when no profile is selected
+	DefaultProfile string `yaml:"default-profile"`
+
+	VCenters map[string]Values   `yaml:"vcenters"`
+	Clouds   map[string]Values   `yaml:"clouds"`
+	Profiles map[string]*Profile `yaml:"profiles"`
+}
+
+// Option is a resolved option of a profile, a flag is set once for each of
+// its values.
+type Option struct {
+	Name   string
+	Values []string
+}
+
+// DefaultPaths are the files the configuration is read from if none is
+// given, the first one which exists is used.
+func DefaultPaths() []string {
+	var paths []string
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, "migratekit", "config.yaml"))
+	}
+
+	return append(paths, "/etc/migratekit/config.yaml")
+}
+
+// Find returns the first of the default paths which exists, empty if none
+// does.
+func Find() (string, error) {
+	for _, path := range DefaultPaths() {
+		_, err := os.Stat(path)
+		if err == nil {
+			return path, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+
+	return "", nil
+}
+
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f File
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return &f, nil
+}
+
+// Profile returns the options of a profile sorted by name, the ones of the
+// profile itself override the ones of its cloud, which override the ones of
+// its vCenter.
+func (f *File) Profile(name string) ([]Option, error) {
+	profile, ok := f.Profiles[name]
+	if !ok || profile == nil {
+		return nil, fmt.Errorf("%w: %s", ErrProfileNotFound, name)
+	}
+
+	merged := Values{}
+
+	if profile.VCenter != "" {
+		values, ok := f.VCenters[profile.VCenter]
+		if !ok {
+			return nil, fmt.Errorf("vCenter %s of profile %s not found", profile.VCenter, name)
+		}
+
+		merge(merged, values)
+	}
+
+	if profile.Cloud != "" {
+		values, ok := f.Clouds[profile.Cloud]
+		if !ok {
+			return nil, fmt.Errorf("cloud %s of profile %s not found", profile.Cloud, name)
+		}
+
+		merge(merged, values)
+	}
+
+	merge(merged, profile.Values)
+
+	options := make([]Option, 0, len(merged))
+	for key, value := range merged {
+		values, err := stringValues(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of %s in profile %s: %w", key, name, err)
+		}
+
+		options = append(options, Option{Name: key, Values: values})
+	}
+
+	sort.Slice(options, func(i, j int) bool {
+		return options[i].Name < options[j].Name
+	})
+
+	return options, nil
+}
+
+func merge(dst Values, src Values) {
+	for key, value := range src {
+		dst[key] = value
+	}
+}
+
+func stringValues(value interface{}) ([]string, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, errors.New("no value")
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, element := range value {
+			v, err := stringValues(element)
+			if err != nil {
+				return nil, err
+			} else if len(v) != 1 {
+				return nil, errors.New("nested lists are not supported")
+			}
+
+			values = append(values, v[0])
+		}
+
+		return values, nil
+	case map[interface{}]interface{}:
+		return nil, errors.New("maps are not supported, expected a value or a list")
+	default:
+		return []string{fmt.Sprint(value)}, nil
+	}
+}
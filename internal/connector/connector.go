@@ -0,0 +1,161 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrUnsupportedVolumeType = errors.New("unsupported volume driver type")
+
+// Properties describes this host to Cinder when initializing a connection, it
+// is used to export the volume to this host.
+type Properties struct {
+	IP        string
+	Host      string
+	Initiator string
+}
+
+// Connection attaches a volume exported by Cinder to this host.
+type Connection interface {
+	// Connect attaches the volume and returns the path of its block device
+	Connect(ctx context.Context) (string, error)
+	Disconnect(ctx context.Context) error
+}
+
+// LocalProperties returns the connector properties of this host, the IP is
+// the address which is used to reach the given endpoint unless it is set.
+func LocalProperties(ip string, endpoint string) (*Properties, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	if ip == "" {
+		// No packets are sent when "connecting" an UDP socket, it only
+		// selects the local address from the routing table
+		conn, err := net.Dial("udp", endpoint)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+
+		ip = conn.LocalAddr().(*net.UDPAddr).IP.String()
+	}
+
+	properties := &Properties{
+		IP:   ip,
+		Host: hostname,
+	}
+
+	data, err := os.ReadFile("/etc/iscsi/initiatorname.iscsi")
+	if err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if name, ok := strings.CutPrefix(strings.TrimSpace(line), "InitiatorName="); ok {
+				properties.Initiator = name
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return properties, nil
+}
+
+// New returns the connection for the connection info returned by Cinder's
+// os-initialize_connection.
+func New(info map[string]any) (Connection, error) {
+	data, _ := info["data"].(map[string]any)
+
+	switch volumeType, _ := info["driver_volume_type"].(string); volumeType {
+	case "iscsi":
+		return newISCSI(data)
+	case "rbd":
+		return newRBD(data)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedVolumeType, volumeType)
+	}
+}
+
+// Resume returns the connection for the connection info of a volume which a
+// previous run connected to the given device and did not disconnect.
+func Resume(info map[string]any, device string) (Connection, error) {
+	connection, err := New(info)
+	if err != nil {
+		return nil, err
+	}
+
+	// The device of an iSCSI target is found again through its session
+	if c, ok := connection.(*rbd); ok {
+		c.device = device
+	}
+
+	return connection, nil
+}
+
+func getString(data map[string]any, key string) string {
+	switch value := data[key].(type) {
+	case string:
+		return value
+	case float64:
+		return fmt.Sprintf("%d", int64(value))
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+func getStrings(data map[string]any, key string) []string {
+	values, _ := data[key].([]any)
+
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		result = append(result, fmt.Sprint(value))
+	}
+
+	return result
+}
+
+func run(ctx context.Context, name string, args ...string) (string, error) {
+	log.WithFields(log.Fields{
+		"command": name,
+		"args":    args,
+	}).Debug("Running command")
+
+	cmd := exec.CommandContext(ctx, name, args...)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %w: %s", name, err, strings.TrimSpace(string(output)))
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+func waitForDevice(ctx context.Context, path string) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for device %s", path)
+		case <-ticker.C:
+		}
+	}
+}
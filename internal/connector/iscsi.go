@@ -0,0 +1,179 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// nodeDirs are where open-iscsi keeps its node records, which depends on the
+// distribution
+var nodeDirs = []string{"/etc/iscsi/nodes", "/var/lib/iscsi/nodes"}
+
+type iscsi struct {
+	portal       string
+	iqn          string
+	lun          string
+	authMethod   string
+	authUsername string
+	authPassword string
+}
+
+func newISCSI(data map[string]any) (*iscsi, error) {
+	c := &iscsi{
+		portal:       getString(data, "target_portal"),
+		iqn:          getString(data, "target_iqn"),
+		lun:          getString(data, "target_lun"),
+		authMethod:   getString(data, "auth_method"),
+		authUsername: getString(data, "auth_username"),
+		authPassword: getString(data, "auth_password"),
+	}
+
+	if c.portal == "" || c.iqn == "" {
+		return nil, errors.New("missing target portal or iqn in connection info")
+	}
+
+	if c.lun == "" {
+		c.lun = "0"
+	}
+
+	return c, nil
+}
+
+func (c *iscsi) iscsiadm(ctx context.Context, args ...string) (string, error) {
+	return run(ctx, "iscsiadm", append([]string{"-m", "node", "-T", c.iqn, "-p", c.portal}, args...)...)
+}
+
+func (c *iscsi) Connect(ctx context.Context) (string, error) {
+	_, err := c.iscsiadm(ctx, "--interface", "default", "--op", "new")
+	if err != nil {
+		return "", err
+	}
+
+	if c.authMethod != "" {
+		err = c.writeAuth()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	_, err = c.iscsiadm(ctx, "--login")
+	if err != nil {
+		// Exit code 15 means the session already exists
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 15 {
+			return "", err
+		}
+	}
+
+	path := fmt.Sprintf("/dev/disk/by-path/ip-%s-iscsi-%s-lun-%s", c.portal, c.iqn, c.lun)
+	err = waitForDevice(ctx, path)
+	if err != nil {
+		return "", err
+	}
+
+	device, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+
+	log.WithFields(log.Fields{
+		"portal": c.portal,
+		"iqn":    c.iqn,
+		"device": device,
+	}).Info("iSCSI volume connected")
+
+	return device, nil
+}
+
+// nodeRecord returns the path of the record of the node for the default
+// interface, which iscsiadm names after the target, the portal and its target
+// portal group tag.
+func (c *iscsi) nodeRecord() (string, error) {
+	host, port, err := net.SplitHostPort(c.portal)
+	if err != nil {
+		return "", err
+	}
+
+	for _, dir := range nodeDirs {
+		matches, err := filepath.Glob(filepath.Join(dir, c.iqn, host+","+port+",*", "default"))
+		if err != nil {
+			return "", err
+		}
+
+		if len(matches) > 0 {
+			return matches[0], nil
+		}
+	}
+
+	return "", fmt.Errorf("node record of %s at %s not found in %s", c.iqn, c.portal, strings.Join(nodeDirs, " or "))
+}
+
+// writeAuth writes the CHAP credentials into the node record directly rather
+// than with "iscsiadm --op update", which would expose the password on its
+// command line.  The record is replaced by a file only readable by root.
+func (c *iscsi) writeAuth() error {
+	path, err := c.nodeRecord()
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	auth := []string{
+		"node.session.auth.authmethod = " + c.authMethod,
+		"node.session.auth.username = " + c.authUsername,
+		"node.session.auth.password = " + c.authPassword,
+	}
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "node.session.auth."):
+			continue
+		case strings.HasPrefix(line, "# END RECORD"):
+			lines = append(lines, auth...)
+			auth = nil
+		}
+
+		lines = append(lines, line)
+	}
+	lines = append(lines, auth...)
+
+	file, err := os.CreateTemp(filepath.Dir(path), ".default-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(strings.Join(lines, "\n") + "\n")
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+func (c *iscsi) Disconnect(ctx context.Context) error {
+	_, err := c.iscsiadm(ctx, "--logout")
+	if err != nil {
+		log.WithError(err).Warn("Failed to log out of iSCSI target")
+	}
+
+	_, err = c.iscsiadm(ctx, "--op", "delete")
+	return err
+}
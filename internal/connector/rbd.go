@@ -0,0 +1,118 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type rbd struct {
+	name     string
+	cluster  string
+	monitors []string
+	user     string
+	keyring  string
+	device   string
+}
+
+func newRBD(data map[string]any) (*rbd, error) {
+	c := &rbd{
+		name:    getString(data, "name"),
+		cluster: getString(data, "cluster_name"),
+		user:    getString(data, "auth_username"),
+		keyring: getString(data, "keyring"),
+	}
+
+	if c.name == "" {
+		return nil, errors.New("missing image name in connection info")
+	}
+
+	hosts, ports := getStrings(data, "hosts"), getStrings(data, "ports")
+	for i, host := range hosts {
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		if i < len(ports) {
+			host = host + ":" + ports[i]
+		}
+
+		c.monitors = append(c.monitors, host)
+	}
+
+	return c, nil
+}
+
+func (c *rbd) Connect(ctx context.Context) (string, error) {
+	args := []string{"map", c.name}
+
+	if c.cluster != "" {
+		args = append(args, "--cluster", c.cluster)
+	}
+
+	if len(c.monitors) > 0 {
+		args = append(args, "--mon_host", strings.Join(c.monitors, ","))
+	}
+
+	if c.user != "" {
+		args = append(args, "--id", c.user)
+	}
+
+	// The keyring is only part of the connection info if Cinder is configured
+	// to share it, otherwise the one in /etc/ceph is used.
+	if c.keyring != "" {
+		file, err := os.CreateTemp("", "migratekit-keyring-")
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(file.Name())
+
+		_, err = file.WriteString(c.keyring)
+		if err == nil {
+			err = file.Close()
+		}
+		if err != nil {
+			file.Close()
+			return "", err
+		}
+
+		args = append(args, "--keyring", file.Name())
+	}
+
+	device, err := run(ctx, "rbd", args...)
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.HasPrefix(device, "/dev/") {
+		return "", fmt.Errorf("unexpected output from rbd map: %s", device)
+	}
+
+	c.device = device
+
+	log.WithFields(log.Fields{
+		"image":  c.name,
+		"device": device,
+	}).Info("RBD volume connected")
+
+	return device, nil
+}
+
+func (c *rbd) Disconnect(ctx context.Context) error {
+	if c.device == "" {
+		return nil
+	}
+
+	_, err := run(ctx, "rbd", "unmap", c.device)
+	if err != nil {
+		return err
+	}
+
+	c.device = ""
+
+	return nil
+}
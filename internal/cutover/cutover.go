@@ -0,0 +1,104 @@
+// Package cutover completes the migration of a virtual machine by creating
+// its server on OpenStack, independently of where it is migrated from.
+package cutover
+
+import (
+	"context"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/flavors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vexxhost/migratekit/cmd"
+	"github.com/vexxhost/migratekit/internal/machine"
+	"github.com/vexxhost/migratekit/internal/openstack"
+)
+
+type Options struct {
+	FlavorID         string
+	NetworkMapping   *cmd.NetworkMappingFlag
+	SecurityGroups   []string
+	AvailabilityZone string
+	RunV2V           bool
+}
+
+// MigrateFunc copies the disks of the virtual machine to their volumes for
+// the last time, after which the server is created from them.
+type MigrateFunc func(ctx context.Context) error
+
+// Complete ensures the ports of the virtual machine exist, runs migrate unless
+// the volumes were already handed over to the destination project, and then
+// creates the server from the volumes.
+func Complete(ctx context.Context, config *openstack.Config, vm *machine.VirtualMachine, opts *Options, migrate MigrateFunc) error {
+	clients, err := openstack.NewClientSet(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	conversionClients, err := openstack.NewConversionClientSet(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	// Volumes are migrated in the project of the conversion host and handed
+	// over to the destination project once the final cycle has completed
+	transfer := conversionClients.ProjectID != clients.ProjectID
+
+	log.Info("Ensuring OpenStack resources exist")
+
+	flavor, err := flavors.Get(ctx, clients.Compute, opts.FlavorID).Extract()
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"flavor": flavor.Name,
+	}).Info("Flavor exists, ensuring network resources exist")
+
+	v := openstack.PortCreateOpts{}
+	if len(opts.SecurityGroups) > 0 {
+		v.SecurityGroups = &opts.SecurityGroups
+	}
+
+	networks, err := clients.EnsurePortsForVirtualMachine(ctx, vm, opts.NetworkMapping, &v)
+	if err != nil {
+		return err
+	}
+
+	transferred := false
+	if transfer {
+		transferred, err = clients.HasTransferredVolumesForVirtualMachine(ctx, vm)
+		if err != nil {
+			return err
+		}
+	}
+
+	if transferred {
+		log.Warn("Volumes were already transferred to the destination project, skipping migration cycles and transferring the remaining volumes")
+	} else {
+		err = migrate(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if transfer {
+		log.WithFields(log.Fields{
+			"project_id": clients.ProjectID,
+		}).Info("Transferring volumes to the destination project")
+
+		err = conversionClients.TransferVolumesForVirtualMachine(ctx, vm, clients)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Info("Spinning up new OpenStack VM")
+
+	err = clients.CreateResourcesForVirtualMachine(ctx, vm, opts.FlavorID, networks, opts.AvailabilityZone)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Cutover completed")
+
+	return nil
+}
@@ -0,0 +1,529 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/vexxhost/migratekit/cmd"
+	"github.com/vexxhost/migratekit/internal/cutover"
+	"github.com/vexxhost/migratekit/internal/target"
+	"github.com/vexxhost/migratekit/internal/vmware"
+	"github.com/vexxhost/migratekit/internal/vmware_nbdkit"
+	"github.com/vmware/govmomi/vim25"
+)
+
+var (
+	ErrJobBusy        = errors.New("job already has a pending or running operation")
+	ErrJobCompleted   = errors.New("job has already been cut over")
+	ErrJobNotRunning  = errors.New("job has no pending or running operation")
+	ErrSnapshotExists = errors.New("migratekit snapshot already exists on the virtual machine, remove it before retrying")
+)
+
+type ValidationError struct {
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// Progress is how far the copy of a disk of the running operation of a job
+// has got.
+type Progress struct {
+	Disk      string    `json:"disk"`
+	Offset    int64     `json:"offset"`
+	Size      int64     `json:"size"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Manager runs the operations of all jobs one at a time, the logs emitted
+// while an operation runs are captured into the log file of its job.
+type Manager struct {
+	ctx        context.Context
+	client     *vim25.Client
+	vddkConfig *vmware_nbdkit.VddkConfig
+	config     *target.Config
+	store      *Store
+
+	queue    chan string
+	mu       sync.Mutex
+	cancels  map[string]context.CancelFunc
+	timers   map[string]*time.Timer
+	progress map[string]Progress
+
+	logMu   sync.Mutex
+	logFile *os.File
+}
+
+// NewManager creates a manager, ctx is used as the parent of every operation
+// and config is how the volumes of every job are created and attached.
+func NewManager(ctx context.Context, client *vim25.Client, vddkConfig *vmware_nbdkit.VddkConfig, config *target.Config, store *Store) *Manager {
+	m := &Manager{
+		ctx:        ctx,
+		client:     client,
+		vddkConfig: vddkConfig,
+		config:     config,
+		store:      store,
+		queue:      make(chan string, 1024),
+		cancels:    map[string]context.CancelFunc{},
+		timers:     map[string]*time.Timer{},
+		progress:   map[string]Progress{},
+	}
+
+	log.AddHook(m)
+
+	return m
+}
+
+// Recover restores the jobs that were queued or scheduled before the daemon
+// was stopped, operations which were running at the time are marked failed.
+func (m *Manager) Recover() error {
+	for _, job := range m.store.List() {
+		switch job.State {
+		case JobStateRunning:
+			_, err := m.store.Update(job.ID, func(j *Job) error {
+				j.State = JobStateFailed
+				j.Error = "interrupted by daemon restart"
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		case JobStateQueued:
+			m.enqueue(job.ID)
+		case JobStateScheduled:
+			m.schedule(job.ID, *job.CutoverAt)
+		}
+	}
+
+	return nil
+}
+
+func (m *Manager) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-m.queue:
+			m.run(id)
+		}
+	}
+}
+
+func (m *Manager) CreateJob(job *Job) (Job, error) {
+	if job.VirtualMachinePath == "" {
+		return Job{}, &ValidationError{Message: "vm_path is required"}
+	}
+
+	if len(job.Cutover.NetworkMappings) > 0 {
+		if _, err := networkMapping(job.Cutover.NetworkMappings); err != nil {
+			return Job{}, &ValidationError{Message: err.Error()}
+		}
+	}
+
+	job.ID = uuid.NewString()
+	job.State = JobStateIdle
+
+	if err := m.store.Create(job); err != nil {
+		return Job{}, err
+	}
+
+	return *job, nil
+}
+
+func (m *Manager) Migrate(id string) (Job, error) {
+	job, err := m.store.Update(id, func(j *Job) error {
+		if err := checkIdle(j); err != nil {
+			return err
+		}
+
+		j.State = JobStateQueued
+		j.Operation = OperationMigrate
+		j.CutoverAt = nil
+		return nil
+	})
+	if err != nil {
+		return Job{}, err
+	}
+
+	m.enqueue(id)
+
+	return job, nil
+}
+
+// Cutover queues a cutover for the job, if at is in the future the cutover
+// is scheduled instead and only queued once that time is reached.
+func (m *Manager) Cutover(id string, at *time.Time) (Job, error) {
+	job, err := m.store.Update(id, func(j *Job) error {
+		if err := checkIdle(j); err != nil {
+			return err
+		}
+
+		if _, err := cutoverOptions(j); err != nil {
+			return &ValidationError{Message: err.Error()}
+		}
+
+		j.Operation = OperationCutover
+		j.CutoverAt = nil
+		j.State = JobStateQueued
+
+		if at != nil && at.After(time.Now()) {
+			j.CutoverAt = at
+			j.State = JobStateScheduled
+		}
+
+		return nil
+	})
+	if err != nil {
+		return Job{}, err
+	}
+
+	if job.State == JobStateScheduled {
+		m.schedule(id, *job.CutoverAt)
+	} else {
+		m.enqueue(id)
+	}
+
+	return job, nil
+}
+
+func (m *Manager) Cancel(id string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, err := m.store.Update(id, func(j *Job) error {
+		switch j.State {
+		case JobStateQueued, JobStateScheduled:
+			j.State = JobStateCancelled
+			j.CutoverAt = nil
+			return nil
+		case JobStateRunning:
+			return nil
+		default:
+			return ErrJobNotRunning
+		}
+	})
+	if err != nil {
+		return Job{}, err
+	}
+
+	if timer, ok := m.timers[id]; ok {
+		timer.Stop()
+		delete(m.timers, id)
+	}
+
+	if cancel, ok := m.cancels[id]; ok {
+		log.WithFields(log.Fields{
+			"job": id,
+		}).Warn("Cancelling running operation")
+		cancel()
+	}
+
+	return job, nil
+}
+
+func (m *Manager) Get(id string) (Job, error) {
+	return m.store.Get(id)
+}
+
+func (m *Manager) List() []Job {
+	return m.store.List()
+}
+
+func (m *Manager) LogPath(id string) string {
+	return m.store.LogPath(id)
+}
+
+// Progress returns how far the copy of a disk of the running operation of
+// the job has got, if it has started copying.
+func (m *Manager) Progress(id string) (Progress, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	progress, ok := m.progress[id]
+	return progress, ok
+}
+
+func (m *Manager) setProgress(id string, disk string, offset, size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.progress[id] = Progress{
+		Disk:      disk,
+		Offset:    offset,
+		Size:      size,
+		UpdatedAt: time.Now(),
+	}
+}
+
+func checkIdle(j *Job) error {
+	switch j.State {
+	case JobStateQueued, JobStateScheduled, JobStateRunning:
+		return ErrJobBusy
+	case JobStateCompleted:
+		return ErrJobCompleted
+	}
+
+	return nil
+}
+
+func (m *Manager) enqueue(id string) {
+	go func() {
+		m.queue <- id
+	}()
+}
+
+func (m *Manager) schedule(id string, at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"job": id,
+		"at":  at,
+	}).Info("Scheduled cutover")
+
+	m.timers[id] = time.AfterFunc(time.Until(at), func() {
+		m.mu.Lock()
+		delete(m.timers, id)
+		m.mu.Unlock()
+
+		_, err := m.store.Update(id, func(j *Job) error {
+			if j.State != JobStateScheduled {
+				return ErrJobNotRunning
+			}
+
+			j.State = JobStateQueued
+			return nil
+		})
+		if err != nil {
+			return
+		}
+
+		m.enqueue(id)
+	})
+}
+
+func (m *Manager) run(id string) {
+	job, err := m.store.Update(id, func(j *Job) error {
+		if j.State != JobStateQueued {
+			return ErrJobNotRunning
+		}
+
+		j.State = JobStateRunning
+		j.Error = ""
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(m.ctx)
+	m.mu.Lock()
+	m.cancels[id] = cancel
+	m.mu.Unlock()
+
+	m.startLog(id)
+
+	logger := log.WithFields(log.Fields{
+		"job":       id,
+		"vm":        job.VirtualMachinePath,
+		"operation": job.Operation,
+	})
+
+	logger.Info("Starting operation")
+	err = m.execute(ctx, &job)
+	if err != nil {
+		logger.WithError(err).Error("Operation failed")
+	} else {
+		logger.Info("Operation completed")
+	}
+
+	m.stopLog()
+
+	m.mu.Lock()
+	delete(m.cancels, id)
+	delete(m.progress, id)
+	m.mu.Unlock()
+	cancel()
+
+	_, updateErr := m.store.Update(id, func(j *Job) error {
+		now := time.Now()
+
+		switch {
+		case err == nil && j.Operation == OperationCutover:
+			j.State = JobStateCompleted
+			j.Cycles += 2
+			j.LastCycleAt = &now
+		case err == nil:
+			j.State = JobStateIdle
+			j.Cycles++
+			j.LastCycleAt = &now
+		case ctx.Err() != nil:
+			j.State = JobStateCancelled
+			j.Error = err.Error()
+		default:
+			j.State = JobStateFailed
+			j.Error = err.Error()
+		}
+
+		j.CutoverAt = nil
+		return nil
+	})
+	if updateErr != nil {
+		logger.WithError(updateErr).Error("Failed to update job state")
+	}
+}
+
+func (m *Manager) execute(ctx context.Context, job *Job) (err error) {
+	vm, err := vmware.FindVirtualMachine(ctx, m.client, job.VirtualMachinePath)
+	if err != nil {
+		return err
+	}
+
+	err = vmware.EnsureChangeTracking(ctx, vm)
+	if err != nil {
+		return err
+	}
+
+	lock, err := vmware.AcquireLock(ctx, vm, fmt.Sprintf("serve (%s)", job.Operation), false)
+	if errors.Is(err, vmware.ErrLockNotUsable) {
+		log.Debug("Run locks are not supported by the endpoint, continuing without one")
+	} else if err != nil {
+		return err
+	} else {
+		defer func() {
+			if err := lock.Release(context.WithoutCancel(ctx)); err != nil {
+				log.WithError(err).Warn("Failed to release run lock")
+			}
+		}()
+	}
+
+	ctx, cancel := lock.Guard(ctx)
+	defer cancel()
+	defer func() {
+		if cause := context.Cause(ctx); errors.Is(cause, vmware.ErrLockLost) {
+			err = errors.Join(err, cause)
+		}
+	}()
+
+	if snapshotRef, _ := vm.FindSnapshot(ctx, "migratekit"); snapshotRef != nil {
+		return ErrSnapshotExists
+	}
+
+	onProgress := func(disk string, offset, size int64) {
+		m.setProgress(job.ID, disk, offset, size)
+	}
+
+	switch job.Operation {
+	case OperationMigrate:
+		servers := vmware_nbdkit.NewNbdkitServers(m.vddkConfig, m.config, vm)
+		servers.OnProgress = onProgress
+		return servers.MigrationCycle(ctx, false)
+	case OperationCutover:
+		opts, err := cutoverOptions(job)
+		if err != nil {
+			return err
+		}
+
+		return vmware_nbdkit.Cutover(ctx, vm, m.vddkConfig, m.config, opts, onProgress)
+	default:
+		return fmt.Errorf("unknown operation: %s", job.Operation)
+	}
+}
+
+func networkMapping(mappings []string) (*cmd.NetworkMappingFlag, error) {
+	flag := &cmd.NetworkMappingFlag{}
+	for _, mapping := range mappings {
+		if err := flag.Set(mapping); err != nil {
+			return nil, err
+		}
+	}
+
+	return flag, nil
+}
+
+func cutoverOptions(job *Job) (*cutover.Options, error) {
+	if job.Cutover.FlavorID == "" {
+		return nil, errors.New("cutover.flavor is required")
+	}
+
+	if job.Cutover.AvailabilityZone == "" {
+		return nil, errors.New("cutover.availability_zone is required")
+	}
+
+	if len(job.Cutover.NetworkMappings) == 0 {
+		return nil, errors.New("cutover.network_mappings is required")
+	}
+
+	mapping, err := networkMapping(job.Cutover.NetworkMappings)
+	if err != nil {
+		return nil, err
+	}
+
+	runV2V := true
+	if job.Cutover.RunV2V != nil {
+		runV2V = *job.Cutover.RunV2V
+	}
+
+	return &cutover.Options{
+		FlavorID:         job.Cutover.FlavorID,
+		NetworkMapping:   mapping,
+		SecurityGroups:   job.Cutover.SecurityGroups,
+		AvailabilityZone: job.Cutover.AvailabilityZone,
+		RunV2V:           runV2V,
+	}, nil
+}
+
+var logFormatter = &log.TextFormatter{
+	DisableColors: true,
+	FullTimestamp: true,
+}
+
+func (m *Manager) startLog(id string) {
+	file, err := os.OpenFile(m.store.LogPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.WithError(err).Error("Failed to open job log")
+		return
+	}
+
+	m.logMu.Lock()
+	m.logFile = file
+	m.logMu.Unlock()
+}
+
+func (m *Manager) stopLog() {
+	m.logMu.Lock()
+	defer m.logMu.Unlock()
+
+	if m.logFile != nil {
+		m.logFile.Close()
+		m.logFile = nil
+	}
+}
+
+func (m *Manager) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (m *Manager) Fire(entry *log.Entry) error {
+	m.logMu.Lock()
+	defer m.logMu.Unlock()
+
+	if m.logFile == nil {
+		return nil
+	}
+
+	line, err := logFormatter.Format(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.logFile.Write(line)
+	return err
+}
@@ -0,0 +1,312 @@
+package daemon
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const pollInterval = time.Second
+
+type Server struct {
+	manager *Manager
+	mux     *http.ServeMux
+	token   string
+}
+
+// NewServer creates the HTTP API of the manager.  Every request must either
+// carry the token as a bearer token or come with a verified TLS client
+// certificate, since the jobs and their logs name the virtual machines and
+// hosts.  Requests are all rejected if the token is empty and the server does
+// not verify client certificates.
+func NewServer(manager *Manager, token string) *Server {
+	s := &Server{
+		manager: manager,
+		mux:     http.NewServeMux(),
+		token:   token,
+	}
+
+	s.mux.HandleFunc("GET /jobs", s.authorized(s.listJobs))
+	s.mux.HandleFunc("POST /jobs", s.authorized(s.createJob))
+	s.mux.HandleFunc("GET /jobs/{id}", s.authorized(s.getJob))
+	s.mux.HandleFunc("POST /jobs/{id}/migrate", s.authorized(s.migrateJob))
+	s.mux.HandleFunc("POST /jobs/{id}/cutover", s.authorized(s.cutoverJob))
+	s.mux.HandleFunc("POST /jobs/{id}/cancel", s.authorized(s.cancelJob))
+	s.mux.HandleFunc("GET /jobs/{id}/logs", s.authorized(s.jobLogs))
+	s.mux.HandleFunc("GET /jobs/{id}/events", s.authorized(s.jobEvents))
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.WithFields(log.Fields{
+		"method": r.Method,
+		"path":   r.URL.Path,
+	}).Debug("Handling request")
+
+	s.mux.ServeHTTP(w, r)
+}
+
+// authorized only calls the handler if the request is authenticated
+func (s *Server) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			handler(w, r)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && s.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1 {
+			handler(w, r)
+			return
+		}
+
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, map[string]string{
+			"error": "a valid bearer token or client certificate is required",
+		})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Error("Failed to encode response")
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+
+	var validationErr *ValidationError
+	switch {
+	case errors.Is(err, ErrJobNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrJobBusy), errors.Is(err, ErrJobCompleted), errors.Is(err, ErrJobNotRunning):
+		status = http.StatusConflict
+	case errors.As(err, &validationErr):
+		status = http.StatusBadRequest
+	}
+
+	writeJSON(w, status, map[string]string{
+		"error": err.Error(),
+	})
+}
+
+func decodeBody(r *http.Request, v any) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if errors.Is(err, io.EOF) {
+		return nil
+	} else if err != nil {
+		return &ValidationError{Message: fmt.Sprintf("invalid request body: %s", err)}
+	}
+
+	return nil
+}
+
+func (s *Server) listJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.manager.List())
+}
+
+func (s *Server) createJob(w http.ResponseWriter, r *http.Request) {
+	var job Job
+	if err := decodeBody(r, &job); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	created, err := s.manager.CreateJob(&job)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func (s *Server) getJob(w http.ResponseWriter, r *http.Request) {
+	job, err := s.manager.Get(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (s *Server) migrateJob(w http.ResponseWriter, r *http.Request) {
+	job, err := s.manager.Migrate(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+type cutoverRequest struct {
+	At *time.Time `json:"at,omitempty"`
+}
+
+func (s *Server) cutoverJob(w http.ResponseWriter, r *http.Request) {
+	var req cutoverRequest
+	if err := decodeBody(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	job, err := s.manager.Cutover(r.PathValue("id"), req.At)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+func (s *Server) cancelJob(w http.ResponseWriter, r *http.Request) {
+	job, err := s.manager.Cancel(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+func isActive(job Job) bool {
+	return job.State == JobStateQueued || job.State == JobStateScheduled || job.State == JobStateRunning
+}
+
+// jobLogs returns the log of the job, if the "follow" query parameter is set
+// the response is streamed until the job has no more operations running.
+func (s *Server) jobLogs(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := s.manager.Get(id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	follow := r.URL.Query().Get("follow") != ""
+	flusher, _ := w.(http.Flusher)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	var file *os.File
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	for {
+		// The log file only exists once the first operation of the job started
+		if file == nil {
+			file, _ = os.Open(s.manager.LogPath(id))
+		}
+
+		if file != nil {
+			if _, err := io.Copy(w, file); err != nil {
+				return
+			}
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if !follow {
+			return
+		}
+
+		job, err := s.manager.Get(id)
+		if err != nil || !isActive(job) {
+			if file != nil {
+				io.Copy(w, file)
+			}
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// jobEvents streams the state of the job as server-sent events every time it
+// changes, along with the progress of the copy of its disks while an
+// operation is running, until the job has no more operations running.
+func (s *Server) jobEvents(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := s.manager.Get(id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	flusher, _ := w.(http.Flusher)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	var lastUpdate, lastProgress time.Time
+	for {
+		job, err := s.manager.Get(id)
+		if err != nil {
+			return
+		}
+
+		if !job.UpdatedAt.Equal(lastUpdate) {
+			lastUpdate = job.UpdatedAt
+
+			data, err := json.Marshal(job)
+			if err != nil {
+				return
+			}
+
+			fmt.Fprintf(w, "event: job\ndata: %s\n\n", data)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if progress, ok := s.manager.Progress(id); ok && !progress.UpdatedAt.Equal(lastProgress) {
+			lastProgress = progress.UpdatedAt
+
+			data, err := json.Marshal(progress)
+			if err != nil {
+				return
+			}
+
+			fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if !isActive(job) {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrJobNotFound = errors.New("job not found")
+
+type JobState string
+
+const (
+	JobStateIdle      JobState = "idle"
+	JobStateQueued    JobState = "queued"
+	JobStateScheduled JobState = "scheduled"
+	JobStateRunning   JobState = "running"
+	JobStateFailed    JobState = "failed"
+	JobStateCancelled JobState = "cancelled"
+	JobStateCompleted JobState = "completed"
+)
+
+type Operation string
+
+const (
+	OperationMigrate Operation = "migrate"
+	OperationCutover Operation = "cutover"
+)
+
+type CutoverOptions struct {
+	FlavorID         string   `json:"flavor"`
+	NetworkMappings  []string `json:"network_mappings"`
+	SecurityGroups   []string `json:"security_groups,omitempty"`
+	AvailabilityZone string   `json:"availability_zone"`
+	RunV2V           *bool    `json:"run_v2v,omitempty"`
+}
+
+type Job struct {
+	ID                 string         `json:"id"`
+	VirtualMachinePath string         `json:"vm_path"`
+	Cutover            CutoverOptions `json:"cutover"`
+	State              JobState       `json:"state"`
+	Operation          Operation      `json:"operation,omitempty"`
+	CutoverAt          *time.Time     `json:"cutover_at,omitempty"`
+	Cycles             int            `json:"cycles"`
+	LastCycleAt        *time.Time     `json:"last_cycle_at,omitempty"`
+	Error              string         `json:"error,omitempty"`
+	CreatedAt          time.Time      `json:"created_at"`
+	UpdatedAt          time.Time      `json:"updated_at"`
+}
+
+// Store keeps track of all jobs and persists them as a single JSON document
+// inside of the state directory.
+type Store struct {
+	dir  string
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "logs"), 0700); err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		dir:  dir,
+		jobs: map[string]*Job{},
+	}
+
+	data, err := os.ReadFile(s.path())
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var jobs []*Job
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return nil, err
+	}
+
+	for _, job := range jobs {
+		s.jobs[job.ID] = job
+	}
+
+	return s, nil
+}
+
+func (s *Store) path() string {
+	return filepath.Join(s.dir, "jobs.json")
+}
+
+func (s *Store) LogPath(id string) string {
+	return filepath.Join(s.dir, "logs", id+".log")
+}
+
+func (s *Store) save() error {
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+
+	data, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path())
+}
+
+func (s *Store) List() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, *job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+
+	return jobs
+}
+
+func (s *Store) Get(id string) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+
+	return *job, nil
+}
+
+func (s *Store) Create(job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	job.CreatedAt = now
+	job.UpdatedAt = now
+	s.jobs[job.ID] = job
+
+	return s.save()
+}
+
+// Update applies fn to the job and persists the result, if fn returns an
+// error the job is left untouched.
+func (s *Store) Update(id string, fn func(*Job) error) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+
+	updated := *job
+	if err := fn(&updated); err != nil {
+		return Job{}, err
+	}
+
+	updated.UpdatedAt = time.Now()
+	s.jobs[id] = &updated
+
+	return updated, s.save()
+}
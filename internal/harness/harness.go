@@ -0,0 +1,63 @@
+// Package harness runs migratekit against a simulated vCenter and a fake
+// OpenStack, so that migration cycles can be exercised without VMware or an
+// OpenStack cloud.  Disks are served with the nbdkit file plugin in place of
+// VDDK and written to sparse files in place of volumes.
+package harness
+
+import (
+	"context"
+
+	"github.com/vexxhost/migratekit/internal/openstack"
+	"github.com/vexxhost/migratekit/internal/target"
+	"github.com/vexxhost/migratekit/internal/vmware_nbdkit"
+	"github.com/vmware/govmomi/object"
+)
+
+type Harness struct {
+	VCenter   *VCenter
+	OpenStack *OpenStack
+
+	// Dir is where the disks are written to by migration cycles
+	Dir string
+}
+
+// New starts a simulated vCenter and a fake OpenStack, migration cycles write
+// the disks to files in dir.
+func New(ctx context.Context, dir string) (*Harness, error) {
+	vcenter, err := NewVCenter(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Harness{
+		VCenter:   vcenter,
+		OpenStack: NewOpenStack(),
+		Dir:       dir,
+	}, nil
+}
+
+func (h *Harness) Close() {
+	h.OpenStack.Close()
+	h.VCenter.Close()
+}
+
+// Config returns the configuration that migratekit sets up from its default
+// flags, the credentials of the fake OpenStack are read from the environment.
+func (h *Harness) Config() *target.Config {
+	return &target.Config{
+		OpenStack: &openstack.Config{},
+		Volume:    target.VolumeCreateOpts{BusType: target.BusTypeVirtio},
+		Attach:    target.AttachOpts{Mode: target.AttachModeNova},
+	}
+}
+
+// NbdkitServers returns the nbdkit servers for a migration cycle of a virtual
+// machine of the simulated vCenter, like vmware_nbdkit.NewNbdkitServers does
+// for a real one.  A new one must be used for every cycle.
+func (h *Harness) NbdkitServers(vm *object.VirtualMachine) *vmware_nbdkit.NbdkitServers {
+	servers := vmware_nbdkit.NewNbdkitServers(&vmware_nbdkit.VddkConfig{}, h.Config(), vm)
+	servers.NewNbdkit = h.VCenter.NewNbdkit(vm)
+	servers.NewTarget = NewTarget(h.Dir)
+
+	return servers
+}
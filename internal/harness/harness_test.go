@@ -0,0 +1,235 @@
+package harness_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/vexxhost/migratekit/internal/harness"
+	"github.com/vexxhost/migratekit/internal/machine"
+	"github.com/vexxhost/migratekit/internal/target"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const vmPath = "/DC0/vm/DC0_H0_VM0"
+
+// fixture migrates the first disk of a virtual machine of the harness and
+// keeps track of the areas written to it, the disks of the simulator are too
+// large to be compared entirely.
+type fixture struct {
+	t       *testing.T
+	ctx     context.Context
+	h       *harness.Harness
+	vm      *object.VirtualMachine
+	disk    *types.VirtualDisk
+	written []types.DiskChangeExtent
+}
+
+// setup starts the harness, the test is skipped unless the tools that
+// migration cycles run are installed.
+func setup(t *testing.T) *fixture {
+	t.Helper()
+
+	if _, err := exec.LookPath("nbdkit"); err != nil {
+		t.Skip("nbdkit is not installed")
+	}
+
+	ctx := context.Background()
+
+	h, err := harness.New(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+
+	vm, err := h.VCenter.VirtualMachine(ctx, vmPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fixture{t: t, ctx: ctx, h: h, vm: vm}
+	f.disk = f.virtualDisk()
+
+	return f
+}
+
+func (f *fixture) virtualDisk() *types.VirtualDisk {
+	f.t.Helper()
+
+	devices, err := f.vm.Device(f.ctx)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	disks := devices.SelectByType((*types.VirtualDisk)(nil))
+	if len(disks) == 0 {
+		f.t.Fatalf("%s has no disks", vmPath)
+	}
+
+	return disks[0].(*types.VirtualDisk)
+}
+
+// changeID returns the current change ID of the disk
+func (f *fixture) changeID() string {
+	return f.virtualDisk().Backing.(*types.VirtualDiskFlatVer2BackingInfo).ChangeId
+}
+
+// path returns the file the harness writes the disk to
+func (f *fixture) path() string {
+	m := &machine.VirtualMachine{Name: f.vm.Name()}
+	return filepath.Join(f.h.Dir, m.DiskLabel(&machine.Disk{Key: f.disk.Key})+".img")
+}
+
+func (f *fixture) write(offset int64, fill byte, length int) {
+	f.t.Helper()
+
+	err := f.h.VCenter.WriteDisk(f.vm, f.disk.Key, offset, bytes.Repeat([]byte{fill}, length))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	f.written = append(f.written, types.DiskChangeExtent{Start: offset, Length: int64(length)})
+}
+
+func (f *fixture) cycle() (fullCopy bool, changedBytes int64) {
+	f.t.Helper()
+
+	servers := f.h.NbdkitServers(f.vm)
+	if err := servers.MigrationCycle(f.ctx, false); err != nil {
+		f.t.Fatal(err)
+	}
+
+	return servers.FullCopy(), servers.ChangedBytes()
+}
+
+// assertCopied fails the test unless the target holds the current contents
+// of the areas written to the disk and of the pages around them.
+func (f *fixture) assertCopied() {
+	f.t.Helper()
+
+	file, err := os.Open(f.path())
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	if info.Size() != f.disk.CapacityInBytes {
+		f.t.Fatalf("target is %d bytes, expected %d bytes", info.Size(), f.disk.CapacityInBytes)
+	}
+
+	for _, area := range f.written {
+		start := max(area.Start-4096, 0)
+		end := min(area.Start+area.Length+4096, f.disk.CapacityInBytes)
+
+		expected, err := f.h.VCenter.ReadDisk(f.vm, f.disk.Key, start, int(end-start))
+		if err != nil {
+			f.t.Fatal(err)
+		}
+
+		actual := make([]byte, end-start)
+		if _, err := file.ReadAt(actual, start); err != nil && err != io.EOF {
+			f.t.Fatal(err)
+		}
+
+		for i := range expected {
+			if actual[i] != expected[i] {
+				f.t.Fatalf("target differs from the disk at offset %d: got %#x, expected %#x", start+int64(i), actual[i], expected[i])
+			}
+		}
+	}
+}
+
+func TestFullAndIncrementalCycles(t *testing.T) {
+	f := setup(t)
+
+	f.write(0, 0xaa, 64*1024)
+	f.write(f.disk.CapacityInBytes/2, 0xbb, 128*1024)
+
+	fullCopy, _ := f.cycle()
+	if !fullCopy {
+		t.Error("first cycle did not do a full copy")
+	}
+	f.assertCopied()
+
+	f.write(4096, 0xcc, 8192)
+	f.write(f.disk.CapacityInBytes-4096, 0xdd, 4096)
+
+	fullCopy, changedBytes := f.cycle()
+	if fullCopy {
+		t.Error("second cycle did a full copy")
+	}
+	if changedBytes != 8192+4096 {
+		t.Errorf("second cycle copied %d changed bytes, expected %d", changedBytes, 8192+4096)
+	}
+	f.assertCopied()
+
+	// Nothing changed since the previous cycle
+	fullCopy, changedBytes = f.cycle()
+	if fullCopy || changedBytes != 0 {
+		t.Errorf("third cycle copied %d changed bytes, full copy: %t", changedBytes, fullCopy)
+	}
+	f.assertCopied()
+}
+
+func TestResumeFullCopy(t *testing.T) {
+	f := setup(t)
+
+	f.write(0, 0xaa, 64*1024)
+	f.write(f.disk.CapacityInBytes-64*1024, 0xbb, 64*1024)
+
+	// Pretend that a full copy was interrupted half way through, after
+	// which the guest kept writing to the part that was already copied
+	copied, err := f.h.VCenter.ReadDisk(f.vm, f.disk.Key, 0, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Create(f.path())
+	if err == nil {
+		_, err = file.Write(copied)
+	}
+	if err == nil {
+		err = file.Truncate(f.disk.CapacityInBytes)
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint, err := json.Marshal(&target.Checkpoint{
+		Offset:   f.disk.CapacityInBytes / 2,
+		ChangeID: f.changeID(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(f.path()+".checkpoint", checkpoint, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f.write(4096, 0xcc, 4096)
+
+	fullCopy, _ := f.cycle()
+	if !fullCopy {
+		t.Error("cycle did not resume the full copy")
+	}
+	f.assertCopied()
+
+	if _, err := os.Stat(f.path() + ".checkpoint"); !os.IsNotExist(err) {
+		t.Errorf("checkpoint was not removed once the full copy completed: %v", err)
+	}
+}
@@ -0,0 +1,828 @@
+package harness
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// OpenStackUsername and OpenStackPassword are the credentials accepted by
+	// the fake OpenStack
+	OpenStackUsername = "migratekit"
+	OpenStackPassword = "migratekit"
+
+	openstackRegion = "RegionOne"
+	timeFormat      = "2006-01-02T15:04:05.000000"
+)
+
+// OpenStack is an in-process fake of the Keystone, Cinder, Nova and Neutron
+// endpoints used by migratekit.  It keeps its resources in memory, volumes
+// become available and servers active as soon as they are created.
+type OpenStack struct {
+	Server *httptest.Server
+
+	mu        sync.Mutex
+	tokens    map[string]string
+	volumes   map[string]*Volume
+	transfers map[string]*transfer
+	servers   map[string]*Server
+	ports     map[string]*Port
+	flavors   map[string]*Flavor
+}
+
+type Volume struct {
+	ID                  string             `json:"id"`
+	Name                string             `json:"name"`
+	Description         string             `json:"description"`
+	Size                int                `json:"size"`
+	Status              string             `json:"status"`
+	Bootable            string             `json:"bootable"`
+	VolumeType          string             `json:"volume_type,omitempty"`
+	AvailabilityZone    string             `json:"availability_zone,omitempty"`
+	Metadata            map[string]string  `json:"metadata"`
+	VolumeImageMetadata map[string]string  `json:"volume_image_metadata,omitempty"`
+	Attachments         []VolumeAttachment `json:"attachments"`
+	ProjectID           string             `json:"os-vol-tenant-attr:tenant_id"`
+	CreatedAt           string             `json:"created_at"`
+}
+
+type VolumeAttachment struct {
+	ID           string `json:"id"`
+	AttachmentID string `json:"attachment_id"`
+	VolumeID     string `json:"volume_id"`
+	ServerID     string `json:"server_id,omitempty"`
+	HostName     string `json:"host_name,omitempty"`
+	Device       string `json:"device,omitempty"`
+	AttachedAt   string `json:"attached_at"`
+}
+
+type transfer struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	VolumeID  string `json:"volume_id"`
+	AuthKey   string `json:"auth_key,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+type Server struct {
+	ID               string            `json:"id"`
+	Name             string            `json:"name"`
+	Status           string            `json:"status"`
+	ProjectID        string            `json:"tenant_id"`
+	Flavor           map[string]string `json:"flavor"`
+	AvailabilityZone string            `json:"OS-EXT-AZ:availability_zone,omitempty"`
+	Networks         []string          `json:"-"`
+	Volumes          []string          `json:"-"`
+}
+
+type Port struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	Description    string    `json:"description"`
+	NetworkID      string    `json:"network_id"`
+	MACAddress     string    `json:"mac_address"`
+	FixedIPs       []FixedIP `json:"fixed_ips"`
+	SecurityGroups []string  `json:"security_groups"`
+	ProjectID      string    `json:"project_id"`
+	Status         string    `json:"status"`
+}
+
+type FixedIP struct {
+	SubnetID  string `json:"subnet_id"`
+	IPAddress string `json:"ip_address,omitempty"`
+}
+
+type Flavor struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	VCPUs int    `json:"vcpus"`
+	RAM   int    `json:"ram"`
+	Disk  int    `json:"disk"`
+}
+
+// NewOpenStack starts the fake OpenStack with a single m1.small flavor.
+func NewOpenStack() *OpenStack {
+	o := &OpenStack{
+		tokens:    map[string]string{},
+		volumes:   map[string]*Volume{},
+		transfers: map[string]*transfer{},
+		servers:   map[string]*Server{},
+		ports:     map[string]*Port{},
+		flavors: map[string]*Flavor{
+			"m1.small": {ID: "m1.small", Name: "m1.small", VCPUs: 1, RAM: 2048, Disk: 20},
+		},
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /identity/v3/auth/tokens", o.createToken)
+
+	mux.HandleFunc("GET /volume/v3/{project}/volumes/detail", o.authenticated(o.listVolumes))
+	mux.HandleFunc("POST /volume/v3/{project}/volumes", o.authenticated(o.createVolume))
+	mux.HandleFunc("GET /volume/v3/{project}/volumes/{id}", o.authenticated(o.getVolume))
+	mux.HandleFunc("PUT /volume/v3/{project}/volumes/{id}", o.authenticated(o.updateVolume))
+	mux.HandleFunc("POST /volume/v3/{project}/volumes/{id}/action", o.authenticated(o.volumeAction))
+	mux.HandleFunc("POST /volume/v3/{project}/os-volume-transfer", o.authenticated(o.createTransfer))
+	mux.HandleFunc("POST /volume/v3/{project}/os-volume-transfer/{id}/accept", o.authenticated(o.acceptTransfer))
+	mux.HandleFunc("DELETE /volume/v3/{project}/os-volume-transfer/{id}", o.authenticated(o.deleteTransfer))
+
+	mux.HandleFunc("GET /compute/v2.1/flavors/{id}", o.authenticated(o.getFlavor))
+	mux.HandleFunc("POST /compute/v2.1/servers", o.authenticated(o.createServer))
+	mux.HandleFunc("GET /compute/v2.1/servers/{id}", o.authenticated(o.getServer))
+	mux.HandleFunc("POST /compute/v2.1/servers/{id}/os-volume_attachments", o.authenticated(o.attachVolume))
+	mux.HandleFunc("DELETE /compute/v2.1/servers/{id}/os-volume_attachments/{volume}", o.authenticated(o.detachVolume))
+
+	mux.HandleFunc("GET /network/{$}", o.networkVersions)
+	mux.HandleFunc("GET /network/v2.0/ports", o.authenticated(o.listPorts))
+	mux.HandleFunc("POST /network/v2.0/ports", o.authenticated(o.createPort))
+
+	o.Server = httptest.NewServer(mux)
+
+	return o
+}
+
+// Close stops the fake OpenStack.
+func (o *OpenStack) Close() {
+	o.Server.Close()
+}
+
+// Environ returns the environment variables to authenticate against the fake
+// OpenStack with a token scoped to the project, there is no need to create
+// projects beforehand.
+func (o *OpenStack) Environ(project string) map[string]string {
+	return map[string]string{
+		"OS_AUTH_URL":     o.Server.URL + "/identity/v3",
+		"OS_USERNAME":     OpenStackUsername,
+		"OS_PASSWORD":     OpenStackPassword,
+		"OS_PROJECT_NAME": project,
+		"OS_DOMAIN_NAME":  "Default",
+		"OS_REGION_NAME":  openstackRegion,
+	}
+}
+
+// Volumes returns a copy of all the volumes, in all projects.
+func (o *OpenStack) Volumes() []Volume {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var result []Volume
+	for _, volume := range o.volumes {
+		result = append(result, *volume)
+	}
+
+	return result
+}
+
+// Servers returns a copy of all the servers, in all projects.
+func (o *OpenStack) Servers() []Server {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var result []Server
+	for _, server := range o.servers {
+		result = append(result, *server)
+	}
+
+	return result
+}
+
+// Ports returns a copy of all the ports, in all projects.
+func (o *OpenStack) Ports() []Port {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var result []Port
+	for _, port := range o.ports {
+		result = append(result, *port)
+	}
+
+	return result
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, format string, args ...any) {
+	writeJSON(w, status, map[string]any{
+		"error": map[string]any{
+			"code":    status,
+			"message": fmt.Sprintf(format, args...),
+		},
+	})
+}
+
+func readJSON(r *http.Request, body any) error {
+	return json.NewDecoder(r.Body).Decode(body)
+}
+
+type handlerFunc func(w http.ResponseWriter, r *http.Request, project string)
+
+// authenticated resolves the project of the token of the request, the
+// project in the path of Cinder requests is not trusted.
+func (o *OpenStack) authenticated(next handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+
+		project, ok := o.tokens[r.Header.Get("X-Auth-Token")]
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "the request you have made requires authentication")
+			return
+		}
+
+		next(w, r, project)
+	}
+}
+
+func (o *OpenStack) catalog(project string) []map[string]any {
+	entry := func(kind, name, url string) map[string]any {
+		return map[string]any{
+			"type": kind,
+			"name": name,
+			"endpoints": []map[string]any{
+				{
+					"id":        uuid.NewString(),
+					"interface": "public",
+					"region":    openstackRegion,
+					"region_id": openstackRegion,
+					"url":       url,
+				},
+			},
+		}
+	}
+
+	return []map[string]any{
+		entry("identity", "keystone", o.Server.URL+"/identity/v3"),
+		entry("block-storage", "cinderv3", o.Server.URL+"/volume/v3/"+project),
+		entry("compute", "nova", o.Server.URL+"/compute/v2.1"),
+		entry("network", "neutron", o.Server.URL+"/network"),
+	}
+}
+
+func (o *OpenStack) createToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Auth struct {
+			Identity struct {
+				Password struct {
+					User struct {
+						Name     string `json:"name"`
+						Password string `json:"password"`
+					} `json:"user"`
+				} `json:"password"`
+			} `json:"identity"`
+			Scope struct {
+				Project struct {
+					ID   string `json:"id"`
+					Name string `json:"name"`
+				} `json:"project"`
+			} `json:"scope"`
+		} `json:"auth"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	user := req.Auth.Identity.Password.User
+	if user.Name != OpenStackUsername || user.Password != OpenStackPassword {
+		writeError(w, http.StatusUnauthorized, "the request you have made requires authentication")
+		return
+	}
+
+	// Projects are identified by their name, so that tokens scoped by name or
+	// by ID end up in the same project
+	project := req.Auth.Scope.Project.ID
+	if project == "" {
+		project = req.Auth.Scope.Project.Name
+	}
+	if project == "" {
+		writeError(w, http.StatusBadRequest, "the fake OpenStack only issues project scoped tokens")
+		return
+	}
+
+	token := uuid.NewString()
+
+	o.mu.Lock()
+	o.tokens[token] = project
+	o.mu.Unlock()
+
+	domain := map[string]string{"id": "default", "name": "Default"}
+
+	w.Header().Set("X-Subject-Token", token)
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"token": map[string]any{
+			"methods":    []string{"password"},
+			"expires_at": time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			"issued_at":  time.Now().UTC().Format(time.RFC3339),
+			"user":       map[string]any{"id": user.Name, "name": user.Name, "domain": domain},
+			"project":    map[string]any{"id": project, "name": project, "domain": domain},
+			"catalog":    o.catalog(project),
+		},
+	})
+}
+
+// parseMetadataFilter parses the metadata filter of volume lists, which
+// gophercloud encodes as {'key':'value', 'other':'value'}.
+func parseMetadataFilter(filter string) map[string]string {
+	result := map[string]string{}
+
+	filter = strings.TrimSuffix(strings.TrimPrefix(filter, "{"), "}")
+	for _, pair := range strings.Split(filter, ", ") {
+		key, value, ok := strings.Cut(pair, ":")
+		if !ok {
+			continue
+		}
+
+		result[strings.Trim(key, "'")] = strings.Trim(value, "'")
+	}
+
+	return result
+}
+
+func (o *OpenStack) listVolumes(w http.ResponseWriter, r *http.Request, project string) {
+	name := r.URL.Query().Get("name")
+	metadata := parseMetadataFilter(r.URL.Query().Get("metadata"))
+
+	volumes := []*Volume{}
+	for _, volume := range o.volumes {
+		if volume.ProjectID != project || (name != "" && volume.Name != name) {
+			continue
+		}
+
+		matches := true
+		for key, value := range metadata {
+			if volume.Metadata[key] != value {
+				matches = false
+			}
+		}
+
+		if matches {
+			volumes = append(volumes, volume)
+		}
+	}
+
+	slices.SortFunc(volumes, func(a, b *Volume) int {
+		return strings.Compare(a.CreatedAt, b.CreatedAt)
+	})
+
+	writeJSON(w, http.StatusOK, map[string]any{"volumes": volumes})
+}
+
+func (o *OpenStack) volume(w http.ResponseWriter, r *http.Request, project string) (*Volume, bool) {
+	volume, ok := o.volumes[r.PathValue("id")]
+	if !ok || volume.ProjectID != project {
+		writeError(w, http.StatusNotFound, "volume %s could not be found", r.PathValue("id"))
+		return nil, false
+	}
+
+	return volume, true
+}
+
+func (o *OpenStack) createVolume(w http.ResponseWriter, r *http.Request, project string) {
+	var req struct {
+		Volume Volume `json:"volume"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	volume := req.Volume
+	volume.ID = uuid.NewString()
+	volume.Status = "available"
+	volume.Bootable = "false"
+	volume.ProjectID = project
+	volume.Attachments = []VolumeAttachment{}
+	volume.CreatedAt = time.Now().UTC().Format(timeFormat)
+	if volume.Metadata == nil {
+		volume.Metadata = map[string]string{}
+	}
+
+	o.volumes[volume.ID] = &volume
+
+	writeJSON(w, http.StatusAccepted, map[string]any{"volume": volume})
+}
+
+func (o *OpenStack) getVolume(w http.ResponseWriter, r *http.Request, project string) {
+	volume, ok := o.volume(w, r, project)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"volume": volume})
+}
+
+func (o *OpenStack) updateVolume(w http.ResponseWriter, r *http.Request, project string) {
+	volume, ok := o.volume(w, r, project)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Volume struct {
+			Name        *string           `json:"name"`
+			Description *string           `json:"description"`
+			Metadata    map[string]string `json:"metadata"`
+		} `json:"volume"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	if req.Volume.Name != nil {
+		volume.Name = *req.Volume.Name
+	}
+	if req.Volume.Description != nil {
+		volume.Description = *req.Volume.Description
+	}
+	if req.Volume.Metadata != nil {
+		volume.Metadata = maps.Clone(req.Volume.Metadata)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"volume": volume})
+}
+
+func (o *OpenStack) volumeAction(w http.ResponseWriter, r *http.Request, project string) {
+	volume, ok := o.volume(w, r, project)
+	if !ok {
+		return
+	}
+
+	var req map[string]json.RawMessage
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	for action, body := range req {
+		switch action {
+		case "os-set_bootable":
+			var opts struct {
+				Bootable bool `json:"bootable"`
+			}
+			json.Unmarshal(body, &opts)
+
+			volume.Bootable = fmt.Sprint(opts.Bootable)
+			w.WriteHeader(http.StatusOK)
+		case "os-set_image_metadata":
+			var opts struct {
+				Metadata map[string]string `json:"metadata"`
+			}
+			json.Unmarshal(body, &opts)
+
+			if volume.VolumeImageMetadata == nil {
+				volume.VolumeImageMetadata = map[string]string{}
+			}
+			maps.Copy(volume.VolumeImageMetadata, opts.Metadata)
+			writeJSON(w, http.StatusOK, map[string]any{"metadata": volume.VolumeImageMetadata})
+		case "os-reserve":
+			volume.Status = "attaching"
+			w.WriteHeader(http.StatusAccepted)
+		case "os-unreserve":
+			volume.Status = "available"
+			w.WriteHeader(http.StatusAccepted)
+		case "os-attach":
+			var opts struct {
+				HostName   string `json:"host_name"`
+				MountPoint string `json:"mountpoint"`
+			}
+			json.Unmarshal(body, &opts)
+
+			id := uuid.NewString()
+			volume.Status = "in-use"
+			volume.Attachments = append(volume.Attachments, VolumeAttachment{
+				ID:           volume.ID,
+				AttachmentID: id,
+				VolumeID:     volume.ID,
+				HostName:     opts.HostName,
+				Device:       opts.MountPoint,
+				AttachedAt:   time.Now().UTC().Format(timeFormat),
+			})
+			w.WriteHeader(http.StatusAccepted)
+		case "os-detach":
+			var opts struct {
+				AttachmentID string `json:"attachment_id"`
+			}
+			json.Unmarshal(body, &opts)
+
+			volume.Attachments = slices.DeleteFunc(volume.Attachments, func(a VolumeAttachment) bool {
+				return a.AttachmentID == opts.AttachmentID
+			})
+			if len(volume.Attachments) == 0 {
+				volume.Status = "available"
+			}
+			w.WriteHeader(http.StatusAccepted)
+		case "os-initialize_connection":
+			// There is nothing to connect to, migratekit fails with an
+			// unsupported volume type if it tries to
+			writeJSON(w, http.StatusOK, map[string]any{
+				"connection_info": map[string]any{
+					"driver_volume_type": "fake",
+					"data":               map[string]any{},
+				},
+			})
+		case "os-terminate_connection":
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			writeError(w, http.StatusBadRequest, "action %s is not supported", action)
+		}
+
+		return
+	}
+
+	writeError(w, http.StatusBadRequest, "no action in request")
+}
+
+func (o *OpenStack) createTransfer(w http.ResponseWriter, r *http.Request, project string) {
+	var req struct {
+		Transfer transfer `json:"transfer"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	volume, ok := o.volumes[req.Transfer.VolumeID]
+	if !ok || volume.ProjectID != project {
+		writeError(w, http.StatusNotFound, "volume %s could not be found", req.Transfer.VolumeID)
+		return
+	} else if volume.Status != "available" {
+		writeError(w, http.StatusBadRequest, "volume %s is %s", volume.ID, volume.Status)
+		return
+	}
+
+	t := req.Transfer
+	t.ID = uuid.NewString()
+	t.AuthKey = uuid.NewString()[:16]
+	t.CreatedAt = time.Now().UTC().Format(timeFormat)
+
+	o.transfers[t.ID] = &t
+	volume.Status = "awaiting-transfer"
+
+	writeJSON(w, http.StatusAccepted, map[string]any{"transfer": t})
+}
+
+func (o *OpenStack) acceptTransfer(w http.ResponseWriter, r *http.Request, project string) {
+	var req struct {
+		Accept struct {
+			AuthKey string `json:"auth_key"`
+		} `json:"accept"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	t, ok := o.transfers[r.PathValue("id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "transfer %s could not be found", r.PathValue("id"))
+		return
+	} else if t.AuthKey != req.Accept.AuthKey {
+		writeError(w, http.StatusBadRequest, "invalid auth key")
+		return
+	}
+
+	volume := o.volumes[t.VolumeID]
+	volume.ProjectID = project
+	volume.Status = "available"
+	delete(o.transfers, t.ID)
+
+	writeJSON(w, http.StatusAccepted, map[string]any{
+		"transfer": map[string]any{"id": t.ID, "name": t.Name, "volume_id": t.VolumeID},
+	})
+}
+
+func (o *OpenStack) deleteTransfer(w http.ResponseWriter, r *http.Request, project string) {
+	t, ok := o.transfers[r.PathValue("id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "transfer %s could not be found", r.PathValue("id"))
+		return
+	}
+
+	if volume, ok := o.volumes[t.VolumeID]; ok {
+		volume.Status = "available"
+	}
+	delete(o.transfers, t.ID)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (o *OpenStack) getFlavor(w http.ResponseWriter, r *http.Request, project string) {
+	flavor, ok := o.flavors[r.PathValue("id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "flavor %s could not be found", r.PathValue("id"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"flavor": flavor})
+}
+
+func (o *OpenStack) createServer(w http.ResponseWriter, r *http.Request, project string) {
+	var req struct {
+		Server struct {
+			Name             string `json:"name"`
+			FlavorRef        string `json:"flavorRef"`
+			AvailabilityZone string `json:"availability_zone"`
+			Networks         []struct {
+				Port string `json:"port"`
+			} `json:"networks"`
+			BlockDevices []struct {
+				UUID string `json:"uuid"`
+			} `json:"block_device_mapping_v2"`
+		} `json:"server"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	if _, ok := o.flavors[req.Server.FlavorRef]; !ok {
+		writeError(w, http.StatusBadRequest, "flavor %s could not be found", req.Server.FlavorRef)
+		return
+	}
+
+	server := &Server{
+		ID:               uuid.NewString(),
+		Name:             req.Server.Name,
+		Status:           "ACTIVE",
+		ProjectID:        project,
+		Flavor:           map[string]string{"id": req.Server.FlavorRef},
+		AvailabilityZone: req.Server.AvailabilityZone,
+	}
+
+	for _, network := range req.Server.Networks {
+		port, ok := o.ports[network.Port]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "port %s could not be found", network.Port)
+			return
+		}
+
+		port.Status = "ACTIVE"
+		server.Networks = append(server.Networks, network.Port)
+	}
+
+	for _, device := range req.Server.BlockDevices {
+		volume, ok := o.volumes[device.UUID]
+		if !ok || volume.ProjectID != project {
+			writeError(w, http.StatusBadRequest, "volume %s could not be found", device.UUID)
+			return
+		}
+
+		volume.Status = "in-use"
+		volume.Attachments = append(volume.Attachments, VolumeAttachment{
+			ID:           volume.ID,
+			AttachmentID: uuid.NewString(),
+			VolumeID:     volume.ID,
+			ServerID:     server.ID,
+			AttachedAt:   time.Now().UTC().Format(timeFormat),
+		})
+		server.Volumes = append(server.Volumes, volume.ID)
+	}
+
+	o.servers[server.ID] = server
+
+	writeJSON(w, http.StatusAccepted, map[string]any{"server": map[string]any{"id": server.ID}})
+}
+
+func (o *OpenStack) getServer(w http.ResponseWriter, r *http.Request, project string) {
+	server, ok := o.servers[r.PathValue("id")]
+	if !ok || server.ProjectID != project {
+		writeError(w, http.StatusNotFound, "server %s could not be found", r.PathValue("id"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"server": server})
+}
+
+// attachVolume attaches a volume to a server of any project, which is what
+// migratekit does with the instance it runs in.
+func (o *OpenStack) attachVolume(w http.ResponseWriter, r *http.Request, project string) {
+	var req struct {
+		VolumeAttachment struct {
+			VolumeID string `json:"volumeId"`
+		} `json:"volumeAttachment"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	volume, ok := o.volumes[req.VolumeAttachment.VolumeID]
+	if !ok || volume.ProjectID != project {
+		writeError(w, http.StatusNotFound, "volume %s could not be found", req.VolumeAttachment.VolumeID)
+		return
+	}
+
+	volume.Status = "in-use"
+	volume.Attachments = append(volume.Attachments, VolumeAttachment{
+		ID:           volume.ID,
+		AttachmentID: uuid.NewString(),
+		VolumeID:     volume.ID,
+		ServerID:     r.PathValue("id"),
+		AttachedAt:   time.Now().UTC().Format(timeFormat),
+	})
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"volumeAttachment": map[string]any{
+			"id":       volume.ID,
+			"volumeId": volume.ID,
+			"serverId": r.PathValue("id"),
+		},
+	})
+}
+
+func (o *OpenStack) detachVolume(w http.ResponseWriter, r *http.Request, project string) {
+	volume, ok := o.volumes[r.PathValue("volume")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "volume %s could not be found", r.PathValue("volume"))
+		return
+	}
+
+	volume.Attachments = slices.DeleteFunc(volume.Attachments, func(a VolumeAttachment) bool {
+		return a.ServerID == r.PathValue("id")
+	})
+	if len(volume.Attachments) == 0 {
+		volume.Status = "available"
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// networkVersions is the version discovery document of Neutron, which has no
+// version in its endpoint.
+func (o *OpenStack) networkVersions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"versions": []map[string]any{
+			{
+				"id":     "v2.0",
+				"status": "CURRENT",
+				"links":  []map[string]string{{"rel": "self", "href": o.Server.URL + "/network/v2.0/"}},
+			},
+		},
+	})
+}
+
+func (o *OpenStack) listPorts(w http.ResponseWriter, r *http.Request, project string) {
+	query := r.URL.Query()
+
+	ports := []*Port{}
+	for _, port := range o.ports {
+		if port.ProjectID != project {
+			continue
+		}
+
+		if network := query.Get("network_id"); network != "" && port.NetworkID != network {
+			continue
+		}
+
+		if mac := query.Get("mac_address"); mac != "" && port.MACAddress != mac {
+			continue
+		}
+
+		ports = append(ports, port)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"ports": ports})
+}
+
+func (o *OpenStack) createPort(w http.ResponseWriter, r *http.Request, project string) {
+	var req struct {
+		Port Port `json:"port"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	port := req.Port
+	port.ID = uuid.NewString()
+	port.ProjectID = project
+	port.Status = "DOWN"
+	if port.SecurityGroups == nil {
+		port.SecurityGroups = []string{}
+	}
+
+	for _, other := range o.ports {
+		if other.NetworkID == port.NetworkID && other.MACAddress == port.MACAddress {
+			writeError(w, http.StatusConflict, "mac address %s is already in use", port.MACAddress)
+			return
+		}
+	}
+
+	o.ports[port.ID] = &port
+
+	writeJSON(w, http.StatusCreated, map[string]any{"port": port})
+}
@@ -0,0 +1,239 @@
+package harness_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/vexxhost/migratekit/cmd"
+	"github.com/vexxhost/migratekit/internal/connector"
+	"github.com/vexxhost/migratekit/internal/harness"
+	"github.com/vexxhost/migratekit/internal/machine"
+	"github.com/vexxhost/migratekit/internal/openstack"
+	"github.com/vexxhost/migratekit/internal/target"
+	"github.com/vexxhost/migratekit/internal/vmware"
+)
+
+// setupOpenStack starts the harness and points the OpenStack clients to its
+// fake cloud with a token scoped to the project, it returns the model of the
+// virtual machine that is migrated.  Nothing is copied, so nbdkit is not
+// needed.
+func setupOpenStack(t *testing.T, project string) (*harness.Harness, *machine.VirtualMachine) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	h, err := harness.New(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+
+	t.Setenv("OS_CLOUD", "")
+	for key, value := range h.OpenStack.Environ(project) {
+		t.Setenv(key, value)
+	}
+
+	vm, err := h.VCenter.VirtualMachine(ctx, vmPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := vmware.NewMachine(ctx, vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Disks) == 0 || len(m.NICs) == 0 {
+		t.Fatalf("%s needs a disk and a network card", vmPath)
+	}
+
+	return h, m
+}
+
+func TestOpenStackTarget(t *testing.T) {
+	h, m := setupOpenStack(t, "migration")
+	ctx := context.Background()
+
+	// The fake cloud has nothing to connect to, so attaching through Cinder
+	// creates the volume and then fails once it is exported
+	config := h.Config()
+	config.Attach.Mode = target.AttachModeCinder
+
+	volume, err := target.NewOpenStack(ctx, config, m, m.Disks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err := volume.Exists(ctx)
+	if err != nil || exists {
+		t.Fatalf("volume exists before it was created: %t, %v", exists, err)
+	}
+
+	changeID, err := volume.GetCurrentChangeID(ctx)
+	if err != nil || changeID != "" {
+		t.Fatalf("change ID of a missing volume: %q, %v", changeID, err)
+	}
+
+	err = volume.Connect(ctx)
+	if !errors.Is(err, connector.ErrUnsupportedVolumeType) {
+		t.Fatalf("connecting to the fake cloud failed with %v, expected %v", err, connector.ErrUnsupportedVolumeType)
+	}
+
+	volumes := h.OpenStack.Volumes()
+	if len(volumes) != 1 {
+		t.Fatalf("%d volumes were created, expected 1", len(volumes))
+	}
+
+	created := volumes[0]
+	if created.Name != m.DiskLabel(m.Disks[0]) || created.Size != 10 || created.Bootable != "true" {
+		t.Errorf("volume %s is %d GiB, bootable: %s", created.Name, created.Size, created.Bootable)
+	}
+	if created.Status != "available" {
+		t.Errorf("volume is %s after the failed connection, expected available", created.Status)
+	}
+	if created.Metadata["migrate_kit"] != "true" || created.Metadata["vm"] != m.ID {
+		t.Errorf("volume metadata does not tie it to the virtual machine: %v", created.Metadata)
+	}
+
+	exists, err = volume.Exists(ctx)
+	if err != nil || !exists {
+		t.Fatalf("created volume does not exist: %v", err)
+	}
+
+	if err := volume.WriteChangeID(ctx, "52 7b/4"); err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint := &target.Checkpoint{Offset: 1024 * 1024 * 1024, ChangeID: "52 7b/5"}
+	if err := volume.WriteCheckpoint(ctx, checkpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	changeID, err = volume.GetCurrentChangeID(ctx)
+	if err != nil || changeID != "52 7b/4" {
+		t.Errorf("change ID is %q, %v, expected 52 7b/4", changeID, err)
+	}
+
+	recorded, err := volume.GetCheckpoint(ctx)
+	if err != nil || recorded == nil || *recorded != *checkpoint {
+		t.Errorf("checkpoint is %v, %v, expected %v", recorded, err, checkpoint)
+	}
+
+	if err := volume.WriteCheckpoint(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	recorded, err = volume.GetCheckpoint(ctx)
+	if err != nil || recorded != nil {
+		t.Errorf("checkpoint is %v, %v after it was removed", recorded, err)
+	}
+
+	changeID, err = volume.GetCurrentChangeID(ctx)
+	if err != nil || changeID != "52 7b/4" {
+		t.Errorf("removing the checkpoint changed the change ID to %q, %v", changeID, err)
+	}
+
+	// Volumes are only found for the disk and the project they belong to
+	other, err := target.NewOpenStack(ctx, config, m, &machine.Disk{Key: m.Disks[0].Key + 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err = other.Exists(ctx)
+	if err != nil || exists {
+		t.Errorf("volume of another disk exists: %t, %v", exists, err)
+	}
+
+	for key, value := range h.OpenStack.Environ("other") {
+		t.Setenv(key, value)
+	}
+
+	other, err = target.NewOpenStack(ctx, config, m, m.Disks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err = other.Exists(ctx)
+	if err != nil || exists {
+		t.Errorf("volume exists in another project: %t, %v", exists, err)
+	}
+}
+
+func TestEnsurePortsForVirtualMachine(t *testing.T) {
+	h, m := setupOpenStack(t, "migration")
+	ctx := context.Background()
+
+	clientSet, err := openstack.NewClientSet(ctx, &openstack.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		networkID = "2a81f1b0-c1b8-48dd-bd8e-4d976608c06d"
+		subnetID  = "21a7110b-2ab2-4cc1-8372-8b552f7a4438"
+	)
+
+	mapping := &cmd.NetworkMappingFlag{}
+	for i, nic := range m.NICs {
+		value := "mac=" + nic.MacAddress + ",network-id=" + networkID + ",subnet-id=" + subnetID
+		if i == 0 {
+			value += ",ip=192.168.2.20"
+		}
+
+		if err := mapping.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	securityGroups := []string{"default"}
+	opts := &openstack.PortCreateOpts{SecurityGroups: &securityGroups}
+
+	networks, err := clientSet.EnsurePortsForVirtualMachine(ctx, m, mapping, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ports := h.OpenStack.Ports()
+	if len(networks) != len(m.NICs) || len(ports) != len(m.NICs) {
+		t.Fatalf("%d networks and %d ports for %d network cards", len(networks), len(ports), len(m.NICs))
+	}
+
+	for _, port := range ports {
+		if port.MACAddress == m.NICs[0].MacAddress {
+			if port.Name != m.NICs[0].Label || port.NetworkID != networkID {
+				t.Errorf("port %s is on network %s, expected %s on %s", port.Name, port.NetworkID, m.NICs[0].Label, networkID)
+			}
+
+			if len(port.FixedIPs) != 1 || port.FixedIPs[0].SubnetID != subnetID || port.FixedIPs[0].IPAddress != "192.168.2.20" {
+				t.Errorf("port has fixed IPs %v, expected 192.168.2.20 on %s", port.FixedIPs, subnetID)
+			}
+
+			if len(port.SecurityGroups) != 1 || port.SecurityGroups[0] != "default" {
+				t.Errorf("port has security groups %v, expected default", port.SecurityGroups)
+			}
+		}
+	}
+
+	// The ports are reused by the next cutover attempt
+	again, err := clientSet.EnsurePortsForVirtualMachine(ctx, m, mapping, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(h.OpenStack.Ports()) != len(ports) {
+		t.Errorf("%d ports after the second attempt, expected %d", len(h.OpenStack.Ports()), len(ports))
+	}
+
+	for i := range networks {
+		if again[i].Port != networks[i].Port {
+			t.Errorf("network card %d uses port %s, expected %s", i, again[i].Port, networks[i].Port)
+		}
+	}
+
+	// Every network card needs a mapping
+	_, err = clientSet.EnsurePortsForVirtualMachine(ctx, m, &cmd.NetworkMappingFlag{}, opts)
+	if err == nil {
+		t.Error("ports were created without network mappings")
+	}
+}
@@ -0,0 +1,117 @@
+package harness
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/vexxhost/migratekit/internal/machine"
+	"github.com/vexxhost/migratekit/internal/target"
+)
+
+// FileTarget writes a disk to a sparse file in place of an OpenStack volume,
+// the change ID and the checkpoint are kept in files next to it so that they
+// survive across migration cycles.
+type FileTarget struct {
+	VirtualMachine *machine.VirtualMachine
+	Disk           *machine.Disk
+	Path           string
+}
+
+// NewTarget returns the file targets of the disks in a directory, it can be
+// used for NbdkitServers.NewTarget.  The directory must support O_DIRECT,
+// which tmpfs does not.
+func NewTarget(dir string) func(context.Context, *machine.VirtualMachine, *machine.Disk) (target.Target, error) {
+	return func(ctx context.Context, vm *machine.VirtualMachine, disk *machine.Disk) (target.Target, error) {
+		return &FileTarget{
+			VirtualMachine: vm,
+			Disk:           disk,
+			Path:           filepath.Join(dir, vm.DiskLabel(disk)+".img"),
+		}, nil
+	}
+}
+
+func (t *FileTarget) GetDisk() *machine.Disk {
+	return t.Disk
+}
+
+func (t *FileTarget) Connect(ctx context.Context) error {
+	file, err := os.OpenFile(t.Path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Truncate(t.Disk.CapacityInBytes)
+}
+
+func (t *FileTarget) GetPath(ctx context.Context) (string, error) {
+	return t.Path, nil
+}
+
+func (t *FileTarget) Disconnect(ctx context.Context) error {
+	return nil
+}
+
+func (t *FileTarget) Exists(ctx context.Context) (bool, error) {
+	_, err := os.Stat(t.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (t *FileTarget) GetCurrentChangeID(ctx context.Context) (string, error) {
+	data, err := os.ReadFile(t.Path + ".change-id")
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func (t *FileTarget) WriteChangeID(ctx context.Context, changeID string) error {
+	return os.WriteFile(t.Path+".change-id", []byte(changeID), 0644)
+}
+
+func (t *FileTarget) GetCheckpoint(ctx context.Context) (*target.Checkpoint, error) {
+	data, err := os.ReadFile(t.Path + ".checkpoint")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var checkpoint target.Checkpoint
+	err = json.Unmarshal(data, &checkpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return &checkpoint, nil
+}
+
+func (t *FileTarget) WriteCheckpoint(ctx context.Context, checkpoint *target.Checkpoint) error {
+	if checkpoint == nil {
+		err := os.Remove(t.Path + ".checkpoint")
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(t.Path+".checkpoint", data, 0644)
+}
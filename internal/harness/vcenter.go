@@ -0,0 +1,462 @@
+package harness
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/vexxhost/migratekit/internal/nbdkit"
+	"github.com/vexxhost/migratekit/internal/vmware"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// VCenter is a simulated vCenter with change tracking enabled on all the
+// virtual machines.  The contents of the disks are kept in sparse files and
+// every write is recorded, so that QueryChangedDiskAreas returns what changed
+// between two snapshots like a real vCenter does.
+type VCenter struct {
+	Model  *simulator.Model
+	Server *simulator.Server
+	Client *vim25.Client
+
+	dir   string
+	mu    sync.Mutex
+	disks map[diskID]*disk
+}
+
+type diskID struct {
+	vm  string
+	key int32
+}
+
+type disk struct {
+	path     string
+	capacity int64
+	uuid     string
+	number   int
+	changes  []change
+}
+
+type change struct {
+	number int
+	area   types.DiskChangeExtent
+}
+
+// changeTracking answers QueryChangedDiskAreas, which vcsim does not
+// implement, on the client side and passes everything else to vcsim.
+type changeTracking struct {
+	soap.RoundTripper
+	vcenter *VCenter
+}
+
+// NewVCenter starts a simulated vCenter with the default inventory of vcsim,
+// the disk images are written to a temporary directory which is removed by
+// Close.
+func NewVCenter(ctx context.Context) (*VCenter, error) {
+	dir, err := os.MkdirTemp("", "migratekit-vcenter-")
+	if err != nil {
+		return nil, err
+	}
+
+	v := &VCenter{
+		Model: simulator.VPX(),
+		dir:   dir,
+		disks: map[diskID]*disk{},
+	}
+
+	err = v.Model.Create()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	v.Model.Service.TLS = new(tls.Config)
+	v.Server = v.Model.Service.NewServer()
+
+	if v.Server.URL.User == nil {
+		v.Server.URL.User = url.UserPassword("user", "pass")
+	}
+
+	err = v.enableChangeTracking()
+	if err == nil {
+		v.Client, err = vmware.NewClient(ctx, v.Server.URL, &vmware.TLSOptions{Insecure: true})
+	}
+	if err == nil {
+		v.Client.RoundTripper = &changeTracking{RoundTripper: v.Client.RoundTripper, vcenter: v}
+	}
+	if err != nil {
+		v.Close()
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// Close stops the simulator and removes the disk images.
+func (v *VCenter) Close() {
+	v.Server.Close()
+	v.Model.Remove()
+	os.RemoveAll(v.dir)
+}
+
+func (v *VCenter) enableChangeTracking() error {
+	ctx := v.Model.Service.Context
+
+	for _, entity := range v.Model.Map().All("VirtualMachine") {
+		vm := entity.(*simulator.VirtualMachine)
+
+		var err error
+		ctx.WithLock(vm, func() {
+			vm.Config.ChangeTrackingEnabled = types.NewBool(true)
+
+			for _, device := range vm.Config.Hardware.Device {
+				d, ok := device.(*types.VirtualDisk)
+				if !ok {
+					continue
+				}
+
+				err = v.addDisk(vm, d)
+				if err != nil {
+					return
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (v *VCenter) addDisk(vm *simulator.VirtualMachine, d *types.VirtualDisk) error {
+	backing, ok := d.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+	if !ok {
+		return fmt.Errorf("unsupported backing for disk %d of %s", d.Key, vm.Name)
+	}
+
+	id := diskID{vm: vm.Self.Value, key: d.Key}
+	path := filepath.Join(v.dir, fmt.Sprintf("%s-%d.img", id.vm, id.key))
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = file.Truncate(d.CapacityInBytes)
+	if err != nil {
+		return err
+	}
+
+	tracked := &disk{
+		path:     path,
+		capacity: d.CapacityInBytes,
+		uuid:     uuid.NewString(),
+	}
+	v.disks[id] = tracked
+
+	backing.ChangeId = tracked.changeID()
+
+	return nil
+}
+
+func (d *disk) changeID() string {
+	return d.uuid + "/" + strconv.Itoa(d.number)
+}
+
+// areas returns the areas written after the change number from and up to
+// the change number to, sorted and merged.
+func (d *disk) areas(from, to int) []types.DiskChangeExtent {
+	var areas []types.DiskChangeExtent
+	for _, c := range d.changes {
+		if c.number > from && c.number <= to {
+			areas = append(areas, c.area)
+		}
+	}
+
+	slices.SortFunc(areas, func(a, b types.DiskChangeExtent) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+
+	var merged []types.DiskChangeExtent
+	for _, area := range areas {
+		if n := len(merged); n > 0 && merged[n-1].Start+merged[n-1].Length >= area.Start {
+			end := max(merged[n-1].Start+merged[n-1].Length, area.Start+area.Length)
+			merged[n-1].Length = end - merged[n-1].Start
+			continue
+		}
+
+		merged = append(merged, area)
+	}
+
+	return merged
+}
+
+// VirtualMachine returns a virtual machine of the simulator by its inventory
+// path, such as /DC0/vm/DC0_H0_VM0.
+func (v *VCenter) VirtualMachine(ctx context.Context, path string) (*object.VirtualMachine, error) {
+	return vmware.FindVirtualMachine(ctx, v.Client, path)
+}
+
+// WriteDisk writes data to a disk of a virtual machine as its guest would,
+// which bumps the change ID of the disk.
+func (v *VCenter) WriteDisk(vm *object.VirtualMachine, key int32, offset int64, data []byte) error {
+	simulated, ok := v.Model.Map().Get(vm.Reference()).(*simulator.VirtualMachine)
+	if !ok {
+		return fmt.Errorf("virtual machine %s not found", vm.Reference().Value)
+	}
+
+	var err error
+	v.Model.Service.Context.WithLock(simulated, func() {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+
+		err = v.writeDisk(simulated, key, offset, data)
+	})
+
+	return err
+}
+
+func (v *VCenter) writeDisk(vm *simulator.VirtualMachine, key int32, offset int64, data []byte) error {
+	d, ok := v.disks[diskID{vm: vm.Self.Value, key: key}]
+	if !ok {
+		return fmt.Errorf("disk %d of %s not found", key, vm.Self.Value)
+	}
+
+	if offset < 0 || offset+int64(len(data)) > d.capacity {
+		return fmt.Errorf("write of %d bytes at %d is past the end of disk %d", len(data), offset, key)
+	}
+
+	file, err := os.OpenFile(d.path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteAt(data, offset)
+	if err != nil {
+		return err
+	}
+
+	d.number++
+	d.changes = append(d.changes, change{
+		number: d.number,
+		area:   types.DiskChangeExtent{Start: offset, Length: int64(len(data))},
+	})
+
+	// Snapshots share the device list of the virtual machine they were taken
+	// from, so it is copied to keep the change ID of existing snapshots.
+	devices := slices.Clone(vm.Config.Hardware.Device)
+	for i, device := range devices {
+		current, ok := device.(*types.VirtualDisk)
+		if !ok || current.Key != key {
+			continue
+		}
+
+		updated := *current
+		backing := *current.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+		backing.ChangeId = d.changeID()
+		updated.Backing = &backing
+		devices[i] = &updated
+	}
+
+	vm.Config.Hardware.Device = devices
+
+	return nil
+}
+
+// ReadDisk returns the current contents of a range of a disk.
+func (v *VCenter) ReadDisk(vm *object.VirtualMachine, key int32, offset int64, length int) ([]byte, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	d, ok := v.disks[diskID{vm: vm.Reference().Value, key: key}]
+	if !ok {
+		return nil, fmt.Errorf("disk %d of %s not found", key, vm.Reference().Value)
+	}
+
+	file, err := os.Open(d.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buf := make([]byte, length)
+	_, err = file.ReadAt(buf, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// snapshotDisk returns the disk of a snapshot along with the change number it
+// was taken at.
+func (v *VCenter) snapshotDisk(vm string, snapshot types.ManagedObjectReference, key int32) (*disk, int, error) {
+	s, ok := v.Model.Map().Get(snapshot).(*simulator.VirtualMachineSnapshot)
+	if !ok {
+		return nil, 0, fmt.Errorf("snapshot %s not found", snapshot.Value)
+	}
+
+	d, ok := v.disks[diskID{vm: vm, key: key}]
+	if !ok {
+		return nil, 0, fmt.Errorf("disk %d of %s not found", key, vm)
+	}
+
+	for _, device := range s.Config.Hardware.Device {
+		snapshotDisk, ok := device.(*types.VirtualDisk)
+		if !ok || snapshotDisk.Key != key {
+			continue
+		}
+
+		backing := snapshotDisk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+		changeID, err := vmware.ParseChangeID(backing.ChangeId)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		number, err := strconv.Atoi(changeID.Number)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return d, number, nil
+	}
+
+	return nil, 0, fmt.Errorf("disk %d not found in snapshot %s", key, snapshot.Value)
+}
+
+func (c *changeTracking) RoundTrip(ctx context.Context, req, res soap.HasFault) error {
+	body, ok := req.(*methods.QueryChangedDiskAreasBody)
+	if !ok {
+		return c.RoundTripper.RoundTrip(ctx, req, res)
+	}
+
+	info, err := c.vcenter.queryChangedDiskAreas(body.Req)
+	if err != nil {
+		return err
+	}
+
+	res.(*methods.QueryChangedDiskAreasBody).Res = &types.QueryChangedDiskAreasResponse{
+		Returnval: *info,
+	}
+
+	return nil
+}
+
+func (v *VCenter) queryChangedDiskAreas(req *types.QueryChangedDiskAreas) (*types.DiskChangeInfo, error) {
+	if req.Snapshot == nil {
+		return nil, errors.New("a snapshot is required to query changed disk areas")
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	d, number, err := v.snapshotDisk(req.This.Value, *req.Snapshot, req.DeviceKey)
+	if err != nil {
+		return nil, err
+	}
+
+	from := 0
+	if req.ChangeId != "*" {
+		changeID, err := vmware.ParseChangeID(req.ChangeId)
+		if err == nil {
+			from, err = strconv.Atoi(changeID.Number)
+		}
+		if err != nil || changeID.UUID != d.uuid {
+			return nil, fmt.Errorf("invalid change ID %s for disk %d", req.ChangeId, req.DeviceKey)
+		}
+	}
+
+	var areas []types.DiskChangeExtent
+	for _, area := range d.areas(from, number) {
+		if area.Start+area.Length > req.StartOffset {
+			areas = append(areas, area)
+		}
+	}
+
+	return &types.DiskChangeInfo{
+		StartOffset: req.StartOffset,
+		Length:      d.capacity - req.StartOffset,
+		ChangedArea: areas,
+	}, nil
+}
+
+// NewNbdkit serves the disk of a snapshot with the nbdkit file plugin, it
+// can be used for NbdkitServers.NewNbdkit.  The contents of the disk are
+// copied when it is called, so the disk must not be written to between
+// creating the snapshot and calling it.
+func (v *VCenter) NewNbdkit(vm *object.VirtualMachine) func(context.Context, types.ManagedObjectReference, *types.VirtualDisk) (*nbdkit.NbdkitServer, error) {
+	return func(ctx context.Context, snapshot types.ManagedObjectReference, virtualDisk *types.VirtualDisk) (*nbdkit.NbdkitServer, error) {
+		path, err := v.freeze(vm, snapshot, virtualDisk)
+		if err != nil {
+			return nil, err
+		}
+
+		return nbdkit.NewNbdkitBuilder().
+			Source(&nbdkit.FileSource{Path: path}).
+			Build()
+	}
+}
+
+// freeze copies the contents of a disk at the time of a snapshot to a sparse
+// file which is served instead of the disk.
+func (v *VCenter) freeze(vm *object.VirtualMachine, snapshot types.ManagedObjectReference, virtualDisk *types.VirtualDisk) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	d, number, err := v.snapshotDisk(vm.Reference().Value, snapshot, virtualDisk.Key)
+	if err != nil {
+		return "", err
+	}
+
+	if number != d.number {
+		return "", fmt.Errorf("disk %d was written to after snapshot %s", virtualDisk.Key, snapshot.Value)
+	}
+
+	source, err := os.Open(d.path)
+	if err != nil {
+		return "", err
+	}
+	defer source.Close()
+
+	path := filepath.Join(v.dir, fmt.Sprintf("%s-%s-%d.img", vm.Reference().Value, snapshot.Value, virtualDisk.Key))
+	frozen, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer frozen.Close()
+
+	err = frozen.Truncate(d.capacity)
+	if err != nil {
+		return "", err
+	}
+
+	for _, area := range d.areas(0, number) {
+		buf := make([]byte, area.Length)
+		_, err = source.ReadAt(buf, area.Start)
+		if err == nil {
+			_, err = frozen.WriteAt(buf, area.Start)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return path, nil
+}
@@ -0,0 +1,104 @@
+package inventory
+
+import (
+	"fmt"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Verdict is whether a virtual machine can be migrated, from the worst of
+// its issues
+type Verdict string
+
+const (
+	// VerdictReady can be migrated as is
+	VerdictReady Verdict = "ready"
+	// VerdictWarning can be migrated, but the issues should be reviewed
+	// before planning it in a wave
+	VerdictWarning Verdict = "warning"
+	// VerdictBlocked can not be migrated until its issues are resolved
+	VerdictBlocked Verdict = "blocked"
+)
+
+type Issue struct {
+	Verdict Verdict `json:"verdict"`
+	Message string  `json:"message"`
+}
+
+func (i Issue) String() string {
+	return string(i.Verdict) + ": " + i.Message
+}
+
+// assess records the issues which get in the way of migrating a virtual
+// machine and sets its verdict.
+func assess(vm *VirtualMachine) {
+	issue := func(verdict Verdict, format string, args ...interface{}) {
+		vm.Issues = append(vm.Issues, Issue{
+			Verdict: verdict,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	if vm.Template {
+		issue(VerdictBlocked, "is a template")
+	}
+
+	if len(vm.Disks) == 0 {
+		issue(VerdictBlocked, "has no disks")
+	}
+
+	if !vm.ChangeTracking {
+		issue(VerdictBlocked, "change tracking is disabled, it must be enabled before the first migration cycle")
+	}
+
+	for _, disk := range vm.Disks {
+		switch disk.Backing {
+		case "rdm-physical":
+			issue(VerdictBlocked, "%s is a physical mode raw device mapping, which can not be snapshotted", disk.Label)
+		case "other":
+			issue(VerdictBlocked, "%s has an unsupported backing", disk.Label)
+		}
+
+		switch types.VirtualDiskMode(disk.Mode) {
+		case types.VirtualDiskModeIndependent_persistent, types.VirtualDiskModeIndependent_nonpersistent:
+			issue(VerdictBlocked, "%s is an independent disk, which is excluded from snapshots", disk.Label)
+		}
+
+		if disk.Sharing == string(types.VirtualDiskSharingSharingMultiWriter) {
+			issue(VerdictBlocked, "%s is shared with multi-writer, which can not be snapshotted", disk.Label)
+		}
+
+		if disk.Backing == "rdm-virtual" {
+			issue(VerdictWarning, "%s is a virtual mode raw device mapping, the volume is created with the size of the LUN", disk.Label)
+		}
+	}
+
+	for _, snapshot := range vm.Snapshots {
+		if snapshot == "migratekit" {
+			issue(VerdictWarning, "has a migratekit snapshot left over from an earlier run")
+		}
+	}
+
+	if len(vm.Snapshots) > 0 {
+		issue(VerdictWarning, "has %d snapshots, which slow down reading the disks", len(vm.Snapshots))
+	}
+
+	if vm.PowerState == string(types.VirtualMachinePowerStatePoweredOn) && !vm.ToolsRunning {
+		issue(VerdictWarning, "VMware Tools are not running, the guest can not be shut down for the cutover")
+	}
+
+	for _, nic := range vm.NICs {
+		if nic.Network == "" {
+			issue(VerdictWarning, "%s is not connected to a network", nic.Label)
+		}
+	}
+
+	vm.Verdict = VerdictReady
+	for _, i := range vm.Issues {
+		if i.Verdict == VerdictBlocked {
+			vm.Verdict = VerdictBlocked
+		} else if vm.Verdict == VerdictReady {
+			vm.Verdict = i.Verdict
+		}
+	}
+}
@@ -0,0 +1,344 @@
+// Package inventory walks the inventory of a vCenter or an ESXi host and
+// assesses whether every virtual machine in it can be migrated, which helps
+// planning migration waves.
+package inventory
+
+import (
+	"context"
+	"errors"
+	"path"
+
+	"github.com/vexxhost/migratekit/internal/machine"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+type VirtualMachine struct {
+	Path       string `json:"path"`
+	Name       string `json:"name"`
+	Datacenter string `json:"datacenter"`
+	Cluster    string `json:"cluster,omitempty"`
+	Host       string `json:"host,omitempty"`
+
+	PowerState     string           `json:"power_state"`
+	GuestID        string           `json:"guest_id"`
+	GuestFullName  string           `json:"guest_full_name"`
+	Firmware       machine.Firmware `json:"firmware"`
+	SecureBoot     bool             `json:"secure_boot"`
+	CPUs           int32            `json:"cpus"`
+	MemoryMB       int64            `json:"memory_mb"`
+	Template       bool             `json:"template"`
+	ChangeTracking bool             `json:"change_tracking"`
+	ToolsRunning   bool             `json:"tools_running"`
+	Snapshots      []string         `json:"snapshots"`
+
+	Disks []Disk `json:"disks"`
+	NICs  []NIC  `json:"nics"`
+
+	Verdict Verdict `json:"verdict"`
+	Issues  []Issue `json:"issues"`
+}
+
+type Disk struct {
+	Label           string `json:"label"`
+	File            string `json:"file"`
+	CapacityInBytes int64  `json:"capacity_bytes"`
+
+	// Backing is the type of the backing of the disk, such as "flat",
+	// "sesparse" or "rdm-physical"
+	Backing string `json:"backing"`
+	Thin    bool   `json:"thin"`
+	Mode    string `json:"mode,omitempty"`
+	Sharing string `json:"sharing,omitempty"`
+}
+
+type NIC struct {
+	Label      string `json:"label"`
+	MacAddress string `json:"mac_address"`
+
+	// Network is the name of the port group the adapter is connected to
+	Network string `json:"network"`
+}
+
+// Options restricts the virtual machines of the inventory
+type Options struct {
+	// Datacenter is the name of the only datacenter to walk, all of them are
+	// walked if it is empty
+	Datacenter string
+}
+
+// Collect returns every virtual machine of every datacenter with the
+// assessment of its readiness, in inventory order.
+func Collect(ctx context.Context, client *vim25.Client, opts *Options) ([]*VirtualMachine, error) {
+	finder := find.NewFinder(client)
+
+	pattern := "*"
+	if opts.Datacenter != "" {
+		pattern = opts.Datacenter
+	}
+
+	datacenters, err := finder.DatacenterList(ctx, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var vms []*VirtualMachine
+	for _, datacenter := range datacenters {
+		found, err := collectDatacenter(ctx, client, finder, datacenter)
+		if err != nil {
+			return nil, err
+		}
+
+		vms = append(vms, found...)
+	}
+
+	return vms, nil
+}
+
+// location is where a host is in the inventory
+type location struct {
+	host    string
+	cluster string
+}
+
+func collectDatacenter(ctx context.Context, client *vim25.Client, finder *find.Finder, datacenter *object.Datacenter) ([]*VirtualMachine, error) {
+	finder.SetDatacenter(datacenter)
+
+	hosts, err := hostLocations(ctx, finder, datacenter)
+	if err != nil {
+		return nil, err
+	}
+
+	networks, err := networkNames(ctx, finder, datacenter)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := finder.VirtualMachineList(ctx, path.Join(datacenter.InventoryPath, "vm", "..."))
+	if isNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	refs := make([]types.ManagedObjectReference, len(list))
+	for i, vm := range list {
+		refs[i] = vm.Reference()
+	}
+
+	var objects []mo.VirtualMachine
+	err = property.DefaultCollector(client).Retrieve(ctx, refs, []string{"name", "config", "runtime", "snapshot", "guest"}, &objects)
+	if err != nil {
+		return nil, err
+	}
+
+	byRef := map[types.ManagedObjectReference]*mo.VirtualMachine{}
+	for i := range objects {
+		byRef[objects[i].Reference()] = &objects[i]
+	}
+
+	var vms []*VirtualMachine
+	for _, ref := range list {
+		o, ok := byRef[ref.Reference()]
+		if !ok {
+			continue
+		}
+
+		vm := newVirtualMachine(o, networks)
+		vm.Path = ref.InventoryPath
+		vm.Datacenter = datacenter.Name()
+
+		if o.Runtime.Host != nil {
+			l := hosts[*o.Runtime.Host]
+			vm.Host = l.host
+			vm.Cluster = l.cluster
+		}
+
+		assess(vm)
+		vms = append(vms, vm)
+	}
+
+	return vms, nil
+}
+
+// hostLocations returns the name of every host of the datacenter and of the
+// cluster it is part of, if any
+func hostLocations(ctx context.Context, finder *find.Finder, datacenter *object.Datacenter) (map[types.ManagedObjectReference]location, error) {
+	root := path.Join(datacenter.InventoryPath, "host", "...")
+
+	clusters, err := finder.ClusterComputeResourceList(ctx, root)
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+
+	clusterPaths := map[string]string{}
+	for _, cluster := range clusters {
+		clusterPaths[cluster.InventoryPath] = cluster.Name()
+	}
+
+	hosts, err := finder.HostSystemList(ctx, root)
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+
+	locations := map[types.ManagedObjectReference]location{}
+	for _, host := range hosts {
+		locations[host.Reference()] = location{
+			host:    host.Name(),
+			cluster: clusterPaths[path.Dir(host.InventoryPath)],
+		}
+	}
+
+	return locations, nil
+}
+
+// networkNames returns the name of every network of the datacenter, by the
+// value of its reference which is also the key of distributed port groups
+func networkNames(ctx context.Context, finder *find.Finder, datacenter *object.Datacenter) (map[string]string, error) {
+	networks, err := finder.NetworkList(ctx, path.Join(datacenter.InventoryPath, "network", "..."))
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+
+	names := map[string]string{}
+	for _, network := range networks {
+		names[network.Reference().Value] = path.Base(network.GetInventoryPath())
+	}
+
+	return names, nil
+}
+
+func isNotFound(err error) bool {
+	var notFound *find.NotFoundError
+	return errors.As(err, &notFound)
+}
+
+func newVirtualMachine(o *mo.VirtualMachine, networks map[string]string) *VirtualMachine {
+	vm := &VirtualMachine{
+		Name:       o.Name,
+		PowerState: string(o.Runtime.PowerState),
+		Firmware:   machine.FirmwareBIOS,
+		Snapshots:  []string{},
+		Disks:      []Disk{},
+		NICs:       []NIC{},
+		Issues:     []Issue{},
+	}
+
+	if o.Guest != nil {
+		vm.ToolsRunning = o.Guest.ToolsRunningStatus == string(types.VirtualMachineToolsRunningStatusGuestToolsRunning)
+	}
+
+	if o.Snapshot != nil {
+		vm.Snapshots = snapshotNames(o.Snapshot.RootSnapshotList)
+	}
+
+	// The configuration is not available while a virtual machine is being
+	// created or is inaccessible
+	if o.Config == nil {
+		return vm
+	}
+
+	vm.GuestID = o.Config.GuestId
+	vm.GuestFullName = o.Config.GuestFullName
+	vm.CPUs = o.Config.Hardware.NumCPU
+	vm.MemoryMB = int64(o.Config.Hardware.MemoryMB)
+	vm.Template = o.Config.Template
+	vm.ChangeTracking = o.Config.ChangeTrackingEnabled != nil && *o.Config.ChangeTrackingEnabled
+
+	if types.GuestOsDescriptorFirmwareType(o.Config.Firmware) == types.GuestOsDescriptorFirmwareTypeEfi {
+		vm.Firmware = machine.FirmwareEFI
+	}
+
+	if o.Config.BootOptions != nil && o.Config.BootOptions.EfiSecureBootEnabled != nil {
+		vm.SecureBoot = *o.Config.BootOptions.EfiSecureBootEnabled
+	}
+
+	for _, device := range o.Config.Hardware.Device {
+		switch device := device.(type) {
+		case *types.VirtualDisk:
+			vm.Disks = append(vm.Disks, newDisk(device))
+		case types.BaseVirtualEthernetCard:
+			card := device.GetVirtualEthernetCard()
+			vm.NICs = append(vm.NICs, NIC{
+				Label:      card.DeviceInfo.GetDescription().Label,
+				MacAddress: card.MacAddress,
+				Network:    networkName(card.Backing, networks),
+			})
+		}
+	}
+
+	return vm
+}
+
+func snapshotNames(tree []types.VirtualMachineSnapshotTree) []string {
+	var names []string
+	for _, snapshot := range tree {
+		names = append(names, snapshot.Name)
+		names = append(names, snapshotNames(snapshot.ChildSnapshotList)...)
+	}
+
+	return names
+}
+
+func newDisk(disk *types.VirtualDisk) Disk {
+	d := Disk{
+		Label:           disk.DeviceInfo.GetDescription().Label,
+		CapacityInBytes: disk.CapacityInBytes,
+	}
+
+	switch backing := disk.Backing.(type) {
+	case *types.VirtualDiskFlatVer2BackingInfo:
+		d.Backing = "flat"
+		d.File = backing.FileName
+		d.Thin = backing.ThinProvisioned != nil && *backing.ThinProvisioned
+		d.Mode = backing.DiskMode
+		d.Sharing = backing.Sharing
+	case *types.VirtualDiskSeSparseBackingInfo:
+		d.Backing = "sesparse"
+		d.File = backing.FileName
+		d.Thin = true
+		d.Mode = backing.DiskMode
+	case *types.VirtualDiskSparseVer2BackingInfo:
+		d.Backing = "sparse"
+		d.File = backing.FileName
+		d.Thin = true
+		d.Mode = backing.DiskMode
+	case *types.VirtualDiskRawDiskMappingVer1BackingInfo:
+		d.Backing = "rdm-virtual"
+		if backing.CompatibilityMode == string(types.VirtualDiskCompatibilityModePhysicalMode) {
+			d.Backing = "rdm-physical"
+		}
+
+		d.File = backing.FileName
+		d.Mode = backing.DiskMode
+		d.Sharing = backing.Sharing
+	case types.BaseVirtualDeviceFileBackingInfo:
+		d.Backing = "other"
+		d.File = backing.GetVirtualDeviceFileBackingInfo().FileName
+	default:
+		d.Backing = "other"
+	}
+
+	return d
+}
+
+func networkName(backing types.BaseVirtualDeviceBackingInfo, networks map[string]string) string {
+	switch backing := backing.(type) {
+	case *types.VirtualEthernetCardNetworkBackingInfo:
+		return backing.DeviceName
+	case *types.VirtualEthernetCardDistributedVirtualPortBackingInfo:
+		if name, ok := networks[backing.Port.PortgroupKey]; ok {
+			return name
+		}
+
+		return backing.Port.PortgroupKey
+	case *types.VirtualEthernetCardOpaqueNetworkBackingInfo:
+		return backing.OpaqueNetworkId
+	default:
+		return ""
+	}
+}
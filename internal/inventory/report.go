@@ -0,0 +1,115 @@
+package inventory
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+var Formats = []string{FormatCSV, FormatJSON}
+
+// Write writes the report in the format, CSV has one row per virtual machine
+// with the disks, network adapters and issues joined with semicolons.
+func Write(w io.Writer, format string, vms []*VirtualMachine) error {
+	switch format {
+	case FormatCSV:
+		return writeCSV(w, vms)
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(vms)
+	default:
+		return fmt.Errorf("invalid report format: %s, valid options are: %s", format, strings.Join(Formats, ", "))
+	}
+}
+
+var csvHeader = []string{
+	"path",
+	"name",
+	"datacenter",
+	"cluster",
+	"host",
+	"power_state",
+	"guest_id",
+	"guest_full_name",
+	"firmware",
+	"secure_boot",
+	"cpus",
+	"memory_mb",
+	"change_tracking",
+	"tools_running",
+	"snapshots",
+	"disk_count",
+	"disk_capacity_bytes",
+	"disks",
+	"nics",
+	"verdict",
+	"issues",
+}
+
+func writeCSV(w io.Writer, vms []*VirtualMachine) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return err
+	}
+
+	for _, vm := range vms {
+		var capacity int64
+		disks := make([]string, len(vm.Disks))
+		for i, disk := range vm.Disks {
+			capacity += disk.CapacityInBytes
+			disks[i] = fmt.Sprintf("%s=%d:%s", disk.Label, disk.CapacityInBytes, disk.Backing)
+			if disk.Thin {
+				disks[i] += ":thin"
+			}
+		}
+
+		nics := make([]string, len(vm.NICs))
+		for i, nic := range vm.NICs {
+			nics[i] = nic.MacAddress + "=" + nic.Network
+		}
+
+		issues := make([]string, len(vm.Issues))
+		for i, issue := range vm.Issues {
+			issues[i] = issue.String()
+		}
+
+		err := writer.Write([]string{
+			vm.Path,
+			vm.Name,
+			vm.Datacenter,
+			vm.Cluster,
+			vm.Host,
+			vm.PowerState,
+			vm.GuestID,
+			vm.GuestFullName,
+			string(vm.Firmware),
+			strconv.FormatBool(vm.SecureBoot),
+			strconv.Itoa(int(vm.CPUs)),
+			strconv.FormatInt(vm.MemoryMB, 10),
+			strconv.FormatBool(vm.ChangeTracking),
+			strconv.FormatBool(vm.ToolsRunning),
+			strconv.Itoa(len(vm.Snapshots)),
+			strconv.Itoa(len(vm.Disks)),
+			strconv.FormatInt(capacity, 10),
+			strings.Join(disks, ";"),
+			strings.Join(nics, ";"),
+			string(vm.Verdict),
+			strings.Join(issues, ";"),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,70 @@
+// Package machine describes a virtual machine independently of where it is
+// migrated from, which is what the volumes and the server on OpenStack are
+// created from.
+package machine
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gosimple/slug"
+)
+
+type Firmware string
+
+const (
+	FirmwareBIOS Firmware = "bios"
+	FirmwareEFI  Firmware = "efi"
+)
+
+type VirtualMachine struct {
+	// ID identifies the virtual machine in its source, it is recorded in the
+	// metadata of the volumes to find them again
+	ID       string
+	Name     string
+	CPUs     int32
+	MemoryMB int64
+
+	Firmware   Firmware
+	SecureBoot bool
+
+	// GuestID is the guest operating system as identified by the source,
+	// such as the VMware guest ID or the libosinfo ID of a libvirt domain
+	GuestID       string
+	GuestFullName string
+
+	Disks []*Disk
+	NICs  []*NIC
+}
+
+type Disk struct {
+	// Key identifies the disk within the virtual machine
+	Key             int32
+	CapacityInBytes int64
+
+	// ObjectID is the VMware disk object ID, only used to find volumes
+	// created by older versions
+	ObjectID string
+
+	// ChangeID is the change tracking ID of the disk at the time it is read,
+	// empty if the source does not track changes
+	ChangeID string
+}
+
+type NIC struct {
+	MacAddress string
+	Label      string
+	Summary    string
+}
+
+// DiskLabel returns the name of the volume of a disk
+func (vm *VirtualMachine) DiskLabel(disk *Disk) string {
+	return slug.Make(vm.Name + "-" + strconv.Itoa(int(disk.Key)))
+}
+
+// IsWindows returns true if the guest ID names a Windows operating system,
+// Linux is assumed otherwise.
+func (vm *VirtualMachine) IsWindows() bool {
+	guestID := strings.ToLower(vm.GuestID)
+	return strings.Contains(guestID, "windows") || strings.HasPrefix(guestID, "http://microsoft.com/win/")
+}
@@ -0,0 +1,153 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const namespace = "migratekit"
+
+const (
+	PhaseSnapshotCreate  = "snapshot_create"
+	PhaseSnapshotRemove  = "snapshot_remove"
+	PhaseNbdkitStart     = "nbdkit_start"
+	PhaseTargetConnect   = "target_connect"
+	PhaseFullCopy        = "full_copy"
+	PhaseIncrementalCopy = "incremental_copy"
+	PhaseV2V             = "virt_v2v"
+	PhaseChangeID        = "change_id"
+)
+
+var (
+	DiskReadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "disk_read_bytes_total",
+		Help:      "Bytes read from the source disk.",
+	}, []string{"vm", "disk"})
+
+	DiskWrittenBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "disk_written_bytes_total",
+		Help:      "Bytes written to the target disk.",
+	}, []string{"vm", "disk"})
+
+	DiskZeroedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "disk_zeroed_bytes_total",
+		Help:      "Bytes zeroed on the target disk instead of being written.",
+	}, []string{"vm", "disk"})
+
+	ChangedAreaBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "changed_area_bytes_total",
+		Help:      "Bytes reported as changed by QueryChangedDiskAreas.",
+	}, []string{"vm", "disk"})
+
+	ChangedAreas = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "changed_areas_total",
+		Help:      "Number of areas reported as changed by QueryChangedDiskAreas.",
+	}, []string{"vm", "disk"})
+
+	CycleDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "migration_cycle_duration_seconds",
+		Help:      "Duration of migration cycles.",
+		Buckets:   prometheus.ExponentialBuckets(30, 2, 14),
+	}, []string{"vm"})
+
+	LastCycleDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "migration_cycle_last_duration_seconds",
+		Help:      "Duration of the most recent migration cycle.",
+	}, []string{"vm"})
+
+	LastCycleChangedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "migration_cycle_last_changed_bytes",
+		Help:      "Bytes copied during the most recent migration cycle.",
+	}, []string{"vm"})
+
+	ChangeRate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "change_rate_bytes_per_second",
+		Help:      "Rate at which data changes on the source, measured across recent cycles.",
+	}, []string{"vm"})
+
+	EstimatedCutoverDowntime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "estimated_cutover_downtime_seconds",
+		Help:      "Estimated duration of the final sync of a cutover, based on recent cycles.",
+	}, []string{"vm"})
+
+	SnapshotDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "snapshot_operation_duration_seconds",
+		Help:      "Latency of VMware snapshot create and remove operations.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"vm", "operation"})
+
+	Failures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "failures_total",
+		Help:      "Failures by migration phase.",
+	}, []string{"vm", "phase"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		DiskReadBytes,
+		DiskWrittenBytes,
+		DiskZeroedBytes,
+		ChangedAreaBytes,
+		ChangedAreas,
+		CycleDuration,
+		LastCycleDuration,
+		LastCycleChangedBytes,
+		ChangeRate,
+		EstimatedCutoverDowntime,
+		SnapshotDuration,
+		Failures,
+	)
+}
+
+// Failure records a failure for the given phase and returns the error
+// unchanged so that it can be used inline in return statements, interrupted
+// operations are not counted as failures.
+func Failure(vm, phase string, err error) error {
+	if err != nil && !errors.Is(err, context.Canceled) {
+		Failures.WithLabelValues(vm, phase).Inc()
+	}
+
+	return err
+}
+
+// Serve exposes the metrics over HTTP on the given address, the listener is
+// opened synchronously so that an invalid address is reported immediately.
+func Serve(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.WithFields(log.Fields{
+		"address": listener.Addr().String(),
+	}).Info("Serving metrics")
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.WithError(err).Error("Metrics server stopped")
+		}
+	}()
+
+	return nil
+}
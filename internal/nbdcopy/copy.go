@@ -0,0 +1,272 @@
+// Package nbdcopy copies the data of an NBD export to a block device or a
+// file through libnbd, skipping or zeroing the areas of the export which read
+// as zeroes.
+package nbdcopy
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/schollz/progressbar/v3"
+	"github.com/vexxhost/migratekit/internal/blockdev"
+	"github.com/vexxhost/migratekit/internal/metrics"
+	"github.com/vexxhost/migratekit/internal/progress"
+	"libguestfs.org/libnbd"
+)
+
+const MaxChunkSize = 64 * 1024 * 1024
+
+// Copy copies data from an NBD export into the target device, keeping track
+// of the metrics for the disk.
+type Copy struct {
+	handle       *libnbd.Libnbd
+	fd           *os.File
+	bar          *progressbar.ProgressBar
+	extents      bool
+	onProgress   func(offset int64) error
+	readBytes    prometheus.Counter
+	writtenBytes prometheus.Counter
+	zeroedBytes  prometheus.Counter
+}
+
+type Options struct {
+	// Description is shown next to the progress bar
+	Description string
+	// Size is the size of the export, which the progress is relative to
+	Size int64
+
+	// VirtualMachine and Disk label the metrics of the copy
+	VirtualMachine string
+	Disk           string
+
+	// OnProgress (if set) is called with the offset of the export below
+	// which everything has been copied, every time it moves forward.  An
+	// error returned by it stops the copy.
+	OnProgress func(offset int64) error
+}
+
+// Open connects to the NBD export at uri and opens the target device at path
+// for writing.
+func Open(uri string, path string, opts *Options) (*Copy, error) {
+	handle, err := libnbd.Create()
+	if err != nil {
+		return nil, err
+	}
+
+	err = handle.AddMetaContext(libnbd.CONTEXT_BASE_ALLOCATION)
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+
+	err = handle.ConnectUri(uri)
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+
+	extents, err := handle.CanMetaContext(libnbd.CONTEXT_BASE_ALLOCATION)
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_EXCL|syscall.O_DIRECT, 0644)
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+
+	return &Copy{
+		handle:       handle,
+		fd:           fd,
+		bar:          progress.DataProgressBar(opts.Description, opts.Size),
+		extents:      extents,
+		onProgress:   opts.OnProgress,
+		readBytes:    metrics.DiskReadBytes.WithLabelValues(opts.VirtualMachine, opts.Disk),
+		writtenBytes: metrics.DiskWrittenBytes.WithLabelValues(opts.VirtualMachine, opts.Disk),
+		zeroedBytes:  metrics.DiskZeroedBytes.WithLabelValues(opts.VirtualMachine, opts.Disk),
+	}, nil
+}
+
+func (c *Copy) Close() {
+	c.fd.Close()
+	c.handle.Close()
+}
+
+// Sync flushes the data written so far to the target device
+func (c *Copy) Sync() error {
+	return c.fd.Sync()
+}
+
+// SetProgress records that everything below an offset of the export has
+// been copied, such as after skipping an area which does not need copying.
+func (c *Copy) SetProgress(offset int64) error {
+	c.bar.Set64(offset)
+
+	if c.onProgress == nil {
+		return nil
+	}
+
+	return c.onProgress(offset)
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// blockExtent is a range of the source with its base:allocation flags
+type blockExtent struct {
+	Start  int64
+	Length int64
+	Flags  uint32
+}
+
+// blockStatus returns the allocation status of a range of the source, the
+// whole range is reported as data if the server does not support extents.
+func (c *Copy) blockStatus(start, length int64) ([]blockExtent, error) {
+	end := start + length
+	if !c.extents {
+		return []blockExtent{{Start: start, Length: length}}, nil
+	}
+
+	var result []blockExtent
+	for offset := start; offset < end; {
+		err := c.handle.BlockStatus(uint64(end-offset), uint64(offset), func(metacontext string, extentOffset uint64, entries []uint32, _ *int) int {
+			if metacontext != libnbd.CONTEXT_BASE_ALLOCATION {
+				return 0
+			}
+
+			position := int64(extentOffset)
+			for i := 0; i+1 < len(entries) && position < end; i += 2 {
+				extentLength := min(int64(entries[i]), end-position)
+
+				result = append(result, blockExtent{
+					Start:  position,
+					Length: extentLength,
+					Flags:  entries[i+1],
+				})
+				position += extentLength
+			}
+
+			return 0
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(result) == 0 || result[len(result)-1].Start+result[len(result)-1].Length <= offset {
+			return nil, errors.New("server returned no extents")
+		}
+
+		offset = result[len(result)-1].Start + result[len(result)-1].Length
+	}
+
+	return result, nil
+}
+
+// CopyRange copies a range of the disk in chunks.  Areas which the source
+// reports as reading as zeroes are zeroed on the target instead of being
+// written, unless skipZero is set in which case they are skipped since the
+// target is already zeroed.  Zeroing unmaps the range if the device supports
+// it.  Holes without the zero flag may hold data, so they are copied like any
+// other area.
+func (c *Copy) CopyRange(ctx context.Context, start, length int64, skipZero bool) error {
+	for offset := start; offset < start+length; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		chunkSize := length - (offset - start)
+		if chunkSize > MaxChunkSize {
+			chunkSize = MaxChunkSize
+		}
+
+		extents, err := c.blockStatus(offset, chunkSize)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range extents {
+			switch {
+			case skipZero && e.Flags&libnbd.STATE_ZERO != 0:
+			case e.Flags&libnbd.STATE_ZERO != 0:
+				err = c.ZeroRange(e.Start, e.Length)
+			default:
+				err = c.copyData(e.Start, e.Length, skipZero)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		offset += chunkSize
+		if err := c.SetProgress(offset); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Copy) copyData(start, length int64, skipZero bool) error {
+	buf := make([]byte, length)
+	err := c.handle.Pread(buf, uint64(start), nil)
+	if err != nil {
+		return err
+	}
+	c.readBytes.Add(float64(length))
+
+	if isZero(buf) {
+		if skipZero {
+			return nil
+		}
+
+		return c.ZeroRange(start, length)
+	}
+
+	_, err = c.fd.WriteAt(buf, start)
+	if err != nil {
+		return err
+	}
+	c.writtenBytes.Add(float64(length))
+
+	return nil
+}
+
+// ZeroRange zeroes a range of the target in chunks.  Holes are punched into
+// targets which are regular files, and zeroes are only written if neither is
+// supported.
+func (c *Copy) ZeroRange(start, length int64) error {
+	for offset := start; offset < start+length; {
+		chunkSize := min(start+length-offset, MaxChunkSize)
+
+		err := blockdev.ZeroOut(c.fd, offset, chunkSize)
+		if errors.Is(err, blockdev.ErrNotSupported) {
+			err = blockdev.PunchHole(c.fd, offset, chunkSize)
+		}
+		if errors.Is(err, blockdev.ErrNotSupported) {
+			_, err = c.fd.WriteAt(make([]byte, chunkSize), offset)
+		}
+		if err != nil {
+			return err
+		}
+
+		c.zeroedBytes.Add(float64(chunkSize))
+		offset += chunkSize
+		if err := c.SetProgress(offset); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
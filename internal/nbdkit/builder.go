@@ -3,7 +3,7 @@ package nbdkit
 import (
 	"fmt"
 	"os"
-	"os/exec"
+	"path/filepath"
 )
 
 type CompressionMethod string
@@ -16,61 +16,32 @@ const (
 )
 
 type NbdkitBuilder struct {
-	server      string
-	username    string
-	password    string
-	thumbprint  string
-	vm          string
-	snapshot    string
-	filename    string
-	compression CompressionMethod
+	source   Source
+	throttle bool
 }
 
 func NewNbdkitBuilder() *NbdkitBuilder {
 	return &NbdkitBuilder{}
 }
 
-func (b *NbdkitBuilder) Server(server string) *NbdkitBuilder {
-	b.server = server
+// Source sets the plugin which the disk is served from.
+func (b *NbdkitBuilder) Source(source Source) *NbdkitBuilder {
+	b.source = source
 	return b
 }
 
-func (b *NbdkitBuilder) Username(username string) *NbdkitBuilder {
-	b.username = username
-	return b
-}
-
-func (b *NbdkitBuilder) Password(password string) *NbdkitBuilder {
-	b.password = password
-	return b
-}
-
-func (b *NbdkitBuilder) Thumbprint(thumbprint string) *NbdkitBuilder {
-	b.thumbprint = thumbprint
-	return b
-}
-
-func (b *NbdkitBuilder) VirtualMachine(vm string) *NbdkitBuilder {
-	b.vm = vm
-	return b
-}
-
-func (b *NbdkitBuilder) Snapshot(snapshot string) *NbdkitBuilder {
-	b.snapshot = snapshot
-	return b
-}
-
-func (b *NbdkitBuilder) Filename(filename string) *NbdkitBuilder {
-	b.filename = filename
-	return b
-}
-
-func (b *NbdkitBuilder) Compression(method CompressionMethod) *NbdkitBuilder {
-	b.compression = method
+// Throttle enables the nbdkit rate filter, the rate is read from a file
+// which can be updated while the server is running.
+func (b *NbdkitBuilder) Throttle(throttle bool) *NbdkitBuilder {
+	b.throttle = throttle
 	return b
 }
 
 func (b *NbdkitBuilder) Build() (*NbdkitServer, error) {
+	if b.source == nil {
+		return nil, fmt.Errorf("no source set for nbdkit server")
+	}
+
 	tmp, err := os.MkdirTemp("", "migratekit-")
 	if err != nil {
 		return nil, err
@@ -79,29 +50,26 @@ func (b *NbdkitBuilder) Build() (*NbdkitServer, error) {
 	socket := fmt.Sprintf("%s/nbdkit.sock", tmp)
 	pidFile := fmt.Sprintf("%s/nbdkit.pid", tmp)
 
-	os.Setenv("LD_LIBRARY_PATH", "/usr/lib64/vmware-vix-disklib/lib64")
-	cmd := exec.Command(
-		"nbdkit",
+	args := []string{
 		"--exit-with-parent",
 		"--readonly",
 		"--foreground",
 		fmt.Sprintf("--unix=%s", socket),
 		fmt.Sprintf("--pidfile=%s", pidFile),
-		"vddk",
-		fmt.Sprintf("server=%s", b.server),
-		fmt.Sprintf("user=%s", b.username),
-		fmt.Sprintf("password=%s", b.password),
-		fmt.Sprintf("thumbprint=%s", b.thumbprint),
-		fmt.Sprintf("compression=%s", b.compression),
-		fmt.Sprintf("vm=moref=%s", b.vm),
-		fmt.Sprintf("snapshot=%s", b.snapshot),
-		"transports=file:nbdssl:nbd",
-		b.filename,
-	)
+	}
+
+	var rateFile string
+	if b.throttle {
+		rateFile = fmt.Sprintf("%s/rate", tmp)
+		args = append(args, "--filter=rate")
+	}
 
 	return &NbdkitServer{
-		cmd:     cmd,
-		socket:  socket,
-		pidFile: pidFile,
+		source:     b.source,
+		args:       args,
+		socket:     socket,
+		pidFile:    pidFile,
+		secretsDir: filepath.Join(tmp, "secrets"),
+		rateFile:   rateFile,
 	}, nil
 }
@@ -1,25 +1,58 @@
 package nbdkit
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/vexxhost/migratekit/internal/secret"
 )
 
 type NbdkitServer struct {
-	cmd     *exec.Cmd
-	socket  string
-	pidFile string
+	source     Source
+	args       []string
+	cmd        *exec.Cmd
+	socket     string
+	pidFile    string
+	secretsDir string
+	rateFile   string
 }
 
 func (s *NbdkitServer) Start() error {
+	// Secrets are passed through files to keep them out of the process list,
+	// they are only written here since nbdkit reads them while starting up, so
+	// they are no longer needed once the server is running or failed to start.
+	if err := os.Mkdir(s.secretsDir, 0700); err != nil {
+		return err
+	}
+	defer os.RemoveAll(s.secretsDir)
+
+	plugin, pluginArgs, err := s.source.Plugin(s.secretsDir)
+	if err != nil {
+		return err
+	}
+
+	args := slices.Concat(s.args, []string{plugin}, pluginArgs)
+	if s.rateFile != "" {
+		args = append(args, fmt.Sprintf("rate-file=%s", s.rateFile))
+	}
+
+	s.cmd = exec.Command("nbdkit", args...)
+	s.cmd.Env = append(os.Environ(), s.source.Env()...)
 	s.cmd.Stdout = os.Stdout
 	s.cmd.Stderr = os.Stderr
 
-	log.Debug("Running command: ", s.cmd)
+	// Keep nbdkit out of the process group of the terminal, so that it is
+	// stopped as part of the cleanup instead of on the interrupt
+	s.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	log.Debug("Running command: ", strings.Join(secret.RedactArgs(s.cmd.Args), " "))
 	if err := s.cmd.Start(); err != nil {
 		return fmt.Errorf("failed to start nbdkit server: %w", err)
 	}
@@ -41,9 +74,14 @@ func (s *NbdkitServer) Start() error {
 }
 
 func (s *NbdkitServer) Stop() error {
-	if err := s.cmd.Process.Kill(); err != nil {
+	if s.cmd == nil || s.cmd.Process == nil {
+		return nil
+	}
+
+	if err := s.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
 		return fmt.Errorf("failed to stop nbdkit server: %w", err)
 	}
+	s.cmd.Wait()
 
 	os.Remove(s.socket)
 	return nil
@@ -53,6 +91,12 @@ func (s *NbdkitServer) Socket() string {
 	return s.socket
 }
 
+// RateFile returns the file the rate filter reads the rate from, it is empty
+// if the server was built without throttling.
+func (s *NbdkitServer) RateFile() string {
+	return s.rateFile
+}
+
 func (s *NbdkitServer) LibNBDExportName() string {
 	return fmt.Sprintf("nbd+unix:///?socket=%s", s.socket)
 }
@@ -0,0 +1,263 @@
+package nbdkit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultVddkLibDir is where the VDDK tarball is extracted to by default
+const DefaultVddkLibDir = "/usr/lib64/vmware-vix-disklib"
+
+// DefaultVddkTransports is the order in which VDDK tries the transport modes
+var DefaultVddkTransports = []string{"file", "nbdssl", "nbd"}
+
+// Source is the nbdkit plugin which a disk is served from.
+type Source interface {
+	// Plugin returns the name of the plugin and its parameters, secrets are
+	// written to files in dir which is removed once nbdkit has started.
+	Plugin(dir string) (string, []string, error)
+
+	// Env returns the environment variables which the plugin needs on top of
+	// the ones of migratekit.
+	Env() []string
+}
+
+// writeSecret writes a secret to a file only readable by the current user and
+// returns the nbdkit parameter value which reads it from there.
+func writeSecret(dir string, name string, value string) (string, error) {
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, []byte(value), 0600); err != nil {
+		return "", err
+	}
+
+	return "+" + file, nil
+}
+
+// VddkSource reads a disk of a snapshot through VDDK, the disk must be opened
+// with Filename from the snapshot and not from the virtual machine.
+type VddkSource struct {
+	Server         string
+	Username       string
+	Password       string
+	Thumbprint     string
+	VirtualMachine string
+	Snapshot       string
+	Filename       string
+	Compression    CompressionMethod
+
+	// Transports is the order in which the transport modes are tried,
+	// DefaultVddkTransports if empty
+	Transports []string
+	// LibDir is where VDDK is installed, DefaultVddkLibDir if empty
+	LibDir string
+	// NfcHostPort is the port of the NFC service of the ESXi hosts if it is
+	// not the default one
+	NfcHostPort int
+	// Cookie is the cookie of an existing vCenter session, which is used
+	// instead of the username and password if set
+	Cookie string
+	// Config is a VDDK configuration file with advanced settings
+	Config string
+}
+
+func (s *VddkSource) libDir() string {
+	if s.LibDir == "" {
+		return DefaultVddkLibDir
+	}
+
+	return s.LibDir
+}
+
+func (s *VddkSource) Plugin(dir string) (string, []string, error) {
+	transports := s.Transports
+	if len(transports) == 0 {
+		transports = DefaultVddkTransports
+	}
+
+	args := []string{
+		fmt.Sprintf("server=%s", s.Server),
+		fmt.Sprintf("libdir=%s", s.libDir()),
+		fmt.Sprintf("thumbprint=%s", s.Thumbprint),
+		fmt.Sprintf("compression=%s", s.Compression),
+		fmt.Sprintf("vm=moref=%s", s.VirtualMachine),
+		fmt.Sprintf("snapshot=%s", s.Snapshot),
+		fmt.Sprintf("transports=%s", strings.Join(transports, ":")),
+	}
+
+	if s.Cookie != "" {
+		cookie, err := writeSecret(dir, "cookie", s.Cookie)
+		if err != nil {
+			return "", nil, err
+		}
+
+		args = append(args, fmt.Sprintf("cookie=%s", cookie))
+	} else {
+		password, err := writeSecret(dir, "password", s.Password)
+		if err != nil {
+			return "", nil, err
+		}
+
+		args = append(args,
+			fmt.Sprintf("user=%s", s.Username),
+			fmt.Sprintf("password=%s", password),
+		)
+	}
+
+	if s.NfcHostPort != 0 {
+		args = append(args, fmt.Sprintf("nfc_host_port=%d", s.NfcHostPort))
+	}
+
+	if s.Config != "" {
+		args = append(args, fmt.Sprintf("config=%s", s.Config))
+	}
+
+	return "vddk", append(args, fmt.Sprintf("file=%s", s.Filename)), nil
+}
+
+func (s *VddkSource) Env() []string {
+	return []string{"LD_LIBRARY_PATH=" + filepath.Join(s.libDir(), "lib64")}
+}
+
+// SSHSource reads a flat disk file from the datastore of an ESXi host over
+// SSH, authentication uses the identity file or the SSH agent.
+type SSHSource struct {
+	Host       string
+	Port       int
+	User       string
+	Identity   string
+	KnownHosts string
+	Path       string
+}
+
+func (s *SSHSource) Plugin(dir string) (string, []string, error) {
+	args := []string{
+		fmt.Sprintf("host=%s", s.Host),
+		fmt.Sprintf("path=%s", s.Path),
+	}
+
+	if s.Port != 0 {
+		args = append(args, fmt.Sprintf("port=%d", s.Port))
+	}
+
+	if s.User != "" {
+		args = append(args, fmt.Sprintf("user=%s", s.User))
+	}
+
+	if s.Identity != "" {
+		args = append(args, fmt.Sprintf("identity=%s", s.Identity))
+	}
+
+	if s.KnownHosts != "" {
+		args = append(args, fmt.Sprintf("known-hosts=%s", s.KnownHosts))
+	}
+
+	return "ssh", args, nil
+}
+
+func (s *SSHSource) Env() []string {
+	return nil
+}
+
+// CurlSource reads a flat disk file over HTTPS, such as from the datastore
+// file browser of vCenter.
+type CurlSource struct {
+	URL      string
+	Username string
+	Password string
+	// CAInfo is a PEM file with the CA certificates to verify the server
+	// with, the system CAs are used if empty
+	CAInfo   string
+	Insecure bool
+}
+
+func (s *CurlSource) Plugin(dir string) (string, []string, error) {
+	args := []string{
+		fmt.Sprintf("url=%s", s.URL),
+	}
+
+	if s.Username != "" {
+		password, err := writeSecret(dir, "password", s.Password)
+		if err != nil {
+			return "", nil, err
+		}
+
+		args = append(args,
+			fmt.Sprintf("user=%s", s.Username),
+			fmt.Sprintf("password=%s", password),
+		)
+	}
+
+	if s.CAInfo != "" {
+		args = append(args, fmt.Sprintf("cainfo=%s", s.CAInfo))
+	}
+
+	if s.Insecure {
+		args = append(args, "sslverify=false")
+	}
+
+	return "curl", args, nil
+}
+
+func (s *CurlSource) Env() []string {
+	return nil
+}
+
+// FileSource reads a local raw disk image, such as the flat extent of a
+// VMDK.
+type FileSource struct {
+	Path string
+}
+
+func (s *FileSource) Plugin(dir string) (string, []string, error) {
+	return "file", []string{fmt.Sprintf("file=%s", s.Path)}, nil
+}
+
+func (s *FileSource) Env() []string {
+	return nil
+}
+
+// QemuSource reads a disk image in any format supported by qemu, such as a
+// VMDK exported from VMware, by running qemu-nbd behind the nbdkit nbd
+// plugin.
+type QemuSource struct {
+	Path   string
+	Format string
+
+	// Offset and Size locate the image inside of the file if Size is set,
+	// such as a disk stored in an OVA which is a tar archive
+	Offset int64
+	Size   int64
+}
+
+// ImageArgs returns the arguments of qemu-nbd and qemu-img which open the
+// image
+func (s *QemuSource) ImageArgs() []string {
+	if s.Size == 0 {
+		return []string{"-f", s.Format, s.Path}
+	}
+
+	// Commas are escaped by doubling them in qemu options
+	return []string{"--image-opts", fmt.Sprintf(
+		"driver=%s,file.driver=raw,file.offset=%d,file.size=%d,file.file.driver=file,file.file.filename=%s",
+		s.Format, s.Offset, s.Size, strings.ReplaceAll(s.Path, ",", ",,"),
+	)}
+}
+
+func (s *QemuSource) Plugin(dir string) (string, []string, error) {
+	args := []string{
+		"command=qemu-nbd",
+		"arg=--read-only",
+	}
+
+	for _, arg := range s.ImageArgs() {
+		args = append(args, "arg="+arg)
+	}
+
+	return "nbd", args, nil
+}
+
+func (s *QemuSource) Env() []string {
+	return nil
+}
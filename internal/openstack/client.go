@@ -5,7 +5,6 @@ import (
 	"crypto/tls"
 	"errors"
 	"net/http"
-	"os"
 	"strconv"
 	"time"
 
@@ -13,33 +12,78 @@ import (
 	"github.com/gophercloud/gophercloud/v2/openstack"
 	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/volumes"
 	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/v2/openstack/identity/v3/tokens"
 	"github.com/gophercloud/gophercloud/v2/openstack/networking/v2/ports"
 	log "github.com/sirupsen/logrus"
 	"github.com/vexxhost/migratekit/cmd"
-	"github.com/vmware/govmomi/object"
-	"github.com/vmware/govmomi/vim25/mo"
-	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vexxhost/migratekit/internal/machine"
 )
 
-var ErrorVolumeNotFound = errors.New("volume not found")
+var (
+	ErrorVolumeNotFound = errors.New("volume not found")
+	ErrNoConfig         = errors.New("OpenStack configuration is required")
+)
 
 type ClientSet struct {
+	ProjectID    string
 	BlockStorage *gophercloud.ServiceClient
 	Compute      *gophercloud.ServiceClient
 	Networking   *gophercloud.ServiceClient
+
+	config *Config
+}
+
+// Config selects the projects the clients connect to and how the volumes of
+// a virtual machine are found in them.
+type Config struct {
+	// Client selects the destination project
+	Client ClientOptions
+
+	// ConversionClient selects the project of the conversion host, the
+	// destination project is used if it is nil
+	ConversionClient *ClientOptions
+
+	// VzUnsafeVolumeByName finds volumes by their name only, ignoring the
+	// metadata which ties them to the disk they were created for
+	VzUnsafeVolumeByName bool
 }
 
 type PortCreateOpts struct {
 	SecurityGroups *[]string
 }
 
-func NewClientSet(ctx context.Context) (*ClientSet, error) {
-	opts, err := openstack.AuthOptionsFromEnv()
+// NewClientSet returns the clients for the destination project, which owns
+// the migrated volumes and servers.
+func NewClientSet(ctx context.Context, config *Config) (*ClientSet, error) {
+	if config == nil {
+		return nil, ErrNoConfig
+	}
+
+	return newClientSet(ctx, config, &config.Client)
+}
+
+// NewConversionClientSet returns the clients for the project of the conversion
+// host, which the volumes are created in and attached to during migration
+// cycles.  It is the destination project unless configured otherwise.
+func NewConversionClientSet(ctx context.Context, config *Config) (*ClientSet, error) {
+	if config == nil {
+		return nil, ErrNoConfig
+	}
+
+	if config.ConversionClient == nil {
+		return NewClientSet(ctx, config)
+	}
+
+	return newClientSet(ctx, config, config.ConversionClient)
+}
+
+func newClientSet(ctx context.Context, c *Config, clientOptions *ClientOptions) (*ClientSet, error) {
+	config, err := clientOptions.load()
 	if err != nil {
 		return nil, err
 	}
 
-	provider, err := openstack.NewClient(opts.IdentityEndpoint)
+	provider, err := openstack.NewClient(config.AuthOptions.IdentityEndpoint)
 	if err != nil {
 		return nil, err
 	}
@@ -48,63 +92,65 @@ func NewClientSet(ctx context.Context) (*ClientSet, error) {
 	ua.Prepend("migratekit")
 	provider.UserAgent = ua
 
-	config := &tls.Config{
-		MinVersion: tls.VersionTLS12,
-	}
+	config.TLSConfig.MinVersion = tls.VersionTLS12
 
-	if os.Getenv("OS_INSECURE") == "true" {
-		config.InsecureSkipVerify = true
-	}
+	// Cloning the default transport keeps the proxy settings from the environment
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config.TLSConfig
+	provider.HTTPClient.Transport = transport
 
-	provider.HTTPClient.Transport = &http.Transport{
-		TLSClientConfig: config,
-	}
-
-	err = openstack.Authenticate(ctx, provider, opts)
+	err = openstack.Authenticate(ctx, provider, config.AuthOptions)
 	if err != nil {
 		return nil, err
 	}
 
-	blockStorageClient, err := openstack.NewBlockStorageV3(provider, gophercloud.EndpointOpts{
-		Region: os.Getenv("OS_REGION_NAME"),
-	})
+	provider.EndpointLocator = config.endpointLocator(provider.EndpointLocator)
+
+	var projectID string
+	if result, ok := provider.GetAuthResult().(tokens.CreateResult); ok {
+		project, err := result.ExtractProject()
+		if err != nil {
+			return nil, err
+		}
+
+		if project != nil {
+			projectID = project.ID
+		}
+	}
+
+	blockStorageClient, err := openstack.NewBlockStorageV3(provider, config.endpointOpts("block_storage"))
 	if err != nil {
 		return nil, err
 	}
 
-	computeClient, err := openstack.NewComputeV2(provider, gophercloud.EndpointOpts{
-		Region: os.Getenv("OS_REGION_NAME"),
-	})
+	computeClient, err := openstack.NewComputeV2(provider, config.endpointOpts("compute"))
 	if err != nil {
 		return nil, err
 	}
 
-	networkingClient, err := openstack.NewNetworkV2(provider, gophercloud.EndpointOpts{
-		Region: os.Getenv("OS_REGION_NAME"),
-	})
+	networkingClient, err := openstack.NewNetworkV2(provider, config.endpointOpts("network"))
 	if err != nil {
 		return nil, err
 	}
 
 	return &ClientSet{
+		ProjectID:    projectID,
 		BlockStorage: blockStorageClient,
 		Compute:      computeClient,
 		Networking:   networkingClient,
+		config:       c,
 	}, nil
 }
 
-func (c *ClientSet) GetVolumeForDisk(ctx context.Context, vm *object.VirtualMachine, disk *types.VirtualDisk) (*volumes.Volume, error) {
-
-	vzUnsafeVolumeByName := ctx.Value("vzUnsafeVolumeByName").(bool)
-
+func (c *ClientSet) GetVolumeForDisk(ctx context.Context, vm *machine.VirtualMachine, disk *machine.Disk) (*volumes.Volume, error) {
 	volumsListOpts := volumes.ListOpts{
 		Name: VolumeName(vm, disk),
 	}
 
-	if !vzUnsafeVolumeByName {
+	if !c.config.VzUnsafeVolumeByName {
 		volumsListOpts.Metadata = map[string]string{
 			"migrate_kit": "true",
-			"vm":          vm.Reference().Value,
+			"vm":          vm.ID,
 			"disk":        strconv.Itoa(int(disk.Key)),
 		}
 	}
@@ -121,7 +167,7 @@ func (c *ClientSet) GetVolumeForDisk(ctx context.Context, vm *object.VirtualMach
 
 	// Deprecated, ensuring backward compatibility
 	// TODO: remove
-	if len(volumeList) == 0 {
+	if len(volumeList) == 0 && disk.ObjectID != "" {
 		volumeList, err = c.GetVolumeListForDiskOld(ctx, vm, disk)
 		if err != nil {
 			return nil, err
@@ -142,13 +188,13 @@ func (c *ClientSet) GetVolumeForDisk(ctx context.Context, vm *object.VirtualMach
 
 // Deprecated, ensuring backward compatibility
 // TODO: remove
-func (c *ClientSet) GetVolumeListForDiskOld(ctx context.Context, vm *object.VirtualMachine, disk *types.VirtualDisk) ([]volumes.Volume, error) {
+func (c *ClientSet) GetVolumeListForDiskOld(ctx context.Context, vm *machine.VirtualMachine, disk *machine.Disk) ([]volumes.Volume, error) {
 	pages, err := volumes.List(c.BlockStorage, volumes.ListOpts{
 		Name: VolumeNameOld(vm, disk),
 		Metadata: map[string]string{
 			"migrate_kit": "true",
-			"vm":          vm.Reference().Value,
-			"disk":        disk.DiskObjectId,
+			"vm":          vm.ID,
+			"disk":        disk.ObjectID,
 		},
 	}).AllPages(ctx)
 	if err != nil {
@@ -160,18 +206,9 @@ func (c *ClientSet) GetVolumeListForDiskOld(ctx context.Context, vm *object.Virt
 	return volumeList, err
 }
 
-func (c *ClientSet) EnsurePortsForVirtualMachine(ctx context.Context, vm *object.VirtualMachine, networkMappings *cmd.NetworkMappingFlag) ([]servers.Network, error) {
-	devices, err := vm.Device(context.Background())
-	if err != nil {
-		return nil, err
-	}
-
+func (c *ClientSet) EnsurePortsForVirtualMachine(ctx context.Context, vm *machine.VirtualMachine, networkMappings *cmd.NetworkMappingFlag, portOpts *PortCreateOpts) ([]servers.Network, error) {
 	var networks []servers.Network
-	nics := devices.SelectByType((*types.VirtualEthernetCard)(nil))
-
-	for _, nic := range nics {
-		card := nic.(types.BaseVirtualEthernetCard).GetVirtualEthernetCard()
-
+	for _, card := range vm.NICs {
 		mapping, ok := networkMappings.Mappings[card.MacAddress]
 		if !ok {
 			return nil, errors.New("no network mapping found for MAC address")
@@ -208,14 +245,13 @@ func (c *ClientSet) EnsurePortsForVirtualMachine(ctx context.Context, vm *object
 				}
 			}
 
-			opts := ctx.Value("portCreateOpts").(*PortCreateOpts)
 			port, err = ports.Create(ctx, c.Networking, ports.CreateOpts{
 				NetworkID:      mapping.NetworkID.String(),
-				Name:           card.DeviceInfo.GetDescription().Label,
-				Description:    card.DeviceInfo.GetDescription().Summary,
+				Name:           card.Label,
+				Description:    card.Summary,
 				MACAddress:     card.MacAddress,
 				FixedIPs:       ips,
-				SecurityGroups: opts.SecurityGroups,
+				SecurityGroups: portOpts.SecurityGroups,
 			}).Extract()
 			if err != nil {
 				return nil, err
@@ -242,24 +278,11 @@ func (c *ClientSet) EnsurePortsForVirtualMachine(ctx context.Context, vm *object
 	return networks, nil
 }
 
-func (c *ClientSet) CreateResourcesForVirtualMachine(ctx context.Context, vm *object.VirtualMachine, flavor string, networks []servers.Network, availabilityZone string) error {
-	var o mo.VirtualMachine
-	err := vm.Properties(ctx, vm.Reference(), []string{"config"}, &o)
-	if err != nil {
-		return err
-	}
-
-	devices, err := vm.Device(context.Background())
-	if err != nil {
-		return err
-	}
-
+func (c *ClientSet) CreateResourcesForVirtualMachine(ctx context.Context, vm *machine.VirtualMachine, flavor string, networks []servers.Network, availabilityZone string) error {
 	var blockDevices []servers.BlockDevice
-	disks := devices.SelectByType((*types.VirtualDisk)(nil))
 	diskIndex := 0
-	for _, disk := range disks {
-		vd := disk.(*types.VirtualDisk)
-		volume, err := c.GetVolumeForDisk(ctx, vm, vd)
+	for _, disk := range vm.Disks {
+		volume, err := c.GetVolumeForDisk(ctx, vm, disk)
 		if err != nil {
 			return err
 		}
@@ -274,7 +297,7 @@ func (c *ClientSet) CreateResourcesForVirtualMachine(ctx context.Context, vm *ob
 	}
 
 	server, err := servers.Create(ctx, c.Compute, servers.CreateOpts{
-		Name:             o.Config.Name,
+		Name:             vm.Name,
 		FlavorRef:        flavor,
 		Networks:         networks,
 		BlockDevice:      blockDevices,
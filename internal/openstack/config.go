@@ -0,0 +1,269 @@
+package openstack
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack"
+	"github.com/gophercloud/gophercloud/v2/openstack/config/clouds"
+	"gopkg.in/yaml.v2"
+)
+
+// ClientOptions selects the cloud to connect to, the credentials are read
+// from the OS_* environment variables unless a cloud from clouds.yaml is used.
+type ClientOptions struct {
+	Cloud string
+}
+
+// Service names as used in clouds.yaml keys (e.g. block_storage_region_name)
+// mapped to the service type used to look them up in the catalog.
+var services = map[string]string{
+	"block_storage": "block-storage",
+	"compute":       "compute",
+	"network":       "network",
+}
+
+// Alternative names for the services which are accepted in clouds.yaml keys
+var serviceAliases = map[string][]string{
+	"block_storage": {"volume"},
+}
+
+// ServiceOptions overrides how the endpoint of a single service is found.
+type ServiceOptions struct {
+	Region    string
+	Interface string
+	Endpoint  string
+}
+
+type cloudConfig struct {
+	AuthOptions  gophercloud.AuthOptions
+	EndpointOpts gophercloud.EndpointOpts
+	TLSConfig    *tls.Config
+	Services     map[string]ServiceOptions
+}
+
+func (o *ClientOptions) load() (*cloudConfig, error) {
+	cloud := o.Cloud
+	if cloud == "" {
+		cloud = os.Getenv("OS_CLOUD")
+	}
+
+	if cloud == "" {
+		return loadFromEnv()
+	}
+
+	return loadFromCloudsYAML(cloud)
+}
+
+func loadFromEnv() (*cloudConfig, error) {
+	authOptions, err := openstack.AuthOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := tlsConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &cloudConfig{
+		AuthOptions: authOptions,
+		EndpointOpts: gophercloud.EndpointOpts{
+			Region:       os.Getenv("OS_REGION_NAME"),
+			Availability: availability(os.Getenv("OS_INTERFACE")),
+		},
+		TLSConfig: tlsConfig,
+		Services:  map[string]ServiceOptions{},
+	}
+
+	for name := range services {
+		config.Services[name] = serviceOptions(name, func(key string) string {
+			return os.Getenv("OS_" + strings.ToUpper(key))
+		})
+	}
+
+	return config, nil
+}
+
+func tlsConfigFromEnv() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: os.Getenv("OS_INSECURE") == "true",
+	}
+
+	if caCert := os.Getenv("OS_CACERT"); caCert != "" {
+		pem, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle: %s", caCert)
+		}
+
+		config.RootCAs = pool
+	}
+
+	cert, key := os.Getenv("OS_CERT"), os.Getenv("OS_KEY")
+	if (cert == "") != (key == "") {
+		return nil, errors.New("both OS_CERT and OS_KEY must be set to use a client certificate")
+	}
+
+	if cert != "" {
+		certificate, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// cloudsYAMLLocations returns the same search path used by gophercloud and
+// the OpenStack client.
+func cloudsYAMLLocations() ([]string, error) {
+	if path := os.Getenv("OS_CLIENT_CONFIG_FILE"); path != "" {
+		return []string{path}, nil
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	userConfig, err := os.UserConfigDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{
+		filepath.Join(cwd, "clouds.yaml"),
+		filepath.Join(userConfig, "openstack", "clouds.yaml"),
+		"/etc/openstack/clouds.yaml",
+	}, nil
+}
+
+func loadFromCloudsYAML(cloud string) (*cloudConfig, error) {
+	locations, err := cloudsYAMLLocations()
+	if err != nil {
+		return nil, err
+	}
+
+	var path string
+	for _, location := range locations {
+		if _, err := os.Stat(location); err == nil {
+			path = location
+			break
+		}
+	}
+
+	if path == "" {
+		return nil, fmt.Errorf("clouds.yaml not found, search locations were: %s", strings.Join(locations, ", "))
+	}
+
+	authOptions, endpointOpts, tlsConfig, err := clouds.Parse(
+		clouds.WithCloudName(cloud),
+		clouds.WithLocations(path),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// The per service settings are not part of the parsed cloud, so they
+	// are read from the raw file instead.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw struct {
+		Clouds map[string]map[string]interface{} `yaml:"clouds"`
+	}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	config := &cloudConfig{
+		AuthOptions:  authOptions,
+		EndpointOpts: endpointOpts,
+		TLSConfig:    tlsConfig,
+		Services:     map[string]ServiceOptions{},
+	}
+
+	for name := range services {
+		config.Services[name] = serviceOptions(name, func(key string) string {
+			value, _ := raw.Clouds[cloud][key].(string)
+			return value
+		})
+	}
+
+	return config, nil
+}
+
+func serviceOptions(service string, lookup func(key string) string) ServiceOptions {
+	get := func(key string) string {
+		for _, name := range append([]string{service}, serviceAliases[service]...) {
+			if value := lookup(name + "_" + key); value != "" {
+				return value
+			}
+		}
+
+		return ""
+	}
+
+	return ServiceOptions{
+		Region:    get("region_name"),
+		Interface: get("interface"),
+		Endpoint:  get("endpoint_override"),
+	}
+}
+
+func availability(endpointInterface string) gophercloud.Availability {
+	switch strings.TrimSuffix(strings.ToLower(endpointInterface), "url") {
+	case "internal":
+		return gophercloud.AvailabilityInternal
+	case "admin":
+		return gophercloud.AvailabilityAdmin
+	default:
+		return gophercloud.AvailabilityPublic
+	}
+}
+
+// endpointOpts applies the service specific region and interface on top of
+// the ones of the cloud.
+func (c *cloudConfig) endpointOpts(service string) gophercloud.EndpointOpts {
+	opts := c.EndpointOpts
+	override := c.Services[service]
+
+	if override.Region != "" {
+		opts.Region = override.Region
+	}
+
+	if override.Interface != "" {
+		opts.Availability = availability(override.Interface)
+	}
+
+	return opts
+}
+
+// endpointLocator wraps the catalog lookup to return the endpoint overrides
+// of the services.
+func (c *cloudConfig) endpointLocator(locator gophercloud.EndpointLocator) gophercloud.EndpointLocator {
+	return func(opts gophercloud.EndpointOpts) (string, error) {
+		for name, serviceType := range services {
+			if opts.Type == serviceType && c.Services[name].Endpoint != "" {
+				return gophercloud.NormalizeURL(c.Services[name].Endpoint), nil
+			}
+		}
+
+		return locator(opts)
+	}
+}
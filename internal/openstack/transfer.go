@@ -0,0 +1,70 @@
+package openstack
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/transfers"
+	log "github.com/sirupsen/logrus"
+	"github.com/vexxhost/migratekit/internal/machine"
+)
+
+// HasTransferredVolumesForVirtualMachine returns true if any disk of the
+// virtual machine has a volume in the project of the clients.  Volumes are only
+// transferred once their final cycle has completed, so a transfer which was
+// interrupted part way through is resumed rather than migrated again.
+func (c *ClientSet) HasTransferredVolumesForVirtualMachine(ctx context.Context, vm *machine.VirtualMachine) (bool, error) {
+	for _, disk := range vm.Disks {
+		_, err := c.GetVolumeForDisk(ctx, vm, disk)
+		if errors.Is(err, ErrorVolumeNotFound) {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// TransferVolumesForVirtualMachine transfers the volumes of the virtual machine
+// to the project of the destination clients, volumes which were already
+// transferred are skipped.
+func (c *ClientSet) TransferVolumesForVirtualMachine(ctx context.Context, vm *machine.VirtualMachine, destination *ClientSet) error {
+	for _, disk := range vm.Disks {
+		volume, err := c.GetVolumeForDisk(ctx, vm, disk)
+		if errors.Is(err, ErrorVolumeNotFound) {
+			_, err := destination.GetVolumeForDisk(ctx, vm, disk)
+			if err != nil {
+				return err
+			}
+
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		transfer, err := transfers.Create(ctx, c.BlockStorage, transfers.CreateOpts{
+			VolumeID: volume.ID,
+			Name:     volume.Name,
+		}).Extract()
+		if err != nil {
+			return err
+		}
+
+		_, err = transfers.Accept(ctx, destination.BlockStorage, transfer.ID, transfers.AcceptOpts{
+			AuthKey: transfer.AuthKey,
+		}).Extract()
+		if err != nil {
+			return errors.Join(err, transfers.Delete(ctx, c.BlockStorage, transfer.ID).ExtractErr())
+		}
+
+		log.WithFields(log.Fields{
+			"volume_id":  volume.ID,
+			"project_id": destination.ProjectID,
+		}).Info("Volume transferred")
+	}
+
+	return nil
+}
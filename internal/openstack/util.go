@@ -4,11 +4,9 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
-	"strconv"
 
 	"github.com/gosimple/slug"
-	"github.com/vmware/govmomi/object"
-	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vexxhost/migratekit/internal/machine"
 )
 
 type OpenStackMetadata struct {
@@ -41,12 +39,12 @@ func GetCurrentInstanceUUID() (string, error) {
 	return metadata.UUID, nil
 }
 
-func VolumeName(vm *object.VirtualMachine, disk *types.VirtualDisk) string {
-	return slug.Make(vm.Name() + "-" + strconv.Itoa(int(disk.Key)))
+func VolumeName(vm *machine.VirtualMachine, disk *machine.Disk) string {
+	return vm.DiskLabel(disk)
 }
 
 // ensuring backward compatibility
 // TODO: remove
-func VolumeNameOld(vm *object.VirtualMachine, disk *types.VirtualDisk) string {
-	return slug.Make(vm.Name() + "-" + string(disk.DiskObjectId))
+func VolumeNameOld(vm *machine.VirtualMachine, disk *machine.Disk) string {
+	return slug.Make(vm.Name + "-" + disk.ObjectID)
 }
@@ -3,6 +3,7 @@ package progress
 import (
 	"fmt"
 	"os"
+	"sync/atomic"
 
 	"github.com/k0kubun/go-ansi"
 	"github.com/schollz/progressbar/v3"
@@ -17,13 +18,34 @@ var theme = progressbar.Theme{
 	BarEnd:        "]",
 }
 
-func DataProgressBar(desc string, size int64) *progressbar.ProgressBar {
-	return progressbar.NewOptions64(size,
+// hidden counts the callers of Hide which have not restored the bars yet
+var hidden atomic.Int32
+
+// Hide hides the progress bars created until restore is called, such as
+// while several virtual machines are migrated at the same time and their bars
+// would overwrite each other.
+func Hide() (restore func()) {
+	hidden.Add(1)
+	return func() { hidden.Add(-1) }
+}
+
+// visibility returns the options which show a bar unless bars are hidden
+func visibility() []progressbar.Option {
+	if hidden.Load() > 0 {
+		return []progressbar.Option{progressbar.OptionSetVisibility(false)}
+	}
+
+	return []progressbar.Option{
 		progressbar.OptionSetWriter(ansi.NewAnsiStdout()),
 		progressbar.OptionUseANSICodes(true),
 		progressbar.OptionOnCompletion(func() {
 			fmt.Fprint(os.Stderr, "\n")
 		}),
+	}
+}
+
+func DataProgressBar(desc string, size int64) *progressbar.ProgressBar {
+	return progressbar.NewOptions64(size, append(visibility(),
 		progressbar.OptionEnableColorCodes(true),
 		progressbar.OptionShowBytes(true),
 		progressbar.OptionShowCount(),
@@ -31,22 +53,17 @@ func DataProgressBar(desc string, size int64) *progressbar.ProgressBar {
 		progressbar.OptionFullWidth(),
 		progressbar.OptionSetDescription(desc),
 		progressbar.OptionSetTheme(theme),
-	)
+	)...)
 }
 
 func PercentageProgressBar(task string) *progressbar.ProgressBar {
-	return progressbar.NewOptions64(100,
-		progressbar.OptionSetWriter(ansi.NewAnsiStdout()),
-		progressbar.OptionUseANSICodes(true),
-		progressbar.OptionOnCompletion(func() {
-			fmt.Fprint(os.Stderr, "\n")
-		}),
+	return progressbar.NewOptions64(100, append(visibility(),
 		progressbar.OptionEnableColorCodes(true),
 		progressbar.OptionShowCount(),
 		progressbar.OptionFullWidth(),
 		progressbar.OptionSetDescription(task),
 		progressbar.OptionSetTheme(theme),
-	)
+	)...)
 }
 
 type VMwareProgressBar struct {
@@ -0,0 +1,73 @@
+package secret
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var ErrNotFound = errors.New("secret not found")
+
+// Source describes where a secret can be loaded from, the first one which is
+// set is used in the following order: value, file, command and environment
+// variable.
+type Source struct {
+	Name    string
+	Value   string
+	File    string
+	Command string
+	Env     string
+}
+
+func (s *Source) Resolve(ctx context.Context) (string, error) {
+	switch {
+	case s.Value != "":
+		return s.Value, nil
+	case s.File != "":
+		data, err := os.ReadFile(s.File)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s from file: %w", s.Name, err)
+		}
+
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case s.Command != "":
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", s.Command)
+		cmd.Stderr = os.Stderr
+
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("failed to run command for %s: %w", s.Name, err)
+		}
+
+		return strings.TrimRight(string(output), "\r\n"), nil
+	}
+
+	if value := os.Getenv(s.Env); s.Env != "" && value != "" {
+		return value, nil
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrNotFound, s.Name)
+}
+
+// RedactArgs returns a copy of the command line arguments with the values of
+// all password and cookie parameters replaced, unless they reference a file
+// or stdin.
+func RedactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+
+	for i, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		key = strings.ToLower(key)
+		sensitive := strings.HasSuffix(key, "password") || strings.HasSuffix(key, "cookie")
+		if ok && sensitive && !strings.HasPrefix(value, "+") && value != "-" {
+			arg = key + "=***"
+		}
+
+		redacted[i] = arg
+	}
+
+	return redacted
+}
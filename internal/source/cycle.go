@@ -0,0 +1,233 @@
+package source
+
+import (
+	"context"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vexxhost/migratekit/internal/cleanup"
+	"github.com/vexxhost/migratekit/internal/machine"
+	"github.com/vexxhost/migratekit/internal/metrics"
+	"github.com/vexxhost/migratekit/internal/nbdcopy"
+	"github.com/vexxhost/migratekit/internal/nbdkit"
+	"github.com/vexxhost/migratekit/internal/target"
+	"github.com/vexxhost/migratekit/internal/v2v"
+)
+
+// MigrationCycle copies every disk of the source to its volume and runs
+// virt-v2v-in-place against the first one.  Only the changed areas of a disk
+// are copied if the source knows what changed since the change ID recorded on
+// its volume, the disk is copied entirely otherwise.
+func MigrationCycle(ctx context.Context, config *target.Config, src Source, runV2V bool, debug bool) (err error) {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	vm := src.VirtualMachine()
+
+	var stack cleanup.Stack
+	defer func() {
+		if ctx.Err() != nil {
+			log.Warn("Migration cycle interrupted, cleaning up")
+		}
+
+		err = errors.Join(err, stack.Run(ctx))
+	}()
+
+	for index, disk := range vm.Disks {
+		logger := log.WithFields(log.Fields{
+			"vm":   vm.Name,
+			"disk": vm.DiskLabel(disk),
+		})
+
+		d, err := src.Disk(ctx, disk)
+		if err != nil {
+			return err
+		}
+
+		server, err := nbdkit.NewNbdkitBuilder().
+			Source(d.Source).
+			Build()
+		if err != nil {
+			return err
+		}
+
+		if err := server.Start(); err != nil {
+			return metrics.Failure(vm.Name, metrics.PhaseNbdkitStart, err)
+		}
+
+		stop := stack.Push("stop nbdkit server", func(ctx context.Context) error {
+			return server.Stop()
+		})
+
+		t, err := target.NewOpenStack(ctx, config, vm, disk)
+		if err != nil {
+			return err
+		}
+
+		areas, incremental, targetIsClean, err := changedAreas(ctx, t, d)
+		if err != nil {
+			return err
+		}
+
+		// Pushed before connecting so that a partially attached volume is
+		// detached as well
+		disconnect := stack.Push("detach volume", t.Disconnect)
+
+		err = t.Connect(ctx)
+		if err != nil {
+			return metrics.Failure(vm.Name, metrics.PhaseTargetConnect, err)
+		}
+
+		path, err := t.GetPath(ctx)
+		if err != nil {
+			return err
+		}
+
+		if incremental {
+			logger.Info("Starting incremental copy")
+
+			err = incrementalCopy(ctx, vm, disk, server, path, areas)
+			if err != nil {
+				return metrics.Failure(vm.Name, metrics.PhaseIncrementalCopy, err)
+			}
+
+			logger.Info("Incremental copy completed")
+		} else {
+			logger.Info("Starting full copy")
+
+			err = fullCopy(ctx, vm, disk, server, path, targetIsClean)
+			if err != nil {
+				return metrics.Failure(vm.Name, metrics.PhaseFullCopy, err)
+			}
+
+			logger.Info("Full copy completed")
+		}
+
+		changeID := disk.ChangeID
+		if runV2V && index == 0 {
+			log.Info("Running virt-v2v-in-place")
+
+			err = v2v.InPlace(ctx, path, debug)
+			if err != nil {
+				return metrics.Failure(vm.Name, metrics.PhaseV2V, err)
+			}
+
+			// The converted disk no longer matches the source
+			changeID = ""
+		}
+
+		err = t.WriteChangeID(ctx, changeID)
+		if err != nil {
+			return metrics.Failure(vm.Name, metrics.PhaseChangeID, err)
+		}
+
+		if d.Copied != nil {
+			if err := d.Copied(ctx, changeID); err != nil {
+				return err
+			}
+		}
+
+		if err := errors.Join(disconnect(ctx), stop(ctx)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// changedAreas returns the areas of a disk which changed since it was last
+// copied to the target, incremental is false if it needs a full copy.
+func changedAreas(ctx context.Context, t target.Target, d *Disk) (areas []Extent, incremental bool, targetIsClean bool, err error) {
+	exists, err := t.Exists(ctx)
+	if err != nil {
+		return nil, false, false, err
+	}
+
+	if !exists {
+		log.Info("Data does not exist, full copy needed")
+
+		return nil, false, true, nil
+	}
+
+	if d.ChangedAreas == nil {
+		log.Info("Source does not track changes, full copy needed")
+
+		return nil, false, false, nil
+	}
+
+	currentChangeId, err := t.GetCurrentChangeID(ctx)
+	if err != nil {
+		return nil, false, false, err
+	}
+
+	if currentChangeId == "" {
+		log.Info("No change ID found, assuming full copy is needed")
+
+		return nil, false, false, nil
+	}
+
+	areas, incremental, err = d.ChangedAreas(ctx, currentChangeId)
+	return areas, incremental, false, err
+}
+
+func openCopy(vm *machine.VirtualMachine, disk *machine.Disk, server *nbdkit.NbdkitServer, path string, description string) (*nbdcopy.Copy, error) {
+	return nbdcopy.Open(server.LibNBDExportName(), path, &nbdcopy.Options{
+		Description:    description,
+		Size:           disk.CapacityInBytes,
+		VirtualMachine: vm.Name,
+		Disk:           vm.DiskLabel(disk),
+	})
+}
+
+// fullCopy copies a disk to the target device, the unallocated areas of the
+// disk are skipped if the target is known to be clean.
+func fullCopy(ctx context.Context, vm *machine.VirtualMachine, disk *machine.Disk, server *nbdkit.NbdkitServer, path string, targetIsClean bool) error {
+	c, err := openCopy(vm, disk, server, path, "Full copy")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	err = c.CopyRange(ctx, 0, disk.CapacityInBytes, targetIsClean)
+	if err != nil {
+		return err
+	}
+
+	return c.Sync()
+}
+
+// incrementalCopy copies the changed areas of a disk to the target device
+func incrementalCopy(ctx context.Context, vm *machine.VirtualMachine, disk *machine.Disk, server *nbdkit.NbdkitServer, path string, areas []Extent) error {
+	c, err := openCopy(vm, disk, server, path, "Incremental copy")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	changedAreaBytes := metrics.ChangedAreaBytes.WithLabelValues(vm.Name, vm.DiskLabel(disk))
+	changedAreas := metrics.ChangedAreas.WithLabelValues(vm.Name, vm.DiskLabel(disk))
+
+	for _, area := range areas {
+		if area.Start >= disk.CapacityInBytes {
+			break
+		}
+
+		length := min(area.Length, disk.CapacityInBytes-area.Start)
+
+		changedAreas.Inc()
+		changedAreaBytes.Add(float64(length))
+
+		err = c.CopyRange(ctx, area.Start, length, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.SetProgress(disk.CapacityInBytes)
+	if err != nil {
+		return err
+	}
+
+	return c.Sync()
+}
@@ -0,0 +1,320 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vexxhost/migratekit/internal/machine"
+	"github.com/vexxhost/migratekit/internal/nbdkit"
+	"libguestfs.org/libnbd"
+)
+
+// changeIDPrefix marks the change IDs of disk images, which name the dirty
+// bitmap that records the writes made to the image since it was copied.
+const changeIDPrefix = "dirty-bitmap/"
+
+// bitmapPrefix names the dirty bitmaps added by migratekit, which are the only
+// ones it removes.
+const bitmapPrefix = "migratekit-"
+
+// Image is a disk image read with qemu, the format is never probed since a
+// raw image could pass for any other format.
+type Image struct {
+	Path   string
+	Format string
+
+	// Offset and Size locate the image inside of the file if Size is set,
+	// such as a disk stored in an OVA which is a tar archive
+	Offset int64
+	Size   int64
+}
+
+func (i *Image) qemuSource() *nbdkit.QemuSource {
+	return &nbdkit.QemuSource{
+		Path:   i.Path,
+		Format: i.Format,
+		Offset: i.Offset,
+		Size:   i.Size,
+	}
+}
+
+type ImageInfo struct {
+	VirtualSize    int64 `json:"virtual-size"`
+	FormatSpecific struct {
+		Data struct {
+			Bitmaps []Bitmap `json:"bitmaps"`
+		} `json:"data"`
+	} `json:"format-specific"`
+}
+
+type Bitmap struct {
+	Name  string   `json:"name"`
+	Flags []string `json:"flags"`
+}
+
+// Enabled returns true if the bitmap records every write to the image, the
+// "in-use" flag is set if the image was not closed cleanly in which case the
+// bitmap can not be trusted.
+func (b *Bitmap) Enabled() bool {
+	return slices.Contains(b.Flags, "auto") && !slices.Contains(b.Flags, "in-use")
+}
+
+// Inspect runs qemu-img info against the image.  The image is opened with
+// --force-share so that an image in use by a running virtual machine can be
+// inspected as well, although its metadata may then be out of date and its
+// bitmaps are marked in use.
+func (i *Image) Inspect(ctx context.Context) (*ImageInfo, error) {
+	args := append([]string{"info", "--output=json", "--force-share"}, i.qemuSource().ImageArgs()...)
+	out, err := i.qemuImg(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var info ImageInfo
+	if err := json.Unmarshal(out, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// ChangeID returns the change ID of the image, which names its first enabled
+// dirty bitmap.  It is empty if the image has none, as only qcow2 images
+// carry bitmaps.
+func (i *Image) ChangeID(info *ImageInfo) string {
+	for _, bitmap := range info.FormatSpecific.Data.Bitmaps {
+		if bitmap.Enabled() {
+			return changeIDPrefix + bitmap.Name
+		}
+	}
+
+	return ""
+}
+
+// qemuImg runs qemu-img and returns its output
+func (i *Image) qemuImg(ctx context.Context, args ...string) ([]byte, error) {
+	out, err := exec.CommandContext(ctx, "qemu-img", args...).Output()
+	if exitErr := (*exec.ExitError)(nil); errors.As(err, &exitErr) {
+		return nil, fmt.Errorf("failed to run qemu-img %s on %s: %s", args[0], i.Path, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+
+	return out, err
+}
+
+// bitmap runs a qemu-img bitmap operation, which needs the image not to be in
+// use.
+func (i *Image) bitmap(ctx context.Context, operation string, name string) error {
+	args := append([]string{"bitmap", operation}, i.qemuSource().ImageArgs()...)
+	_, err := i.qemuImg(ctx, append(args, name)...)
+	return err
+}
+
+// Disk reads the image through nbdkit, the changes are read from the dirty
+// bitmap named by the change ID.  If the image tracks changes, a new bitmap is
+// added to it which becomes the change ID of the disk, so that the next cycle
+// only copies the writes made after this one.
+func (i *Image) Disk(ctx context.Context, disk *machine.Disk) (*Disk, error) {
+	d := &Disk{
+		Source:       i.qemuSource(),
+		ChangedAreas: i.changedAreas,
+	}
+
+	if disk.ChangeID == "" {
+		return d, nil
+	}
+
+	name := bitmapPrefix + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := i.bitmap(ctx, "--add", name); err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"image":  i.Path,
+		"bitmap": name,
+	}).Info("Added dirty bitmap")
+
+	disk.ChangeID = changeIDPrefix + name
+	d.Copied = i.removeBitmaps
+	return d, nil
+}
+
+// removeBitmaps removes the bitmaps added by earlier cycles once the change ID
+// of this one was recorded, along with the ones of cycles which failed.
+func (i *Image) removeBitmaps(ctx context.Context, changeID string) error {
+	info, err := i.Inspect(ctx)
+	if err != nil {
+		return err
+	}
+
+	current, _ := strings.CutPrefix(changeID, changeIDPrefix)
+	for _, bitmap := range info.FormatSpecific.Data.Bitmaps {
+		if !strings.HasPrefix(bitmap.Name, bitmapPrefix) || bitmap.Name == current {
+			continue
+		}
+
+		if err := i.bitmap(ctx, "--remove", bitmap.Name); err != nil {
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"image":  i.Path,
+			"bitmap": bitmap.Name,
+		}).Info("Removed dirty bitmap")
+	}
+
+	return nil
+}
+
+// changedAreas returns the areas of the image marked dirty in the bitmap of a
+// change ID.  A bitmap records the writes since it was created, so it holds
+// every change since the copy as long as it stayed enabled in between.
+func (i *Image) changedAreas(ctx context.Context, changeID string) ([]Extent, bool, error) {
+	name, ok := strings.CutPrefix(changeID, changeIDPrefix)
+	if !ok {
+		return nil, false, nil
+	}
+
+	info, err := i.Inspect(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	index := slices.IndexFunc(info.FormatSpecific.Data.Bitmaps, func(b Bitmap) bool {
+		return b.Name == name
+	})
+	if index == -1 || !info.FormatSpecific.Data.Bitmaps[index].Enabled() {
+		log.WithFields(log.Fields{
+			"image":  i.Path,
+			"bitmap": name,
+		}).Warn("Dirty bitmap is gone or disabled, full copy needed")
+
+		return nil, false, nil
+	}
+
+	areas, err := i.dirtyAreas(ctx, name, info.VirtualSize)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return areas, true, nil
+}
+
+// dirtyAreas reads a dirty bitmap of the image from qemu-nbd, which is run
+// directly since nbdkit only passes the allocation of the image through.
+func (i *Image) dirtyAreas(ctx context.Context, bitmap string, size int64) ([]Extent, error) {
+	dir, err := os.MkdirTemp("", "migratekit-bitmap-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "nbd.sock")
+	pidFile := filepath.Join(dir, "qemu-nbd.pid")
+
+	// qemu-nbd forks once it is listening and exits when the client
+	// disconnects
+	args := []string{
+		"--read-only",
+		"--fork",
+		"--bitmap=" + bitmap,
+		"--socket=" + socket,
+		"--pid-file=" + pidFile,
+	}
+
+	cmd := exec.CommandContext(ctx, "qemu-nbd", append(args, i.qemuSource().ImageArgs()...)...)
+	cmd.Stderr = os.Stderr
+
+	log.Debug("Running command: ", strings.Join(cmd.Args, " "))
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to start qemu-nbd: %w", err)
+	}
+
+	handle, err := libnbd.Create()
+	if err != nil {
+		stopQemuNbd(pidFile)
+		return nil, err
+	}
+	defer handle.Close()
+
+	metaContext := "qemu:dirty-bitmap:" + bitmap
+	if err := handle.AddMetaContext(metaContext); err != nil {
+		stopQemuNbd(pidFile)
+		return nil, err
+	}
+
+	if err := handle.ConnectUri(fmt.Sprintf("nbd+unix:///?socket=%s", socket)); err != nil {
+		stopQemuNbd(pidFile)
+		return nil, err
+	}
+
+	var areas []Extent
+	for offset := int64(0); offset < size; {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		next := offset
+		err := handle.BlockStatus(uint64(min(size-offset, 1<<30)), uint64(offset), func(metacontext string, extentOffset uint64, entries []uint32, _ *int) int {
+			if metacontext != metaContext {
+				return 0
+			}
+
+			position := int64(extentOffset)
+			for i := 0; i+1 < len(entries) && position < size; i += 2 {
+				length := min(int64(entries[i]), size-position)
+
+				// Bit 0 of the flags is set for dirty extents
+				if entries[i+1]&1 != 0 {
+					if n := len(areas); n > 0 && areas[n-1].Start+areas[n-1].Length == position {
+						areas[n-1].Length += length
+					} else {
+						areas = append(areas, Extent{Start: position, Length: length})
+					}
+				}
+
+				position += length
+			}
+
+			next = position
+			return 0
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if next <= offset {
+			return nil, errors.New("qemu-nbd returned no extents")
+		}
+
+		offset = next
+	}
+
+	return areas, nil
+}
+
+// stopQemuNbd stops a qemu-nbd server which no client connected to
+func stopQemuNbd(pidFile string) {
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		return
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return
+	}
+
+	if process, err := os.FindProcess(pid); err == nil {
+		process.Kill()
+	}
+}
@@ -0,0 +1,43 @@
+// Package source migrates virtual machines whose disks are read from images
+// on this host, such as Hyper-V VHDX or KVM qcow2 and raw images, reusing the
+// targets and the conversion used for VMware.
+package source
+
+import (
+	"context"
+
+	"github.com/vexxhost/migratekit/internal/machine"
+	"github.com/vexxhost/migratekit/internal/nbdkit"
+)
+
+// Source is a virtual machine which is not migrated from VMware
+type Source interface {
+	// VirtualMachine describes the hardware of the virtual machine, the boot
+	// disk is its first disk and the change IDs of the disks identify their
+	// current contents
+	VirtualMachine() *machine.VirtualMachine
+
+	// Disk returns how a disk is read during a migration cycle
+	Disk(ctx context.Context, disk *machine.Disk) (*Disk, error)
+}
+
+type Disk struct {
+	// Source serves the contents of the disk
+	Source nbdkit.Source
+
+	// ChangedAreas returns the areas which changed since the change ID
+	// recorded by an earlier migration cycle, ok is false if the changes are
+	// unknown in which case a full copy is needed.  It is nil if the source
+	// does not track changes.
+	ChangedAreas func(ctx context.Context, changeID string) (areas []Extent, ok bool, err error)
+
+	// Copied is called once the disk was copied and the change ID was
+	// recorded on its target, it may be nil
+	Copied func(ctx context.Context, changeID string) error
+}
+
+// Extent is a range of a disk
+type Extent struct {
+	Start  int64
+	Length int64
+}
@@ -0,0 +1,254 @@
+package target
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/volumes"
+	log "github.com/sirupsen/logrus"
+	"github.com/vexxhost/migratekit/internal/connector"
+)
+
+const (
+	// AttachModeNova attaches volumes to the instance migratekit runs in
+	AttachModeNova = "nova"
+	// AttachModeCinder connects volumes to this host using the connection
+	// info from Cinder, which does not require running inside an instance
+	AttachModeCinder = "cinder"
+)
+
+type AttachOpts struct {
+	Mode        string
+	ConnectorIP string
+}
+
+func (t *OpenStack) connectorProperties(ctx context.Context) (*connector.Properties, error) {
+	endpoint, err := url.Parse(t.ClientSet.BlockStorage.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	port := endpoint.Port()
+	if port == "" {
+		port = "443"
+		if endpoint.Scheme == "http" {
+			port = "80"
+		}
+	}
+
+	return connector.LocalProperties(t.Config.Attach.ConnectorIP, net.JoinHostPort(endpoint.Hostname(), port))
+}
+
+// initializeConnection exports the volume to this host, device is the block
+// device of a connection which a previous run did not disconnect.
+func (t *OpenStack) initializeConnection(ctx context.Context, volume *volumes.Volume, properties *connector.Properties, device string) (connector.Connection, error) {
+	multipath := false
+
+	info, err := volumes.InitializeConnection(ctx, t.ClientSet.BlockStorage, volume.ID, volumes.InitializeConnectionOpts{
+		IP:        properties.IP,
+		Host:      properties.Host,
+		Initiator: properties.Initiator,
+		Multipath: &multipath,
+	}).Extract()
+	if err != nil {
+		return nil, err
+	}
+
+	if device != "" {
+		return connector.Resume(info, device)
+	}
+
+	return connector.New(info)
+}
+
+func (t *OpenStack) terminateConnection(ctx context.Context, volume *volumes.Volume, properties *connector.Properties) error {
+	multipath := false
+
+	return volumes.TerminateConnection(ctx, t.ClientSet.BlockStorage, volume.ID, volumes.TerminateConnectionOpts{
+		IP:        properties.IP,
+		Host:      properties.Host,
+		Initiator: properties.Initiator,
+		Multipath: &multipath,
+	}).ExtractErr()
+}
+
+// releaseCinder disconnects the volume from this host and marks it as
+// available again.
+func (t *OpenStack) releaseCinder(ctx context.Context, volume *volumes.Volume, properties *connector.Properties, connection connector.Connection) error {
+	if connection != nil {
+		err := connection.Disconnect(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := t.terminateConnection(ctx, volume, properties)
+	if err != nil {
+		return err
+	}
+
+	for _, attachment := range volume.Attachments {
+		if attachment.HostName != properties.Host {
+			continue
+		}
+
+		err := volumes.Detach(ctx, t.ClientSet.BlockStorage, volume.ID, volumes.DetachOpts{
+			AttachmentID: attachment.AttachmentID,
+		}).ExtractErr()
+		if err != nil {
+			return err
+		}
+	}
+
+	if volume.Status == "reserved" || volume.Status == "attaching" {
+		err := volumes.Unreserve(ctx, t.ClientSet.BlockStorage, volume.ID).ExtractErr()
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.waitForAvailable(ctx, volume.ID)
+}
+
+// hostAttachment returns the attachment of the volume to this host, or nil if
+// it is not attached to it.  Volumes attached to any other host are never
+// touched, since another run may still be writing to them.
+func hostAttachment(volume *volumes.Volume, properties *connector.Properties) (*volumes.Attachment, error) {
+	var attached *volumes.Attachment
+
+	for i, attachment := range volume.Attachments {
+		if attachment.HostName != properties.Host {
+			return nil, fmt.Errorf("volume %s is attached to %s", volume.ID, attachment.HostName+attachment.ServerID)
+		}
+
+		attached = &volume.Attachments[i]
+	}
+
+	return attached, nil
+}
+
+// releaseStale releases a volume which a previous run on this host did not
+// disconnect, for example because it crashed, using the device recorded in its
+// attachment to rebuild the connection.
+func (t *OpenStack) releaseStale(ctx context.Context, volume *volumes.Volume, properties *connector.Properties, attachment *volumes.Attachment) error {
+	log.WithFields(log.Fields{
+		"volume_id": volume.ID,
+		"status":    volume.Status,
+		"device":    attachment.Device,
+	}).Warn("Volume was left attached to this host, releasing it")
+
+	connection, err := t.initializeConnection(ctx, volume, properties, attachment.Device)
+	if err != nil {
+		return err
+	}
+
+	return t.releaseCinder(ctx, volume, properties, connection)
+}
+
+func (t *OpenStack) connectCinder(ctx context.Context, volume *volumes.Volume) error {
+	properties, err := t.connectorProperties(ctx)
+	if err != nil {
+		return err
+	}
+
+	if volume.Status != "available" {
+		attachment, err := hostAttachment(volume, properties)
+		if err != nil {
+			return err
+		}
+
+		// A reservation does not record the host, so a volume which is
+		// reserved without being attached cannot safely be released
+		if attachment == nil {
+			return fmt.Errorf("volume %s is %s without being attached to this host, reset its state once no other host uses it", volume.ID, volume.Status)
+		}
+
+		err = t.releaseStale(ctx, volume, properties, attachment)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = volumes.Reserve(ctx, t.ClientSet.BlockStorage, volume.ID).ExtractErr()
+	if err != nil {
+		return err
+	}
+
+	connection, err := t.initializeConnection(ctx, volume, properties, "")
+	if err != nil {
+		return errors.Join(err, volumes.Unreserve(ctx, t.ClientSet.BlockStorage, volume.ID).ExtractErr())
+	}
+
+	devicePath, err := connection.Connect(ctx)
+	if err == nil {
+		err = volumes.Attach(ctx, t.ClientSet.BlockStorage, volume.ID, volumes.AttachOpts{
+			HostName:   properties.Host,
+			MountPoint: devicePath,
+			Mode:       volumes.ReadWrite,
+		}).ExtractErr()
+	}
+	if err != nil {
+		return errors.Join(
+			err,
+			connection.Disconnect(ctx),
+			t.terminateConnection(ctx, volume, properties),
+			volumes.Unreserve(ctx, t.ClientSet.BlockStorage, volume.ID).ExtractErr(),
+		)
+	}
+
+	t.connection = connection
+	t.connectorProps = properties
+	t.devicePath = devicePath
+
+	log.WithFields(log.Fields{
+		"volume_id": volume.ID,
+		"device":    devicePath,
+	}).Info("Device found")
+
+	return nil
+}
+
+func (t *OpenStack) disconnectCinder(ctx context.Context, volume *volumes.Volume) error {
+	// The connection of a previous run which crashed is rebuilt from the
+	// attachment of the volume to this host
+	if t.connection == nil {
+		properties, err := t.connectorProperties(ctx)
+		if err != nil {
+			return err
+		}
+
+		attachment, err := hostAttachment(volume, properties)
+		if err != nil || attachment == nil {
+			return err
+		}
+
+		return t.releaseStale(ctx, volume, properties, attachment)
+	}
+
+	err := t.releaseCinder(ctx, volume, t.connectorProps, t.connection)
+	if err != nil {
+		return err
+	}
+
+	t.connection = nil
+	t.connectorProps = nil
+	t.devicePath = ""
+
+	return nil
+}
+
+func (t *OpenStack) waitForAvailable(ctx context.Context, volumeID string) error {
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+
+	err := volumes.WaitForStatus(ctx, t.ClientSet.BlockStorage, volumeID, "available")
+	if err != nil {
+		return errors.Join(errors.New("timed out waiting for volume to be available"), err)
+	}
+
+	return nil
+}
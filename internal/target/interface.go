@@ -3,16 +3,26 @@ package target
 import (
 	"context"
 
-	"github.com/vexxhost/migratekit/internal/vmware"
-	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vexxhost/migratekit/internal/machine"
 )
 
+// Target is where the disks of a virtual machine are copied to, change IDs
+// are recorded as they come from the source which alone interprets them.
 type Target interface {
-	GetDisk() *types.VirtualDisk
+	GetDisk() *machine.Disk
 	Connect(context.Context) error
 	GetPath(context.Context) (string, error)
 	Disconnect(context.Context) error
 	Exists(context.Context) (bool, error)
-	GetCurrentChangeID(context.Context) (*vmware.ChangeID, error)
-	WriteChangeID(context.Context, *vmware.ChangeID) error
+	GetCurrentChangeID(context.Context) (string, error)
+	WriteChangeID(context.Context, string) error
+	GetCheckpoint(context.Context) (*Checkpoint, error)
+	WriteCheckpoint(context.Context, *Checkpoint) error
+}
+
+// Checkpoint records how far an interrupted full copy got, everything before
+// Offset was copied from a snapshot with the given change ID.
+type Checkpoint struct {
+	Offset   int64
+	ChangeID string
 }
@@ -3,27 +3,30 @@ package target
 import (
 	"context"
 	"errors"
+	"fmt"
 	"math"
-	"os"
-	"path/filepath"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/volumes"
 	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/volumeattach"
 	log "github.com/sirupsen/logrus"
+	"github.com/vexxhost/migratekit/internal/blockdev"
+	"github.com/vexxhost/migratekit/internal/connector"
+	"github.com/vexxhost/migratekit/internal/machine"
 	"github.com/vexxhost/migratekit/internal/openstack"
-	"github.com/vexxhost/migratekit/internal/vmware"
-	"github.com/vmware/govmomi/object"
-	"github.com/vmware/govmomi/vim25/mo"
-	"github.com/vmware/govmomi/vim25/types"
 )
 
 type OpenStack struct {
-	VirtualMachine *object.VirtualMachine
-	Disk           *types.VirtualDisk
+	Config         *Config
+	VirtualMachine *machine.VirtualMachine
+	Disk           *machine.Disk
 	ClientSet      *openstack.ClientSet
+
+	// Only used when attaching through Cinder
+	connection     connector.Connection
+	connectorProps *connector.Properties
+	devicePath     string
 }
 
 type VolumeCreateOpts struct {
@@ -32,54 +35,92 @@ type VolumeCreateOpts struct {
 	BusType          string
 }
 
-func NewOpenStack(ctx context.Context, vm *object.VirtualMachine, disk *types.VirtualDisk) (*OpenStack, error) {
-	clientSet, err := openstack.NewClientSet(ctx)
+const (
+	BusTypeVirtio = "virtio"
+	BusTypeSCSI   = "scsi"
+)
+
+// Config is how the volumes of the disks are created and attached
+type Config struct {
+	OpenStack *openstack.Config
+	Volume    VolumeCreateOpts
+	Attach    AttachOpts
+
+	// OSType is set as the os_type image property of new volumes, "auto"
+	// detects it from the guest operating system and empty leaves it unset
+	OSType string
+
+	EnableQemuGuestAgent bool
+}
+
+// Validate checks the configuration before anything is migrated with it
+func (c *Config) Validate() error {
+	if c == nil {
+		return errors.New("target configuration is required")
+	}
+
+	if c.OpenStack == nil {
+		return openstack.ErrNoConfig
+	}
+
+	switch c.Volume.BusType {
+	case BusTypeVirtio, BusTypeSCSI:
+	case "":
+		return errors.New("disk bus type is required, valid options are: virtio, scsi")
+	default:
+		return fmt.Errorf("invalid disk bus type %q, valid options are: virtio, scsi", c.Volume.BusType)
+	}
+
+	switch c.Attach.Mode {
+	case AttachModeNova, AttachModeCinder:
+	case "":
+		return errors.New("attach mode is required, valid options are: nova, cinder")
+	default:
+		return fmt.Errorf("invalid attach mode %q, valid options are: nova, cinder", c.Attach.Mode)
+	}
+
+	return nil
+}
+
+func NewOpenStack(ctx context.Context, config *Config, vm *machine.VirtualMachine, disk *machine.Disk) (*OpenStack, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	clientSet, err := openstack.NewConversionClientSet(ctx, config.OpenStack)
 	if err != nil {
 		return nil, err
 	}
 
 	return &OpenStack{
+		Config:         config,
 		VirtualMachine: vm,
 		Disk:           disk,
 		ClientSet:      clientSet,
 	}, nil
 }
 
-func (t *OpenStack) GetDisk() *types.VirtualDisk {
+func (t *OpenStack) GetDisk() *machine.Disk {
 	return t.Disk
 }
 
-func findDevice(volumeID string) (string, error) {
-	files, err := os.ReadDir("/dev/disk/by-id/")
-	if err != nil {
-		return "", err
-	}
-
-	for _, file := range files {
-		if strings.Contains(file.Name(), volumeID[:18]) {
-			devicePath, err := filepath.EvalSymlinks(filepath.Join("/dev/disk/by-id/", file.Name()))
-			if err != nil {
-				return "", err
-			}
-
-			return devicePath, nil
-		}
-	}
-
-	return "", nil
+// findDevice returns the block device of a volume attached through Nova, which
+// uses the volume ID as the serial of the disk.
+func findDevice(serial string, volume *volumes.Volume) (string, error) {
+	return blockdev.FindBySerial(serial, int64(volume.Size)*1024*1024*1024)
 }
 
 func (t *OpenStack) Connect(ctx context.Context) error {
 	volume, err := t.ClientSet.GetVolumeForDisk(ctx, t.VirtualMachine, t.Disk)
 	volumeMetadata := map[string]string{
 		"migrate_kit": "true",
-		"vm":          t.VirtualMachine.Reference().Value,
+		"vm":          t.VirtualMachine.ID,
 		"disk":        strconv.Itoa(int(t.Disk.Key)),
 	}
 
-	opts := ctx.Value("volumeCreateOpts").(*VolumeCreateOpts)
+	opts := &t.Config.Volume
 
-	if opts.BusType == "scsi" {
+	if opts.BusType == BusTypeSCSI {
 		volumeMetadata["hw_disk_bus"] = "scsi"
 		volumeMetadata["hw_scsi_model"] = "virtio-scsi"
 	}
@@ -103,27 +144,16 @@ func (t *OpenStack) Connect(ctx context.Context) error {
 				return err
 			}
 
-			var o mo.VirtualMachine
-			err = t.VirtualMachine.Properties(ctx, t.VirtualMachine.Reference(), []string{
-				"config.bootOptions",
-				"config.firmware",
-				"config.guestFullName",
-				"config.guestId",
-			}, &o)
-			if err != nil {
-				return err
-			}
 			log.WithFields(log.Fields{
-				"Config.GuestId":       o.Config.GuestId,
-				"Config.GuestFullName": o.Config.GuestFullName,
+				"Config.GuestId":       t.VirtualMachine.GuestID,
+				"Config.GuestFullName": t.VirtualMachine.GuestFullName,
 			}).Info("VMware GustId")
 
 			volumeImageMetadata := map[string]string{}
-			switch osTypeCMD := ctx.Value("osType").(string); osTypeCMD {
+			switch osTypeCMD := t.Config.OSType; osTypeCMD {
 			case "auto":
-				guestIdLower := strings.ToLower(o.Config.GuestId)
 				vmOsType := "linux" // linux is the default os type, TODO: Add mapping for all possible GuestIds
-				if strings.Contains(guestIdLower, "windows") {
+				if t.VirtualMachine.IsWindows() {
 					vmOsType = "windows"
 				}
 				volumeImageMetadata["os_type"] = vmOsType
@@ -140,7 +170,7 @@ func (t *OpenStack) Connect(ctx context.Context) error {
 				}).Info("Volume set os type")
 			}
 
-			if ctx.Value("enableQemuGuestAgent").(bool) {
+			if t.Config.EnableQemuGuestAgent {
 				log.WithFields(log.Fields{
 					"volume_id":           volume.ID,
 					"hw_qemu_guest_agent": "yes",
@@ -148,7 +178,7 @@ func (t *OpenStack) Connect(ctx context.Context) error {
 				volumeImageMetadata["hw_qemu_guest_agent"] = "yes"
 			}
 
-			if types.GuestOsDescriptorFirmwareType(o.Config.Firmware) == types.GuestOsDescriptorFirmwareTypeEfi {
+			if t.VirtualMachine.Firmware == machine.FirmwareEFI {
 				log.WithFields(log.Fields{
 					"volume_id": volume.ID,
 				}).Info("Setting volume to be UEFI")
@@ -156,13 +186,11 @@ func (t *OpenStack) Connect(ctx context.Context) error {
 				volumeImageMetadata["hw_firmware_type"] = "uefi"
 			}
 
-			if o.Config.BootOptions.EfiSecureBootEnabled != nil {
-				if *o.Config.BootOptions.EfiSecureBootEnabled {
-					log.WithFields(log.Fields{
-						"volume_id": volume.ID,
-					}).Info("Setting volume to be UEFI Secure Boot")
-					volumeImageMetadata["os_secure_boot"] = "required"
-				}
+			if t.VirtualMachine.SecureBoot {
+				log.WithFields(log.Fields{
+					"volume_id": volume.ID,
+				}).Info("Setting volume to be UEFI Secure Boot")
+				volumeImageMetadata["os_secure_boot"] = "required"
 			}
 
 			err = volumes.SetImageMetadata(ctx, t.ClientSet.BlockStorage, volume.ID, volumes.ImageMetadataOpts{
@@ -180,6 +208,10 @@ func (t *OpenStack) Connect(ctx context.Context) error {
 		"volume_id": volume.ID,
 	}).Info("Attaching volume")
 
+	if t.Config.Attach.Mode == AttachModeCinder {
+		return t.connectCinder(ctx, volume)
+	}
+
 	path, err := t.GetPath(ctx)
 	if err != nil {
 		return err
@@ -195,7 +227,7 @@ func (t *OpenStack) Connect(ctx context.Context) error {
 			"instance_uuid": instanceUUID,
 		}).Info("Detected instance UUID, attaching volume...")
 
-		_, err = volumeattach.Create(ctx, t.ClientSet.Compute, instanceUUID, volumeattach.CreateOpts{
+		attachment, err := volumeattach.Create(ctx, t.ClientSet.Compute, instanceUUID, volumeattach.CreateOpts{
 			VolumeID: volume.ID,
 		}).Extract()
 		if err != nil {
@@ -208,10 +240,12 @@ func (t *OpenStack) Connect(ctx context.Context) error {
 
 		for {
 			select {
+			case <-ctx.Done():
+				return ctx.Err()
 			case <-timeoutTimer:
 				return errors.New("timed out waiting for volume to attach")
 			case <-ticker.C:
-				devicePath, err := findDevice(volume.ID)
+				devicePath, err := findDevice(attachment.VolumeID, volume)
 				if err != nil {
 					return err
 				}
@@ -238,7 +272,7 @@ func (t *OpenStack) Connect(ctx context.Context) error {
 func (t *OpenStack) createVolume(ctx context.Context, opts *VolumeCreateOpts, metadata map[string]string) (*volumes.Volume, error) {
 	log.Info("Creating new volume")
 	volume, err := volumes.Create(ctx, t.ClientSet.BlockStorage, volumes.CreateOpts{
-		Name:             DiskLabel(t.VirtualMachine, t.Disk),
+		Name:             t.VirtualMachine.DiskLabel(t.Disk),
 		Size:             int(math.Ceil(float64(t.Disk.CapacityInBytes) / 1024 / 1024 / 1024)),
 		AvailabilityZone: opts.AvailabilityZone,
 		VolumeType:       opts.VolumeType,
@@ -260,17 +294,16 @@ func (t *OpenStack) createVolume(ctx context.Context, opts *VolumeCreateOpts, me
 }
 
 func (t *OpenStack) GetPath(ctx context.Context) (string, error) {
-	volume, err := t.ClientSet.GetVolumeForDisk(ctx, t.VirtualMachine, t.Disk)
-	if err != nil {
-		return "", err
+	if t.Config.Attach.Mode == AttachModeCinder {
+		return t.devicePath, nil
 	}
 
-	devicePath, err := findDevice(volume.ID)
+	volume, err := t.ClientSet.GetVolumeForDisk(ctx, t.VirtualMachine, t.Disk)
 	if err != nil {
 		return "", err
 	}
 
-	return devicePath, nil
+	return findDevice(volume.ID, volume)
 }
 
 func (t *OpenStack) Disconnect(ctx context.Context) error {
@@ -281,28 +314,31 @@ func (t *OpenStack) Disconnect(ctx context.Context) error {
 		return err
 	}
 
-	devicePath, err := findDevice(volume.ID)
+	if t.Config.Attach.Mode == AttachModeCinder {
+		return t.disconnectCinder(ctx, volume)
+	}
+
+	instanceUUID, err := openstack.GetCurrentInstanceUUID()
 	if err != nil {
 		return err
 	}
 
-	if devicePath != "" {
-		instanceUUID, err := openstack.GetCurrentInstanceUUID()
-		if err != nil {
-			return err
+	attached := false
+	for _, attachment := range volume.Attachments {
+		if attachment.ServerID == instanceUUID {
+			attached = true
 		}
+	}
 
+	if attached {
 		err = volumeattach.Delete(ctx, t.ClientSet.Compute, instanceUUID, volume.ID).ExtractErr()
 		if err != nil {
 			return err
 		}
 
-		ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
-		defer cancel()
-
-		err = volumes.WaitForStatus(ctx, t.ClientSet.BlockStorage, volume.ID, "available")
+		err = t.waitForAvailable(ctx, volume.ID)
 		if err != nil {
-			return errors.Join(errors.New("timed out waiting for volume to be available"), err)
+			return err
 		}
 	}
 
@@ -320,28 +356,78 @@ func (t *OpenStack) Exists(ctx context.Context) (bool, error) {
 	return true, nil
 }
 
-func (t *OpenStack) GetCurrentChangeID(ctx context.Context) (*vmware.ChangeID, error) {
+// GetCurrentChangeID returns the change ID recorded on the volume, it is
+// empty if the volume does not exist or has none.
+func (t *OpenStack) GetCurrentChangeID(ctx context.Context) (string, error) {
 	volume, err := t.ClientSet.GetVolumeForDisk(ctx, t.VirtualMachine, t.Disk)
 	if errors.Is(err, openstack.ErrorVolumeNotFound) {
-		return &vmware.ChangeID{}, nil
+		return "", nil
 	} else if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	if changeID, ok := volume.Metadata["change_id"]; ok {
-		return vmware.ParseChangeID(changeID)
+	return volume.Metadata["change_id"], nil
+}
+
+func (t *OpenStack) WriteChangeID(ctx context.Context, changeID string) error {
+	volume, err := t.ClientSet.GetVolumeForDisk(ctx, t.VirtualMachine, t.Disk)
+	if errors.Is(err, openstack.ErrorVolumeNotFound) {
+		return nil
 	}
 
-	return &vmware.ChangeID{}, nil
+	volume.Metadata["change_id"] = changeID
+
+	_, err = volumes.Update(ctx, t.ClientSet.BlockStorage, volume.ID, volumes.UpdateOpts{
+		Metadata: volume.Metadata,
+	}).Extract()
+
+	return err
 }
 
-func (t *OpenStack) WriteChangeID(ctx context.Context, changeID *vmware.ChangeID) error {
+func (t *OpenStack) GetCheckpoint(ctx context.Context) (*Checkpoint, error) {
 	volume, err := t.ClientSet.GetVolumeForDisk(ctx, t.VirtualMachine, t.Disk)
 	if errors.Is(err, openstack.ErrorVolumeNotFound) {
-		return nil
+		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
 
-	volume.Metadata["change_id"] = changeID.Value
+	offset, ok := volume.Metadata["full_copy_offset"]
+	if !ok {
+		return nil, nil
+	}
+
+	parsedOffset, err := strconv.ParseInt(offset, 10, 64)
+	if err != nil {
+		log.WithError(err).Warn("Invalid full copy offset, ignoring checkpoint")
+		return nil, nil
+	}
+
+	return &Checkpoint{
+		Offset:   parsedOffset,
+		ChangeID: volume.Metadata["full_copy_change_id"],
+	}, nil
+}
+
+// WriteCheckpoint records the checkpoint in the volume metadata, a nil
+// checkpoint removes it once the full copy has completed.
+func (t *OpenStack) WriteCheckpoint(ctx context.Context, checkpoint *Checkpoint) error {
+	volume, err := t.ClientSet.GetVolumeForDisk(ctx, t.VirtualMachine, t.Disk)
+	if err != nil {
+		return err
+	}
+
+	if checkpoint == nil {
+		if _, ok := volume.Metadata["full_copy_offset"]; !ok {
+			return nil
+		}
+
+		delete(volume.Metadata, "full_copy_offset")
+		delete(volume.Metadata, "full_copy_change_id")
+	} else {
+		volume.Metadata["full_copy_offset"] = strconv.FormatInt(checkpoint.Offset, 10)
+		volume.Metadata["full_copy_change_id"] = checkpoint.ChangeID
+	}
 
 	_, err = volumes.Update(ctx, t.ClientSet.BlockStorage, volume.ID, volumes.UpdateOpts{
 		Metadata: volume.Metadata,
@@ -0,0 +1,175 @@
+package throttle
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var units = map[string]int64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// ParseRate parses a rate in bytes per second with an optional binary unit
+// suffix, such as "500K", "20M", "20MiB" or "1G".
+func ParseRate(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "i")
+
+	number := strings.TrimRight(value, "KMGTkmgt")
+	unit := strings.ToUpper(value[len(number):])
+
+	multiplier, ok := units[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid rate unit: %s", unit)
+	}
+
+	rate, err := strconv.ParseFloat(number, 64)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("invalid rate: %s", value)
+	}
+
+	return int64(rate * float64(multiplier)), nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window applies a rate between two times of the day, the window wraps around
+// midnight if it ends before it starts.
+type Window struct {
+	Days  map[time.Weekday]bool
+	Start time.Duration
+	End   time.Duration
+	Rate  int64
+}
+
+func (w *Window) Contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	day := t.Weekday()
+
+	if w.Start <= w.End {
+		return w.Days[day] && offset >= w.Start && offset < w.End
+	}
+
+	// The part after midnight belongs to the window of the previous day
+	if offset >= w.Start {
+		return w.Days[day]
+	}
+
+	return offset < w.End && w.Days[(day+6)%7]
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day: %s", value)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseDays(value string) (map[time.Weekday]bool, error) {
+	days := map[time.Weekday]bool{}
+
+	for _, part := range strings.Split(strings.ToLower(value), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+
+		start, ok := weekdays[first]
+		if !ok {
+			return nil, fmt.Errorf("invalid day: %s", first)
+		}
+
+		end := start
+		if isRange {
+			end, ok = weekdays[last]
+			if !ok {
+				return nil, fmt.Errorf("invalid day: %s", last)
+			}
+		}
+
+		for day := start; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == end {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+// ParseWindow parses a window in the "[DAYS ]HH:MM-HH:MM=RATE" format, such as
+// "mon-fri 08:00-18:00=20M", windows without days apply to every day.
+func ParseWindow(value string) (*Window, error) {
+	spec, rate, ok := strings.Cut(value, "=")
+	if !ok {
+		return nil, fmt.Errorf("invalid bandwidth schedule, missing rate: %s", value)
+	}
+
+	window := &Window{}
+
+	var err error
+	window.Rate, err = ParseRate(rate)
+	if err != nil {
+		return nil, err
+	}
+
+	days, times, hasDays := strings.Cut(strings.TrimSpace(spec), " ")
+	if !hasDays {
+		times = days
+		days = "sun-sat"
+	}
+
+	window.Days, err = parseDays(days)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end, ok := strings.Cut(times, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid bandwidth schedule, missing time range: %s", value)
+	}
+
+	window.Start, err = parseTimeOfDay(start)
+	if err != nil {
+		return nil, err
+	}
+
+	window.End, err = parseTimeOfDay(end)
+	if err != nil {
+		return nil, err
+	}
+
+	return window, nil
+}
+
+// Schedule returns the rate for a given time, the first window which contains
+// the time is used, otherwise the default rate applies.  A rate of 0 means
+// that no limit is applied.
+type Schedule struct {
+	Default int64
+	Windows []*Window
+}
+
+func (s *Schedule) RateAt(t time.Time) int64 {
+	for _, window := range s.Windows {
+		if window.Contains(t) {
+			return window.Rate
+		}
+	}
+
+	return s.Default
+}
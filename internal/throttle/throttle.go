@@ -0,0 +1,173 @@
+package throttle
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	updateInterval = 5 * time.Second
+	leaseTimeout   = 30 * time.Second
+
+	// The nbdkit rate filter has no way to express an unlimited rate inside
+	// of the rate file, so a rate far above any link speed is used instead.
+	unlimitedBitsPerSecond = 1 << 50
+)
+
+// Throttle limits the rate at which data is read from the source, copies
+// reading from the same ESXi host share the host limit by registering leases
+// inside of a directory which is shared between all migratekit processes.
+type Throttle struct {
+	Schedule  Schedule
+	HostLimit int64
+	Dir       string
+}
+
+func (t *Throttle) Enabled() bool {
+	return t != nil && (t.Schedule.Default > 0 || len(t.Schedule.Windows) > 0 || t.HostLimit > 0)
+}
+
+// Copy holds the lease of a running copy and keeps the rate file of its
+// nbdkit server up to date until it is stopped.
+type Copy struct {
+	throttle *Throttle
+	host     string
+	lease    string
+	rateFile string
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// Start registers a copy reading from the given ESXi host and starts updating
+// the rate file used by the nbdkit rate filter.
+func (t *Throttle) Start(ctx context.Context, host, rateFile string) (*Copy, error) {
+	c := &Copy{
+		throttle: t,
+		host:     host,
+		rateFile: rateFile,
+		done:     make(chan struct{}),
+	}
+
+	if t.HostLimit > 0 {
+		dir := filepath.Join(t.Dir, host)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+
+		c.lease = filepath.Join(dir, uuid.NewString())
+	}
+
+	if err := c.update(); err != nil {
+		return nil, err
+	}
+
+	ctx, c.cancel = context.WithCancel(ctx)
+	go func() {
+		defer close(c.done)
+
+		ticker := time.NewTicker(updateInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := c.update(); err != nil {
+					log.WithError(err).Warn("Failed to update bandwidth limit")
+				}
+			}
+		}
+	}()
+
+	return c, nil
+}
+
+func (c *Copy) Stop() {
+	c.cancel()
+	<-c.done
+
+	if c.lease != "" {
+		os.Remove(c.lease)
+	}
+}
+
+// activeCopies touches the lease of this copy and returns the number of
+// copies which renewed their lease recently for the same ESXi host.
+func (c *Copy) activeCopies() (int64, error) {
+	now := time.Now()
+	if err := os.WriteFile(c.lease, []byte(now.Format(time.RFC3339)), 0644); err != nil {
+		return 0, err
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(c.lease))
+	if err != nil {
+		return 0, err
+	}
+
+	var active int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		if now.Sub(info.ModTime()) > leaseTimeout {
+			os.Remove(filepath.Join(filepath.Dir(c.lease), entry.Name()))
+			continue
+		}
+
+		active++
+	}
+
+	return active, nil
+}
+
+func (c *Copy) Rate() (int64, error) {
+	rate := c.throttle.Schedule.RateAt(time.Now())
+
+	if c.lease != "" {
+		active, err := c.activeCopies()
+		if err != nil {
+			return 0, err
+		}
+
+		share := c.throttle.HostLimit / max(active, 1)
+		if rate == 0 || share < rate {
+			rate = share
+		}
+	}
+
+	return rate, nil
+}
+
+func (c *Copy) update() error {
+	rate, err := c.Rate()
+	if err != nil {
+		return err
+	}
+
+	bits := int64(unlimitedBitsPerSecond)
+	if rate > 0 {
+		bits = rate * 8
+	}
+
+	log.WithFields(log.Fields{
+		"host":             c.host,
+		"bytes_per_second": rate,
+		"rate_file":        c.rateFile,
+	}).Debug("Updating bandwidth limit")
+
+	tmp := c.rateFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(bits, 10)+"\n"), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, c.rateFile)
+}
@@ -0,0 +1,34 @@
+// Package v2v converts the guest on a migrated disk to run on KVM.
+package v2v
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// InPlace runs virt-v2v-in-place against the disk at path, which must hold
+// the operating system of the guest.
+func InPlace(ctx context.Context, path string, debug bool) error {
+	os.Setenv("LIBGUESTFS_BACKEND", "direct")
+
+	var cmd *exec.Cmd
+	if debug {
+		cmd = exec.CommandContext(ctx, "virt-v2v-in-place", "-v", "-x", "-i", "disk", path)
+	} else {
+		cmd = exec.CommandContext(ctx, "virt-v2v-in-place", "-i", "disk", path)
+	}
+
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// Give virt-v2v a chance to shut down its appliance when interrupted
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = 30 * time.Second
+
+	return cmd.Run()
+}
@@ -0,0 +1,75 @@
+package vmware
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/session/keepalive"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+)
+
+var ErrChangeTrackingDisabled = errors.New("change tracking is not enabled on the virtual machine")
+
+func NewClient(ctx context.Context, endpointUrl *url.URL, opts *TLSOptions) (*vim25.Client, error) {
+	soapClient := soap.NewClient(endpointUrl, opts.Insecure)
+
+	if opts.CABundle != "" {
+		if err := soapClient.SetRootCAs(opts.CABundle); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Thumbprint != "" {
+		soapClient.SetThumbprint(endpointUrl.Host, NormalizeThumbprint(opts.Thumbprint))
+	}
+
+	vimClient, err := vim25.NewClient(ctx, soapClient)
+	if err != nil {
+		return nil, err
+	}
+
+	vimClient.RoundTripper = keepalive.NewHandlerSOAP(
+		vimClient.RoundTripper,
+		15*time.Second,
+		nil,
+	)
+
+	mgr := session.NewManager(vimClient)
+	err = mgr.Login(ctx, endpointUrl.User)
+	if err != nil {
+		return nil, err
+	}
+
+	return vimClient, nil
+}
+
+// Logout ends the session of a client created by NewClient
+func Logout(ctx context.Context, client *vim25.Client) error {
+	return session.NewManager(client).Logout(ctx)
+}
+
+func FindVirtualMachine(ctx context.Context, client *vim25.Client, path string) (*object.VirtualMachine, error) {
+	finder := find.NewFinder(client)
+	return finder.VirtualMachine(ctx, path)
+}
+
+func EnsureChangeTracking(ctx context.Context, vm *object.VirtualMachine) error {
+	var o mo.VirtualMachine
+	err := vm.Properties(ctx, vm.Reference(), []string{"config"}, &o)
+	if err != nil {
+		return err
+	}
+
+	if o.Config.ChangeTrackingEnabled == nil || !*o.Config.ChangeTrackingEnabled {
+		return ErrChangeTrackingDisabled
+	}
+
+	return nil
+}
@@ -0,0 +1,275 @@
+package vmware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// LockAttribute is the custom attribute of the virtual machine which holds
+// the run lock.
+const LockAttribute = "migratekit.lock"
+
+const (
+	// LockTTL is how long a lock is valid for if it is not refreshed, so
+	// that the lock of a run which crashed eventually expires.
+	LockTTL = 5 * time.Minute
+	// vSphere has no compare-and-swap for custom attributes, so the lock is
+	// read back after a delay to detect a concurrent run taking it.
+	lockSettleDelay = 2 * time.Second
+)
+
+var (
+	ErrLocked        = errors.New("virtual machine is locked by another migratekit run")
+	ErrLockNotUsable = errors.New("run locks require a vCenter server")
+	ErrLockLost      = errors.New("run lock was taken over or expired")
+)
+
+type LockOwner struct {
+	ID        string    `json:"id"`
+	Host      string    `json:"host"`
+	PID       int       `json:"pid"`
+	Command   string    `json:"command"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (o *LockOwner) String() string {
+	return fmt.Sprintf("%s on %s (pid %d) until %s", o.Command, o.Host, o.PID, o.ExpiresAt.Format(time.RFC3339))
+}
+
+// Lock prevents several migratekit runs against the same virtual machine,
+// it is refreshed in the background until it is released.
+type Lock struct {
+	vm      *object.VirtualMachine
+	manager *object.CustomFieldsManager
+	key     int32
+	owner   LockOwner
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	// valid is until when the last write of the lock holds it, lost is
+	// closed once it was taken over or expired
+	valid time.Time
+	lost  chan struct{}
+}
+
+func lockKey(ctx context.Context, manager *object.CustomFieldsManager) (int32, error) {
+	key, err := manager.FindKey(ctx, LockAttribute)
+	if err == nil {
+		return key, nil
+	} else if !errors.Is(err, object.ErrKeyNameNotFound) {
+		return -1, err
+	}
+
+	def, err := manager.Add(ctx, LockAttribute, "VirtualMachine", nil, nil)
+	if err != nil {
+		// Another run might have created the attribute in the meantime
+		if key, findErr := manager.FindKey(ctx, LockAttribute); findErr == nil {
+			return key, nil
+		}
+
+		return -1, err
+	}
+
+	return def.Key, nil
+}
+
+func (l *Lock) current(ctx context.Context) (*LockOwner, error) {
+	var o mo.VirtualMachine
+	err := l.vm.Properties(ctx, l.vm.Reference(), []string{"customValue"}, &o)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, value := range o.CustomValue {
+		field, ok := value.(*types.CustomFieldStringValue)
+		if !ok || field.Key != l.key || field.Value == "" {
+			continue
+		}
+
+		var owner LockOwner
+		if err := json.Unmarshal([]byte(field.Value), &owner); err != nil {
+			log.WithError(err).Warn("Ignoring invalid run lock")
+			return nil, nil
+		}
+
+		return &owner, nil
+	}
+
+	return nil, nil
+}
+
+func (l *Lock) write(ctx context.Context) error {
+	l.owner.ExpiresAt = time.Now().Add(LockTTL)
+
+	value, err := json.Marshal(l.owner)
+	if err != nil {
+		return err
+	}
+
+	return l.manager.Set(ctx, l.vm.Reference(), l.key, string(value))
+}
+
+// AcquireLock takes the run lock of the virtual machine, it fails with
+// ErrLocked if another run holds it unless force is set.
+func AcquireLock(ctx context.Context, vm *object.VirtualMachine, command string, force bool) (*Lock, error) {
+	manager, err := object.GetCustomFieldsManager(vm.Client())
+	if errors.Is(err, object.ErrNotSupported) {
+		return nil, ErrLockNotUsable
+	} else if err != nil {
+		return nil, err
+	}
+
+	key, err := lockKey(ctx, manager)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Lock{
+		vm:      vm,
+		manager: manager,
+		key:     key,
+		owner: LockOwner{
+			ID:      uuid.NewString(),
+			Host:    hostname,
+			PID:     os.Getpid(),
+			Command: command,
+		},
+	}
+
+	owner, err := l.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if owner != nil && time.Now().Before(owner.ExpiresAt) {
+		if !force {
+			return nil, fmt.Errorf("%w: held by %s, use --force-unlock if it is no longer running", ErrLocked, owner)
+		}
+
+		log.WithFields(log.Fields{
+			"owner": owner.String(),
+		}).Warn("Forcing the unlock of the virtual machine")
+	}
+
+	err = l.write(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(lockSettleDelay):
+	}
+
+	owner, err = l.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if owner == nil || owner.ID != l.owner.ID {
+		return nil, fmt.Errorf("%w: another run took the lock at the same time", ErrLocked)
+	}
+
+	refreshCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	l.cancel = cancel
+	l.done = make(chan struct{})
+	l.valid = l.owner.ExpiresAt
+	l.lost = make(chan struct{})
+	go l.refresh(refreshCtx)
+
+	return l, nil
+}
+
+func (l *Lock) refresh(ctx context.Context) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(LockTTL / 5)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			owner, err := l.current(ctx)
+			if err == nil && owner != nil && owner.ID != l.owner.ID {
+				log.WithFields(log.Fields{
+					"owner": owner.String(),
+				}).Error("Run lock was taken over by another run")
+				close(l.lost)
+				return
+			}
+
+			if err == nil {
+				err = l.write(ctx)
+			}
+			if err == nil {
+				l.valid = l.owner.ExpiresAt
+			} else if ctx.Err() == nil {
+				log.WithError(err).Warn("Failed to refresh run lock")
+			}
+
+			// Another run may take the lock once it expired
+			if err != nil && ctx.Err() == nil && time.Now().After(l.valid) {
+				log.Error("Run lock expired since it could not be refreshed")
+				close(l.lost)
+				return
+			}
+		}
+	}
+}
+
+// Guard returns a context which is cancelled with ErrLockLost as its cause
+// once the lock is lost, so that the run stops before it conflicts with the
+// one which took the lock.  The lock may be nil if it is not usable, in which
+// case the context is only cancelled along with ctx.
+func (l *Lock) Guard(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	if l == nil {
+		return ctx, func() { cancel(nil) }
+	}
+
+	go func() {
+		select {
+		case <-l.lost:
+			cancel(ErrLockLost)
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() { cancel(nil) }
+}
+
+// Release stops refreshing the lock and removes it unless another run took it
+// over in the meantime.
+func (l *Lock) Release(ctx context.Context) error {
+	l.cancel()
+	<-l.done
+
+	owner, err := l.current(ctx)
+	if err != nil {
+		return err
+	}
+
+	if owner == nil || owner.ID != l.owner.ID {
+		return nil
+	}
+
+	return l.manager.Set(ctx, l.vm.Reference(), l.key, "")
+}
@@ -0,0 +1,71 @@
+package vmware
+
+import (
+	"context"
+
+	"github.com/vexxhost/migratekit/internal/machine"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// NewMachine describes a virtual machine with the disks of its current
+// configuration, the name is the one from the inventory path so that it
+// matches the volumes created by earlier migration cycles.
+func NewMachine(ctx context.Context, vm *object.VirtualMachine) (*machine.VirtualMachine, error) {
+	var o mo.VirtualMachine
+	err := vm.Properties(ctx, vm.Reference(), []string{"config"}, &o)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &machine.VirtualMachine{
+		ID:            vm.Reference().Value,
+		Name:          vm.Name(),
+		CPUs:          o.Config.Hardware.NumCPU,
+		MemoryMB:      int64(o.Config.Hardware.MemoryMB),
+		Firmware:      machine.FirmwareBIOS,
+		GuestID:       o.Config.GuestId,
+		GuestFullName: o.Config.GuestFullName,
+	}
+
+	if types.GuestOsDescriptorFirmwareType(o.Config.Firmware) == types.GuestOsDescriptorFirmwareTypeEfi {
+		m.Firmware = machine.FirmwareEFI
+	}
+
+	if o.Config.BootOptions != nil && o.Config.BootOptions.EfiSecureBootEnabled != nil {
+		m.SecureBoot = *o.Config.BootOptions.EfiSecureBootEnabled
+	}
+
+	for _, device := range o.Config.Hardware.Device {
+		switch device := device.(type) {
+		case *types.VirtualDisk:
+			m.Disks = append(m.Disks, NewDisk(device))
+		case types.BaseVirtualEthernetCard:
+			card := device.GetVirtualEthernetCard()
+			m.NICs = append(m.NICs, &machine.NIC{
+				MacAddress: card.MacAddress,
+				Label:      card.DeviceInfo.GetDescription().Label,
+				Summary:    card.DeviceInfo.GetDescription().Summary,
+			})
+		}
+	}
+
+	return m, nil
+}
+
+// NewDisk describes a disk of a virtual machine or of one of its snapshots,
+// the change ID is left empty if change tracking is not enabled on it.
+func NewDisk(disk *types.VirtualDisk) *machine.Disk {
+	d := &machine.Disk{
+		Key:             disk.Key,
+		CapacityInBytes: disk.CapacityInBytes,
+		ObjectID:        disk.DiskObjectId,
+	}
+
+	if changeId, err := GetChangeID(disk); err == nil {
+		d.ChangeID = changeId.Value
+	}
+
+	return d
+}
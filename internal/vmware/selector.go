@@ -0,0 +1,285 @@
+package vmware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Selector selects virtual machines by where they are in the inventory, by
+// their tags and by their name.  The virtual machines must match every
+// criterion which is set, templates are never selected.
+type Selector struct {
+	// Folder selects the virtual machines of an inventory folder and of its
+	// subfolders
+	Folder string
+
+	// ResourcePool selects the virtual machines of a resource pool and of
+	// its child pools
+	ResourcePool string
+
+	// Cluster selects the virtual machines running on the hosts of a cluster
+	Cluster string
+
+	// Tags select the virtual machines with any of the tags, a tag can be
+	// qualified with its category as "category:tag"
+	Tags []string
+
+	// TagCategories select the virtual machines with any tag of any of the
+	// categories
+	TagCategories []string
+
+	// Name selects the virtual machines whose name matches
+	Name *regexp.Regexp
+}
+
+// Empty returns true if no criterion is set
+func (s *Selector) Empty() bool {
+	return s.Folder == "" && s.ResourcePool == "" && s.Cluster == "" &&
+		len(s.Tags) == 0 && len(s.TagCategories) == 0 && s.Name == nil
+}
+
+// Select returns the virtual machines matched by the selector sorted by
+// their inventory path, the user logs into the vSphere API to read tags.
+func (s *Selector) Select(ctx context.Context, client *vim25.Client, user *url.Userinfo) ([]*object.VirtualMachine, error) {
+	finder := find.NewFinder(client)
+
+	candidates, err := s.candidates(ctx, finder)
+	if err != nil || len(candidates) == 0 {
+		return nil, err
+	}
+
+	refs := make([]types.ManagedObjectReference, len(candidates))
+	for i, vm := range candidates {
+		refs[i] = vm.Reference()
+	}
+
+	var objects []mo.VirtualMachine
+	err = property.DefaultCollector(client).Retrieve(ctx, refs, []string{"name", "resourcePool", "runtime.host", "config.template"}, &objects)
+	if err != nil {
+		return nil, err
+	}
+
+	filters, err := s.filters(ctx, client, finder, user)
+	if err != nil {
+		return nil, err
+	}
+
+	matched := map[types.ManagedObjectReference]bool{}
+	for i := range objects {
+		o := &objects[i]
+		if o.Config != nil && o.Config.Template {
+			continue
+		}
+
+		if !matchesAll(filters, o) {
+			continue
+		}
+
+		matched[o.Reference()] = true
+	}
+
+	var vms []*object.VirtualMachine
+	for _, vm := range candidates {
+		if matched[vm.Reference()] {
+			vms = append(vms, vm)
+		}
+	}
+
+	sort.Slice(vms, func(i, j int) bool {
+		return vms[i].InventoryPath < vms[j].InventoryPath
+	})
+
+	return vms, nil
+}
+
+// filter returns true if a virtual machine matches a criterion
+type filter func(vm *mo.VirtualMachine) bool
+
+func matchesAll(filters []filter, vm *mo.VirtualMachine) bool {
+	for _, f := range filters {
+		if !f(vm) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// candidates returns the virtual machines of the folder, or of every
+// datacenter if there is none
+func (s *Selector) candidates(ctx context.Context, finder *find.Finder) ([]*object.VirtualMachine, error) {
+	var roots []string
+	if s.Folder != "" {
+		folder, err := finder.Folder(ctx, s.Folder)
+		if err != nil {
+			return nil, err
+		}
+
+		roots = append(roots, folder.InventoryPath)
+	} else {
+		datacenters, err := finder.DatacenterList(ctx, "*")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, datacenter := range datacenters {
+			roots = append(roots, path.Join(datacenter.InventoryPath, "vm"))
+		}
+	}
+
+	var vms []*object.VirtualMachine
+	for _, root := range roots {
+		found, err := finder.VirtualMachineList(ctx, path.Join(root, "..."))
+		if err != nil && !isNotFound(err) {
+			return nil, err
+		}
+
+		vms = append(vms, found...)
+	}
+
+	return vms, nil
+}
+
+func (s *Selector) filters(ctx context.Context, client *vim25.Client, finder *find.Finder, user *url.Userinfo) ([]filter, error) {
+	var filters []filter
+
+	if s.ResourcePool != "" {
+		pool, err := finder.ResourcePool(ctx, s.ResourcePool)
+		if err != nil {
+			return nil, err
+		}
+
+		children, err := finder.ResourcePoolList(ctx, path.Join(pool.InventoryPath, "..."))
+		if err != nil && !isNotFound(err) {
+			return nil, err
+		}
+
+		pools := map[types.ManagedObjectReference]bool{pool.Reference(): true}
+		for _, child := range children {
+			pools[child.Reference()] = true
+		}
+
+		filters = append(filters, func(vm *mo.VirtualMachine) bool {
+			return vm.ResourcePool != nil && pools[*vm.ResourcePool]
+		})
+	}
+
+	if s.Cluster != "" {
+		cluster, err := finder.ClusterComputeResource(ctx, s.Cluster)
+		if err != nil {
+			return nil, err
+		}
+
+		members, err := cluster.Hosts(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		hosts := map[types.ManagedObjectReference]bool{}
+		for _, host := range members {
+			hosts[host.Reference()] = true
+		}
+
+		filters = append(filters, func(vm *mo.VirtualMachine) bool {
+			return vm.Runtime.Host != nil && hosts[*vm.Runtime.Host]
+		})
+	}
+
+	if len(s.Tags) > 0 || len(s.TagCategories) > 0 {
+		tagged, err := s.tagged(ctx, client, user)
+		if err != nil {
+			return nil, err
+		}
+
+		filters = append(filters, func(vm *mo.VirtualMachine) bool {
+			return tagged[vm.Reference().Value]
+		})
+	}
+
+	if s.Name != nil {
+		filters = append(filters, func(vm *mo.VirtualMachine) bool {
+			return s.Name.MatchString(vm.Name)
+		})
+	}
+
+	return filters, nil
+}
+
+// tagged returns the references of the virtual machines with any of the tags
+// or with any tag of the categories
+func (s *Selector) tagged(ctx context.Context, client *vim25.Client, user *url.Userinfo) (map[string]bool, error) {
+	restClient := rest.NewClient(client)
+	if err := restClient.Login(ctx, user); err != nil {
+		return nil, err
+	}
+	defer restClient.Logout(context.WithoutCancel(ctx))
+
+	manager := tags.NewManager(restClient)
+
+	var ids []string
+	for _, name := range s.Tags {
+		var tag *tags.Tag
+		var err error
+		if category, tagName, ok := strings.Cut(name, ":"); ok {
+			tag, err = manager.GetTagForCategory(ctx, tagName, category)
+		} else {
+			tag, err = manager.GetTag(ctx, name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to find tag %s: %w", name, err)
+		}
+
+		ids = append(ids, tag.ID)
+	}
+
+	for _, category := range s.TagCategories {
+		categoryTags, err := manager.GetTagsForCategory(ctx, category)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find tag category %s: %w", category, err)
+		}
+
+		for _, tag := range categoryTags {
+			ids = append(ids, tag.ID)
+		}
+	}
+
+	tagged := map[string]bool{}
+	if len(ids) == 0 {
+		return tagged, nil
+	}
+
+	attached, err := manager.ListAttachedObjectsOnTags(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tag := range attached {
+		for _, ref := range tag.ObjectIDs {
+			if ref.Reference().Type == "VirtualMachine" {
+				tagged[ref.Reference().Value] = true
+			}
+		}
+	}
+
+	return tagged, nil
+}
+
+func isNotFound(err error) bool {
+	var notFound *find.NotFoundError
+	return errors.As(err, &notFound)
+}
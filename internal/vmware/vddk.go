@@ -3,15 +3,83 @@ package vmware
 import (
 	"crypto/sha1"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net/url"
+	"os"
 	"strings"
 )
 
-func GetEndpointThumbprint(url *url.URL) (string, error) {
-	config := tls.Config{
-		InsecureSkipVerify: true,
+var ErrThumbprintMismatch = errors.New("certificate thumbprint does not match")
+
+// TLSOptions controls how the certificate of the VMware endpoint is verified,
+// by default it must be signed by a trusted CA.  If a thumbprint is set, the
+// certificate must match it instead.
+type TLSOptions struct {
+	CABundle   string
+	Thumbprint string
+	Insecure   bool
+}
+
+// NormalizeThumbprint converts a SHA-1 thumbprint to the colon separated and
+// upper case format used by VDDK.
+func NormalizeThumbprint(thumbprint string) string {
+	hex := strings.ToUpper(strings.NewReplacer(":", "", " ", "").Replace(thumbprint))
+
+	parts := make([]string, 0, len(hex)/2)
+	for i := 0; i+1 < len(hex); i += 2 {
+		parts = append(parts, hex[i:i+2])
+	}
+
+	return strings.Join(parts, ":")
+}
+
+func certificateThumbprint(certificate *x509.Certificate) string {
+	sha1Bytes := sha1.Sum(certificate.Raw)
+
+	thumbprint := make([]string, len(sha1Bytes))
+	for i, b := range sha1Bytes {
+		thumbprint[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(thumbprint, ":")
+}
+
+func (o *TLSOptions) config(serverName string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: serverName,
+	}
+
+	// The thumbprint is verified once connected
+	if o.Insecure || o.Thumbprint != "" {
+		config.InsecureSkipVerify = true
+		return config, nil
+	}
+
+	if o.CABundle != "" {
+		pem, err := os.ReadFile(o.CABundle)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle: %s", o.CABundle)
+		}
+
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+// GetEndpointThumbprint connects to the endpoint, verifies its certificate
+// and returns its thumbprint which is needed by VDDK.
+func GetEndpointThumbprint(url *url.URL, opts *TLSOptions) (string, error) {
+	config, err := opts.config(url.Hostname())
+	if err != nil {
+		return "", err
 	}
 
 	port := url.Port()
@@ -19,7 +87,7 @@ func GetEndpointThumbprint(url *url.URL) (string, error) {
 		port = "443"
 	}
 
-	conn, err := tls.Dial("tcp", fmt.Sprintf("%s:%s", url.Hostname(), port), &config)
+	conn, err := tls.Dial("tcp", fmt.Sprintf("%s:%s", url.Hostname(), port), config)
 	if err != nil {
 		return "", err
 	}
@@ -29,13 +97,11 @@ func GetEndpointThumbprint(url *url.URL) (string, error) {
 		return "", errors.New("no certificates found")
 	}
 
-	certificate := conn.ConnectionState().PeerCertificates[0]
-	sha1Bytes := sha1.Sum(certificate.Raw)
+	thumbprint := certificateThumbprint(conn.ConnectionState().PeerCertificates[0])
 
-	thumbprint := make([]string, len(sha1Bytes))
-	for i, b := range sha1Bytes {
-		thumbprint[i] = fmt.Sprintf("%02X", b)
+	if opts.Thumbprint != "" && NormalizeThumbprint(opts.Thumbprint) != thumbprint {
+		return "", fmt.Errorf("%w: expected %s, got %s", ErrThumbprintMismatch, NormalizeThumbprint(opts.Thumbprint), thumbprint)
 	}
 
-	return strings.Join(thumbprint, ":"), nil
+	return thumbprint, nil
 }
@@ -0,0 +1,367 @@
+package vmware_nbdkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vexxhost/migratekit/internal/metrics"
+	"github.com/vexxhost/migratekit/internal/nbdcopy"
+	"github.com/vexxhost/migratekit/internal/target"
+	"github.com/vexxhost/migratekit/internal/vmware"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// ErrNoProgress is returned when querying the changed areas of a disk does
+// not move past the offset it was queried from.
+var ErrNoProgress = errors.New("change tracking did not advance")
+
+// CheckpointInterval is how often the progress of a full copy is recorded
+// on the target so that an interrupted copy can be resumed.
+const CheckpointInterval = 30 * time.Second
+
+// diskCopy copies data from the nbdkit server of a disk into the target
+// device.
+type diskCopy struct {
+	*nbdcopy.Copy
+	server *NbdkitServer
+}
+
+// openCopy opens a copy into the target device, onProgress (if set) is called
+// with the offset below which the disk has been copied after it is reported
+// to the OnProgress function of the servers.
+func (s *NbdkitServer) openCopy(path string, description string, onProgress func(offset int64) error) (*diskCopy, error) {
+	disk := s.diskName()
+	report := s.Servers.OnProgress
+
+	c, err := nbdcopy.Open(s.Nbdkit.LibNBDExportName(), path, &nbdcopy.Options{
+		Description:    description,
+		Size:           s.Disk.CapacityInBytes,
+		VirtualMachine: s.Servers.VirtualMachine.Name(),
+		Disk:           disk,
+		OnProgress: func(offset int64) error {
+			if report != nil {
+				report(disk, offset, s.Disk.CapacityInBytes)
+			}
+
+			if onProgress == nil {
+				return nil
+			}
+
+			return onProgress(offset)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &diskCopy{
+		Copy:   c,
+		server: s,
+	}, nil
+}
+
+// extent is a range of the disk which is either allocated or unallocated
+type extent struct {
+	Start     int64
+	Length    int64
+	Allocated bool
+}
+
+// allocatedExtents uses change tracking with the special "*" change ID, which
+// returns the allocated areas of the disk, to split the disk from start to
+// its end into allocated and unallocated extents.
+func (s *NbdkitServer) allocatedExtents(ctx context.Context, start int64) ([]extent, error) {
+	var extents []extent
+
+	offset := start
+	startOffset := start
+	for startOffset < s.Disk.CapacityInBytes {
+		req := types.QueryChangedDiskAreas{
+			This:        s.Servers.VirtualMachine.Reference(),
+			Snapshot:    &s.Servers.SnapshotRef,
+			DeviceKey:   s.Disk.Key,
+			StartOffset: startOffset,
+			ChangeId:    "*",
+		}
+
+		res, err := methods.QueryChangedDiskAreas(ctx, s.Servers.VirtualMachine.Client(), &req)
+		if err != nil {
+			return nil, err
+		}
+
+		diskChangeInfo := res.Returnval
+
+		for _, area := range diskChangeInfo.ChangedArea {
+			areaEnd := area.Start + area.Length
+			if areaEnd <= offset {
+				continue
+			}
+
+			areaStart := max(area.Start, offset)
+			if areaStart > offset {
+				extents = append(extents, extent{Start: offset, Length: areaStart - offset})
+			}
+
+			extents = append(extents, extent{Start: areaStart, Length: areaEnd - areaStart, Allocated: true})
+			offset = areaEnd
+		}
+
+		next := diskChangeInfo.StartOffset + diskChangeInfo.Length
+		if next <= startOffset {
+			return nil, fmt.Errorf("%w: allocated areas stopped at offset %d", ErrNoProgress, startOffset)
+		}
+
+		startOffset = next
+	}
+
+	if offset < s.Disk.CapacityInBytes {
+		extents = append(extents, extent{Start: offset, Length: s.Disk.CapacityInBytes - offset})
+	}
+
+	return extents, nil
+}
+
+// copyChangedAreas copies all of the areas of the disk below end which
+// changed since the given change ID.
+func (c *diskCopy) copyChangedAreas(ctx context.Context, changeId string, end int64) error {
+	s := c.server
+	vm := s.Servers.VirtualMachine.Name()
+	changedAreaBytes := metrics.ChangedAreaBytes.WithLabelValues(vm, s.diskName())
+	changedAreas := metrics.ChangedAreas.WithLabelValues(vm, s.diskName())
+
+	startOffset := int64(0)
+	for startOffset < end {
+		req := types.QueryChangedDiskAreas{
+			This:        s.Servers.VirtualMachine.Reference(),
+			Snapshot:    &s.Servers.SnapshotRef,
+			DeviceKey:   s.Disk.Key,
+			StartOffset: startOffset,
+			ChangeId:    changeId,
+		}
+
+		res, err := methods.QueryChangedDiskAreas(ctx, s.Servers.VirtualMachine.Client(), &req)
+		if err != nil {
+			return err
+		}
+
+		diskChangeInfo := res.Returnval
+
+		for _, area := range diskChangeInfo.ChangedArea {
+			if area.Start >= end {
+				break
+			}
+
+			length := min(area.Length, end-area.Start)
+
+			changedAreas.Inc()
+			changedAreaBytes.Add(float64(length))
+			s.ChangedBytes += length
+
+			err = c.CopyRange(ctx, area.Start, length, false)
+			if err != nil {
+				return err
+			}
+		}
+
+		next := diskChangeInfo.StartOffset + diskChangeInfo.Length
+		if next <= startOffset {
+			return fmt.Errorf("%w: changed areas stopped at offset %d", ErrNoProgress, startOffset)
+		}
+
+		startOffset = next
+		if err := c.SetProgress(min(startOffset, end)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FullCopyToTarget copies the allocated areas of the disk to the target in a
+// single session, skipping the rest if the target is known to be clean and
+// zeroing it otherwise, and records its progress every CheckpointInterval.  If
+// a previous full copy was interrupted, the areas it already copied are
+// brought up to date using change tracking and the copy resumes from where it
+// stopped.
+func (s *NbdkitServer) FullCopyToTarget(ctx context.Context, t target.Target, path string, targetIsClean bool) error {
+	vm := s.Servers.VirtualMachine.Name()
+	logger := log.WithFields(log.Fields{
+		"vm":   vm,
+		"disk": s.diskName(),
+	})
+
+	err := s.fullCopy(ctx, t, path, targetIsClean, logger)
+	if err != nil {
+		return metrics.Failure(vm, metrics.PhaseFullCopy, err)
+	}
+
+	logger.Info("Full copy completed")
+
+	return nil
+}
+
+func (s *NbdkitServer) fullCopy(ctx context.Context, t target.Target, path string, targetIsClean bool, logger *log.Entry) error {
+	snapshotChangeId, err := vmware.GetChangeID(s.Disk)
+	if err != nil {
+		return err
+	}
+
+	var checkpoint *target.Checkpoint
+	if !targetIsClean {
+		checkpoint, err = t.GetCheckpoint(ctx)
+		if err != nil {
+			return err
+		}
+
+		if checkpoint != nil {
+			checkpointChangeId, err := vmware.ParseChangeID(checkpoint.ChangeID)
+			if err != nil {
+				logger.WithError(err).Warn("Invalid full copy change ID, ignoring checkpoint")
+
+				checkpoint = nil
+			} else if checkpointChangeId.UUID != snapshotChangeId.UUID {
+				logger.WithFields(log.Fields{
+					"checkpointChangeId": checkpointChangeId.Value,
+					"snapshotChangeId":   snapshotChangeId.Value,
+				}).Warn("Change ID mismatch, discarding full copy checkpoint")
+
+				checkpoint = nil
+			}
+		}
+	}
+
+	offset := int64(0)
+	if checkpoint != nil {
+		logger.WithFields(log.Fields{
+			"offset": checkpoint.Offset,
+		}).Info("Resuming full copy, catching up on changes before the checkpoint")
+
+		c, err := s.openCopy(path, "Catching up", nil)
+		if err != nil {
+			return err
+		}
+
+		err = c.copyChangedAreas(ctx, checkpoint.ChangeID, checkpoint.Offset)
+		if err == nil {
+			err = c.Sync()
+		}
+		c.Close()
+		if err != nil {
+			return err
+		}
+
+		offset = checkpoint.Offset
+		err = t.WriteCheckpoint(ctx, &target.Checkpoint{
+			Offset:   offset,
+			ChangeID: snapshotChangeId.Value,
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		logger.Info("Starting full copy")
+	}
+
+	extents, err := s.allocatedExtents(ctx, offset)
+	if err != nil {
+		logger.WithError(err).Warn("Unable to query allocated areas, copying the entire disk")
+
+		extents = []extent{{Start: offset, Length: s.Disk.CapacityInBytes - offset, Allocated: true}}
+	}
+
+	// The checkpoint is only written once the data below it has been
+	// flushed, so that it is never ahead of what is on the target
+	var c *diskCopy
+	lastCheckpoint := time.Now()
+	c, err = s.openCopy(path, "Full copy", func(offset int64) error {
+		if time.Since(lastCheckpoint) < CheckpointInterval || offset >= s.Disk.CapacityInBytes {
+			return nil
+		}
+
+		if err := c.Sync(); err != nil {
+			return err
+		}
+
+		err := t.WriteCheckpoint(ctx, &target.Checkpoint{
+			Offset:   offset,
+			ChangeID: snapshotChangeId.Value,
+		})
+		if err != nil {
+			return err
+		}
+
+		lastCheckpoint = time.Now()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	err = c.SetProgress(offset)
+	if err != nil {
+		return err
+	}
+
+	// The unallocated extents read as zeroes, so they are skipped if the
+	// target is clean and zeroed without reading them otherwise
+	for _, e := range extents {
+		switch {
+		case e.Allocated:
+			s.ChangedBytes += e.Length
+			err = c.CopyRange(ctx, e.Start, e.Length, targetIsClean)
+		case targetIsClean:
+			err = c.SetProgress(e.Start + e.Length)
+		default:
+			err = c.ZeroRange(e.Start, e.Length)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.Sync()
+	if err != nil {
+		return err
+	}
+
+	s.FullCopy = true
+
+	return t.WriteCheckpoint(ctx, nil)
+}
+
+func (s *NbdkitServer) IncrementalCopyToTarget(ctx context.Context, t target.Target, path string) error {
+	vm := s.Servers.VirtualMachine.Name()
+	logger := log.WithFields(log.Fields{
+		"vm":   vm,
+		"disk": s.diskName(),
+	})
+
+	logger.Info("Starting incremental copy")
+
+	err := s.incrementalCopy(ctx, t, path)
+	if err != nil {
+		return metrics.Failure(vm, metrics.PhaseIncrementalCopy, err)
+	}
+
+	return nil
+}
+
+func (s *NbdkitServer) incrementalCopy(ctx context.Context, t target.Target, path string) error {
+	currentChangeId, err := t.GetCurrentChangeID(ctx)
+	if err != nil {
+		return err
+	}
+
+	c, err := s.openCopy(path, "Incremental copy", nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return c.copyChangedAreas(ctx, currentChangeId, s.Disk.CapacityInBytes)
+}
@@ -0,0 +1,77 @@
+package vmware_nbdkit
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vexxhost/migratekit/internal/cutover"
+	"github.com/vexxhost/migratekit/internal/target"
+	"github.com/vexxhost/migratekit/internal/vmware"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Cutover migrates a VMware virtual machine for the last time and creates
+// its server on OpenStack, onProgress (if set) reports the progress of the
+// copies of its disks.
+func Cutover(ctx context.Context, vm *object.VirtualMachine, vddkConfig *VddkConfig, config *target.Config, opts *cutover.Options, onProgress ProgressFunc) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	m, err := vmware.NewMachine(ctx, vm)
+	if err != nil {
+		return err
+	}
+
+	return cutover.Complete(ctx, config.OpenStack, m, opts, func(ctx context.Context) error {
+		return migrate(ctx, vm, vddkConfig, config, opts, onProgress)
+	})
+}
+
+// migrate runs a migration cycle, shuts down the source VM and runs the final
+// migration cycle.
+func migrate(ctx context.Context, vm *object.VirtualMachine, vddkConfig *VddkConfig, config *target.Config, opts *cutover.Options, onProgress ProgressFunc) error {
+	log.Info("Starting migration cycle")
+
+	servers := NewNbdkitServers(vddkConfig, config, vm)
+	servers.OnProgress = onProgress
+	err := servers.MigrationCycle(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Completed migration cycle, shutting down source VM")
+
+	powerState, err := vm.PowerState(ctx)
+	if err != nil {
+		return err
+	}
+
+	if powerState == types.VirtualMachinePowerStatePoweredOff {
+		log.Warn("Source VM is already off, skipping shutdown")
+	} else {
+		err := vm.ShutdownGuest(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = vm.WaitForPowerState(ctx, types.VirtualMachinePowerStatePoweredOff)
+		if err != nil {
+			return err
+		}
+
+		log.Info("Source VM shut down, starting final migration cycle")
+	}
+
+	servers = NewNbdkitServers(vddkConfig, config, vm)
+	servers.OnProgress = onProgress
+	err = servers.MigrationCycle(ctx, opts.RunV2V)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Final migration cycle completed")
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package vmware_nbdkit
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/vexxhost/migratekit/internal/nbdkit"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const (
+	// SourceVddk reads the disks of the snapshot through VDDK
+	SourceVddk = "vddk"
+	// SourceSSH reads the flat disk files from the datastore over SSH to the
+	// ESXi host
+	SourceSSH = "ssh"
+	// SourceCurl reads the flat disk files from the datastore over HTTPS
+	// through vCenter
+	SourceCurl = "curl"
+	// SourceFile reads the flat disk files from the datastores mounted on
+	// this host, such as over NFS
+	SourceFile = "file"
+)
+
+// DefaultDatastoreDir is where the datastores are mounted on ESXi hosts, the
+// same layout is expected for SourceFile by default
+const DefaultDatastoreDir = "/vmfs/volumes"
+
+var Sources = []string{SourceVddk, SourceSSH, SourceCurl, SourceFile}
+
+// source returns the nbdkit source of a disk of the snapshot
+func (s *NbdkitServers) source(ctx context.Context, disk *types.VirtualDisk) (nbdkit.Source, error) {
+	backing := disk.Backing.(types.BaseVirtualDeviceFileBackingInfo)
+	info := backing.GetVirtualDeviceFileBackingInfo()
+
+	switch s.VddkConfig.Source {
+	case SourceVddk, "":
+		password, _ := s.VddkConfig.Endpoint.User.Password()
+		return &nbdkit.VddkSource{
+			Server:         s.VddkConfig.Endpoint.Host,
+			Username:       s.VddkConfig.Endpoint.User.Username(),
+			Password:       password,
+			Thumbprint:     s.VddkConfig.Thumbprint,
+			VirtualMachine: s.VirtualMachine.Reference().Value,
+			Snapshot:       s.SnapshotRef.Value,
+			Filename:       info.FileName,
+			Compression:    s.VddkConfig.Compression,
+			Transports:     s.VddkConfig.Transports,
+			LibDir:         s.VddkConfig.LibDir,
+			NfcHostPort:    s.VddkConfig.NfcHostPort,
+			Cookie:         s.VddkConfig.Cookie,
+			Config:         s.VddkConfig.ConfigFile,
+		}, nil
+	case SourceSSH:
+		file, err := flatFile(disk)
+		if err != nil {
+			return nil, err
+		}
+
+		host, err := s.VirtualMachine.HostSystem(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		hostName, err := host.ObjectName(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return &nbdkit.SSHSource{
+			Host:       hostName,
+			User:       s.VddkConfig.SSHUser,
+			Identity:   s.VddkConfig.SSHIdentity,
+			KnownHosts: s.VddkConfig.SSHKnownHosts,
+			Path:       path.Join("/vmfs/volumes", file.Datastore, file.Path),
+		}, nil
+	case SourceCurl:
+		file, err := flatFile(disk)
+		if err != nil {
+			return nil, err
+		}
+
+		datacenter, err := s.datacenterPath(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		fileUrl := &url.URL{
+			Scheme: "https",
+			Host:   s.VddkConfig.Endpoint.Host,
+			Path:   path.Join("/folder", file.Path),
+			RawQuery: url.Values{
+				"dcPath": {datacenter},
+				"dsName": {file.Datastore},
+			}.Encode(),
+		}
+
+		password, _ := s.VddkConfig.Endpoint.User.Password()
+		return &nbdkit.CurlSource{
+			URL:      fileUrl.String(),
+			Username: s.VddkConfig.Endpoint.User.Username(),
+			Password: password,
+			CAInfo:   s.VddkConfig.CABundle,
+			Insecure: s.VddkConfig.Insecure,
+		}, nil
+	case SourceFile:
+		file, err := flatFile(disk)
+		if err != nil {
+			return nil, err
+		}
+
+		dir := s.VddkConfig.DatastoreDir
+		if dir == "" {
+			dir = DefaultDatastoreDir
+		}
+
+		return &nbdkit.FileSource{
+			Path: path.Join(dir, file.Datastore, file.Path),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown nbdkit source: %s", s.VddkConfig.Source)
+	}
+}
+
+// flatFile returns the datastore path of the flat extent of a disk, which is
+// only unchanged while the snapshot exists if the disk has no earlier
+// snapshots.
+func flatFile(disk *types.VirtualDisk) (*object.DatastorePath, error) {
+	backing, ok := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+	if !ok {
+		return nil, fmt.Errorf("disk %d is not a flat disk, only vddk can read it", disk.Key)
+	}
+
+	if backing.Parent != nil {
+		return nil, fmt.Errorf("disk %d has snapshots which were not taken by migratekit, only vddk can read it", disk.Key)
+	}
+
+	var file object.DatastorePath
+	if !file.FromString(backing.FileName) {
+		return nil, fmt.Errorf("invalid datastore path: %s", backing.FileName)
+	}
+
+	file.Path = strings.TrimSuffix(file.Path, ".vmdk") + "-flat.vmdk"
+
+	return &file, nil
+}
+
+// datacenterPath returns the inventory path of the datacenter of the virtual
+// machine, relative to the root folder.
+func (s *NbdkitServers) datacenterPath(ctx context.Context) (string, error) {
+	client := s.VirtualMachine.Client()
+	ancestors, err := mo.Ancestors(ctx, client, client.ServiceContent.PropertyCollector, s.VirtualMachine.Reference())
+	if err != nil {
+		return "", err
+	}
+
+	names := []string{}
+	for _, entity := range ancestors[1:] {
+		names = append(names, entity.Name)
+		if entity.Self.Type == "Datacenter" {
+			return strings.Join(names, "/"), nil
+		}
+	}
+
+	return "", fmt.Errorf("virtual machine %s is not in a datacenter", s.VirtualMachine.Name())
+}
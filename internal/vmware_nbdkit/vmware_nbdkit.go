@@ -2,56 +2,107 @@ package vmware_nbdkit
 
 import (
 	"context"
+	"errors"
 	"net/url"
-	"os"
-	"os/exec"
-	"os/signal"
-	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/vexxhost/migratekit/internal/nbdcopy"
+	"github.com/vexxhost/migratekit/internal/cleanup"
+	"github.com/vexxhost/migratekit/internal/machine"
+	"github.com/vexxhost/migratekit/internal/metrics"
 	"github.com/vexxhost/migratekit/internal/nbdkit"
 	"github.com/vexxhost/migratekit/internal/progress"
 	"github.com/vexxhost/migratekit/internal/target"
+	"github.com/vexxhost/migratekit/internal/throttle"
+	"github.com/vexxhost/migratekit/internal/v2v"
 	"github.com/vexxhost/migratekit/internal/vmware"
 	"github.com/vmware/govmomi/object"
-	"github.com/vmware/govmomi/vim25/methods"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
-	"libguestfs.org/libnbd"
 )
 
-const MaxChunkSize = 64 * 1024 * 1024
-
 type VddkConfig struct {
 	Debug       bool
 	Endpoint    *url.URL
 	Thumbprint  string
 	Compression nbdkit.CompressionMethod
+	Throttle    *throttle.Throttle
+
+	// Source is the nbdkit plugin the disks are read with, SourceVddk if
+	// empty
+	Source string
+
+	// VDDK tunables, the defaults of the nbdkit package are used if unset
+	Transports  []string
+	LibDir      string
+	NfcHostPort int
+	Cookie      string
+	ConfigFile  string
+
+	// SSH options for SourceSSH, the SSH agent is used if no identity is set
+	SSHUser       string
+	SSHIdentity   string
+	SSHKnownHosts string
+
+	// TLS options for SourceCurl
+	CABundle string
+	Insecure bool
+
+	// DatastoreDir is where the datastores are mounted for SourceFile, each
+	// in a directory named after it, DefaultDatastoreDir if empty
+	DatastoreDir string
 }
 
+// ProgressFunc is called as a disk is copied with the offset below which it
+// has been copied and the size of the disk.
+type ProgressFunc func(disk string, offset, size int64)
+
 type NbdkitServers struct {
 	VddkConfig     *VddkConfig
+	Config         *target.Config
 	VirtualMachine *object.VirtualMachine
 	SnapshotRef    types.ManagedObjectReference
+	Machine        *machine.VirtualMachine
+	Host           string
 	Servers        []*NbdkitServer
+
+	// NewNbdkit and NewTarget replace the VDDK nbdkit servers and the
+	// OpenStack volumes of the disks when set, which allows running migration
+	// cycles against simulated infrastructure.
+	NewNbdkit func(ctx context.Context, snapshot types.ManagedObjectReference, disk *types.VirtualDisk) (*nbdkit.NbdkitServer, error)
+	NewTarget func(ctx context.Context, vm *machine.VirtualMachine, disk *machine.Disk) (target.Target, error)
+
+	// OnProgress (if set) reports the progress of the copies of the disks
+	OnProgress ProgressFunc
+
+	// Undoes everything done by a migration cycle, in order: detaching the
+	// volumes, stopping the nbdkit servers and removing the snapshot
+	cleanup cleanup.Stack
 }
 
 type NbdkitServer struct {
-	Servers *NbdkitServers
-	Disk    *types.VirtualDisk
-	Nbdkit  *nbdkit.NbdkitServer
+	Servers      *NbdkitServers
+	Disk         *types.VirtualDisk
+	Nbdkit       *nbdkit.NbdkitServer
+	ChangedBytes int64
+	FullCopy     bool
 }
 
-func NewNbdkitServers(vddk *VddkConfig, vm *object.VirtualMachine) *NbdkitServers {
+func NewNbdkitServers(vddk *VddkConfig, config *target.Config, vm *object.VirtualMachine) *NbdkitServers {
 	return &NbdkitServers{
 		VddkConfig:     vddk,
+		Config:         config,
 		VirtualMachine: vm,
 		Servers:        []*NbdkitServer{},
 	}
 }
 
 func (s *NbdkitServers) createSnapshot(ctx context.Context) error {
+	start := time.Now()
+	defer func() {
+		metrics.SnapshotDuration.WithLabelValues(s.VirtualMachine.Name(), "create").Observe(time.Since(start).Seconds())
+	}()
+
 	task, err := s.VirtualMachine.CreateSnapshot(ctx, "migratekit", "Ephemeral snapshot for MigrateKit", false, false)
 	if err != nil {
 		return err
@@ -73,12 +124,36 @@ func (s *NbdkitServers) createSnapshot(ctx context.Context) error {
 	return nil
 }
 
+// Start creates the snapshot and starts an nbdkit server for every disk, Stop
+// must be called even if it fails to undo what was done.
 func (s *NbdkitServers) Start(ctx context.Context) error {
-	err := s.createSnapshot(ctx)
+	var err error
+	s.Machine, err = vmware.NewMachine(ctx, s.VirtualMachine)
 	if err != nil {
 		return err
 	}
 
+	err = s.createSnapshot(ctx)
+	if err != nil {
+		return metrics.Failure(s.VirtualMachine.Name(), metrics.PhaseSnapshotCreate, err)
+	}
+
+	s.cleanup.Push("remove snapshot", func(ctx context.Context) error {
+		return metrics.Failure(s.VirtualMachine.Name(), metrics.PhaseSnapshotRemove, s.removeSnapshot(ctx))
+	})
+
+	if s.VddkConfig.Throttle.Enabled() {
+		host, err := s.VirtualMachine.HostSystem(ctx)
+		if err != nil {
+			return err
+		}
+
+		s.Host, err = host.ObjectName(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
 	var snapshot mo.VirtualMachineSnapshot
 	err = s.VirtualMachine.Properties(ctx, s.SnapshotRef, []string{"config.hardware"}, &snapshot)
 	if err != nil {
@@ -88,28 +163,19 @@ func (s *NbdkitServers) Start(ctx context.Context) error {
 	for _, device := range snapshot.Config.Hardware.Device {
 		switch disk := device.(type) {
 		case *types.VirtualDisk:
-			backing := disk.Backing.(types.BaseVirtualDeviceFileBackingInfo)
-			info := backing.GetVirtualDeviceFileBackingInfo()
-
-			password, _ := s.VddkConfig.Endpoint.User.Password()
-			server, err := nbdkit.NewNbdkitBuilder().
-				Server(s.VddkConfig.Endpoint.Host).
-				Username(s.VddkConfig.Endpoint.User.Username()).
-				Password(password).
-				Thumbprint(s.VddkConfig.Thumbprint).
-				VirtualMachine(s.VirtualMachine.Reference().Value).
-				Snapshot(s.SnapshotRef.Value).
-				Filename(info.FileName).
-				Compression(s.VddkConfig.Compression).
-				Build()
+			server, err := s.newNbdkit(ctx, disk)
 			if err != nil {
-				return err
+				return metrics.Failure(s.VirtualMachine.Name(), metrics.PhaseNbdkitStart, err)
 			}
 
 			if err := server.Start(); err != nil {
-				return err
+				return metrics.Failure(s.VirtualMachine.Name(), metrics.PhaseNbdkitStart, err)
 			}
 
+			s.cleanup.Push("stop nbdkit server", func(ctx context.Context) error {
+				return server.Stop()
+			})
+
 			s.Servers = append(s.Servers, &NbdkitServer{
 				Servers: s,
 				Disk:    disk,
@@ -118,24 +184,41 @@ func (s *NbdkitServers) Start(ctx context.Context) error {
 		}
 	}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		log.Warn("Received interrupt signal, cleaning up...")
+	return nil
+}
 
-		err := s.Stop(ctx)
-		if err != nil {
-			log.WithError(err).Fatal("Failed to stop nbdkit servers")
-		}
+func (s *NbdkitServers) newNbdkit(ctx context.Context, disk *types.VirtualDisk) (*nbdkit.NbdkitServer, error) {
+	if s.NewNbdkit != nil {
+		return s.NewNbdkit(ctx, s.SnapshotRef, disk)
+	}
 
-		os.Exit(1)
-	}()
+	source, err := s.source(ctx, disk)
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
+	return nbdkit.NewNbdkitBuilder().
+		Source(source).
+		Throttle(s.VddkConfig.Throttle.Enabled()).
+		Build()
+}
+
+// newTarget returns the target of a disk of the snapshot, which carries the
+// change ID of the disk at the time of the snapshot.
+func (s *NbdkitServers) newTarget(ctx context.Context, disk *types.VirtualDisk) (target.Target, error) {
+	if s.NewTarget != nil {
+		return s.NewTarget(ctx, s.Machine, vmware.NewDisk(disk))
+	}
+
+	return target.NewOpenStack(ctx, s.Config, s.Machine, vmware.NewDisk(disk))
 }
 
 func (s *NbdkitServers) removeSnapshot(ctx context.Context) error {
+	start := time.Now()
+	defer func() {
+		metrics.SnapshotDuration.WithLabelValues(s.VirtualMachine.Name(), "remove").Observe(time.Since(start).Seconds())
+	}()
+
 	consolidate := true
 	task, err := s.VirtualMachine.RemoveSnapshot(ctx, s.SnapshotRef.Value, false, &consolidate)
 	if err != nil {
@@ -157,35 +240,66 @@ func (s *NbdkitServers) removeSnapshot(ctx context.Context) error {
 	return nil
 }
 
+// Stop runs the cleanups of the migration cycle, it also runs them if the
+// context was cancelled.
 func (s *NbdkitServers) Stop(ctx context.Context) error {
+	return s.cleanup.Run(ctx)
+}
+
+// ChangedBytes returns the amount of data copied for all disks during the
+// last migration cycle.
+func (s *NbdkitServers) ChangedBytes() int64 {
+	var changed int64
 	for _, server := range s.Servers {
-		if err := server.Nbdkit.Stop(); err != nil {
-			return err
-		}
+		changed += server.ChangedBytes
 	}
 
-	err := s.removeSnapshot(ctx)
-	if err != nil {
-		return err
+	return changed
+}
+
+// FullCopy returns true if any of the disks needed a full copy during the
+// last migration cycle.
+func (s *NbdkitServers) FullCopy() bool {
+	for _, server := range s.Servers {
+		if server.FullCopy {
+			return true
+		}
 	}
 
-	return nil
+	return false
 }
 
-func (s *NbdkitServers) MigrationCycle(ctx context.Context, runV2V bool) error {
-	err := s.Start(ctx)
-	if err != nil {
-		return err
-	}
+func (s *NbdkitServers) MigrationCycle(ctx context.Context, runV2V bool) (err error) {
+	start := time.Now()
 	defer func() {
-		err := s.Stop(ctx)
-		if err != nil {
-			log.WithError(err).Fatal("Failed to stop nbdkit servers")
+		duration := time.Since(start).Seconds()
+		metrics.CycleDuration.WithLabelValues(s.VirtualMachine.Name()).Observe(duration)
+		metrics.LastCycleDuration.WithLabelValues(s.VirtualMachine.Name()).Set(duration)
+	}()
+
+	defer func() {
+		if ctx.Err() != nil {
+			log.Warn("Migration cycle interrupted, cleaning up")
 		}
+
+		err = errors.Join(err, s.Stop(ctx))
 	}()
 
+	// Checked before the snapshot is created, the volumes are not needed
+	// when the disks are written elsewhere
+	if s.NewTarget == nil {
+		if err := s.Config.Validate(); err != nil {
+			return err
+		}
+	}
+
+	err = s.Start(ctx)
+	if err != nil {
+		return err
+	}
+
 	for index, server := range s.Servers {
-		t, err := target.NewOpenStack(ctx, s.VirtualMachine, server.Disk)
+		t, err := s.newTarget(ctx, server.Disk)
 		if err != nil {
 			return err
 		}
@@ -203,149 +317,95 @@ func (s *NbdkitServers) MigrationCycle(ctx context.Context, runV2V bool) error {
 	return nil
 }
 
-func (s *NbdkitServer) FullCopyToTarget(t target.Target, path string, targetIsClean bool) error {
-	logger := log.WithFields(log.Fields{
-		"vm":   s.Servers.VirtualMachine.Name(),
-		"disk": s.Disk.Backing.(types.BaseVirtualDeviceFileBackingInfo).GetVirtualDeviceFileBackingInfo().FileName,
-	})
-
-	logger.Info("Starting full copy")
+func (s *NbdkitServer) diskName() string {
+	return s.Disk.Backing.(types.BaseVirtualDeviceFileBackingInfo).GetVirtualDeviceFileBackingInfo().FileName
+}
 
-	err := nbdcopy.Run(
-		s.Nbdkit.LibNBDExportName(),
-		path,
-		s.Disk.CapacityInBytes,
-		targetIsClean,
-	)
+// needsFullCopy returns whether the disk needs a full copy, which is the case
+// unless the change ID recorded on the target comes from the same change
+// tracking session as the one of the snapshot, and whether the target is
+// known to be clean.
+func needsFullCopy(ctx context.Context, t target.Target) (bool, bool, error) {
+	exists, err := t.Exists(ctx)
 	if err != nil {
-		return err
+		return false, false, err
 	}
 
-	logger.Info("Full copy completed")
-
-	return nil
-}
-
-func (s *NbdkitServer) IncrementalCopyToTarget(ctx context.Context, t target.Target, path string) error {
-	logger := log.WithFields(log.Fields{
-		"vm":   s.Servers.VirtualMachine.Name(),
-		"disk": s.Disk.Backing.(types.BaseVirtualDeviceFileBackingInfo).GetVirtualDeviceFileBackingInfo().FileName,
-	})
+	if !exists {
+		log.Info("Data does not exist, full copy needed")
 
-	logger.Info("Starting incremental copy")
-
-	currentChangeId, err := t.GetCurrentChangeID(ctx)
-	if err != nil {
-		return err
+		return true, true, nil
 	}
 
-	handle, err := libnbd.Create()
+	value, err := t.GetCurrentChangeID(ctx)
 	if err != nil {
-		return err
+		return false, false, err
 	}
 
-	err = handle.ConnectUri(s.Nbdkit.LibNBDExportName())
+	currentChangeId, err := vmware.ParseChangeID(value)
 	if err != nil {
-		return err
+		log.Info("No or invalid change ID found, assuming full copy is needed")
+
+		return true, false, nil
 	}
 
-	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_EXCL|syscall.O_DIRECT, 0644)
+	snapshotChangeId, err := vmware.ParseChangeID(t.GetDisk().ChangeID)
 	if err != nil {
-		return err
+		return false, false, err
 	}
-	defer fd.Close()
-
-	startOffset := int64(0)
-	bar := progress.DataProgressBar("Incremental copy", s.Disk.CapacityInBytes)
-
-	for {
-		req := types.QueryChangedDiskAreas{
-			This:        s.Servers.VirtualMachine.Reference(),
-			Snapshot:    &s.Servers.SnapshotRef,
-			DeviceKey:   s.Disk.Key,
-			StartOffset: startOffset,
-			ChangeId:    currentChangeId.Value,
-		}
-
-		res, err := methods.QueryChangedDiskAreas(ctx, s.Servers.VirtualMachine.Client(), &req)
-		if err != nil {
-			return err
-		}
-
-		diskChangeInfo := res.Returnval
-
-		for _, area := range diskChangeInfo.ChangedArea {
-			for offset := area.Start; offset < area.Start+area.Length; {
-				chunkSize := area.Length - (offset - area.Start)
-				if chunkSize > MaxChunkSize {
-					chunkSize = MaxChunkSize
-				}
-
-				buf := make([]byte, chunkSize)
-				err = handle.Pread(buf, uint64(offset), nil)
-				if err != nil {
-					return err
-				}
 
-				_, err = fd.WriteAt(buf, offset)
-				if err != nil {
-					return err
-				}
+	if currentChangeId.UUID != snapshotChangeId.UUID {
+		log.WithFields(log.Fields{
+			"currentChangeId":  currentChangeId.Value,
+			"snapshotChangeId": snapshotChangeId.Value,
+		}).Warning("Change ID mismatch, full copy needed")
 
-				bar.Set64(offset + chunkSize)
-				offset += chunkSize
-			}
-		}
-
-		startOffset = diskChangeInfo.StartOffset + diskChangeInfo.Length
-		bar.Set64(startOffset)
-
-		if startOffset == s.Disk.CapacityInBytes {
-			break
-		}
+		return true, false, nil
 	}
 
-	return nil
+	log.Info("Starting incremental copy")
+
+	return false, false, nil
 }
 
-func (s *NbdkitServer) SyncToTarget(ctx context.Context, t target.Target, runV2V bool) error {
+func (s *NbdkitServer) SyncToTarget(ctx context.Context, t target.Target, runV2V bool) (err error) {
 	snapshotChangeId, err := vmware.GetChangeID(s.Disk)
 	if err != nil {
 		return err
 	}
 
-	needFullCopy, targetIsClean, err := target.NeedsFullCopy(ctx, t)
+	needFullCopy, targetIsClean, err := needsFullCopy(ctx, t)
 	if err != nil {
 		return err
 	}
 
+	// Pushed before connecting so that a partially attached volume is
+	// detached as well, the volume is detached once the disk is synced
+	disconnect := s.Servers.cleanup.Push("detach volume", t.Disconnect)
+	defer func() {
+		err = errors.Join(err, disconnect(ctx))
+	}()
+
 	err = t.Connect(ctx)
 	if err != nil {
-		return err
+		return metrics.Failure(s.Servers.VirtualMachine.Name(), metrics.PhaseTargetConnect, err)
 	}
-	defer t.Disconnect(ctx)
-
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		log.Warn("Received interrupt signal, cleaning up...")
-
-		err := t.Disconnect(ctx)
-		if err != nil {
-			log.WithError(err).Fatal("Failed to disconnect from target")
-		}
-
-		os.Exit(1)
-	}()
 
 	path, err := t.GetPath(ctx)
 	if err != nil {
 		return err
 	}
 
+	if s.Servers.VddkConfig.Throttle.Enabled() {
+		throttled, err := s.Servers.VddkConfig.Throttle.Start(ctx, s.Servers.Host, s.Nbdkit.RateFile())
+		if err != nil {
+			return err
+		}
+		defer throttled.Stop()
+	}
+
 	if needFullCopy {
-		err = s.FullCopyToTarget(t, path, targetIsClean)
+		err = s.FullCopyToTarget(ctx, t, path, targetIsClean)
 		if err != nil {
 			return err
 		}
@@ -359,31 +419,19 @@ func (s *NbdkitServer) SyncToTarget(ctx context.Context, t target.Target, runV2V
 	if runV2V {
 		log.Info("Running virt-v2v-in-place")
 
-		os.Setenv("LIBGUESTFS_BACKEND", "direct")
-
-		var cmd *exec.Cmd
-		if s.Servers.VddkConfig.Debug {
-			cmd = exec.Command("virt-v2v-in-place", "-v", "-x", "-i", "disk", path)
-		} else {
-			cmd = exec.Command("virt-v2v-in-place", "-i", "disk", path)
-		}
-
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-
-		err := cmd.Run()
+		err := v2v.InPlace(ctx, path, s.Servers.VddkConfig.Debug)
 		if err != nil {
-			return err
+			return metrics.Failure(s.Servers.VirtualMachine.Name(), metrics.PhaseV2V, err)
 		}
 
-		err = t.WriteChangeID(ctx, &vmware.ChangeID{})
+		err = t.WriteChangeID(ctx, "")
 		if err != nil {
-			return err
+			return metrics.Failure(s.Servers.VirtualMachine.Name(), metrics.PhaseChangeID, err)
 		}
 	} else {
-		err = t.WriteChangeID(ctx, snapshotChangeId)
+		err = t.WriteChangeID(ctx, snapshotChangeId.Value)
 		if err != nil {
-			return err
+			return metrics.Failure(s.Servers.VirtualMachine.Name(), metrics.PhaseChangeID, err)
 		}
 	}
 
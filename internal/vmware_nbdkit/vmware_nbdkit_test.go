@@ -0,0 +1,67 @@
+package vmware_nbdkit
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vexxhost/migratekit/internal/machine"
+	"github.com/vexxhost/migratekit/internal/target"
+)
+
+// changeIDTarget is a target which only records whether it exists and its
+// change ID, the other methods are not used to decide on a full copy.
+type changeIDTarget struct {
+	target.Target
+
+	disk     *machine.Disk
+	exists   bool
+	changeID string
+}
+
+func (t *changeIDTarget) GetDisk() *machine.Disk {
+	return t.disk
+}
+
+func (t *changeIDTarget) Exists(ctx context.Context) (bool, error) {
+	return t.exists, nil
+}
+
+func (t *changeIDTarget) GetCurrentChangeID(ctx context.Context) (string, error) {
+	return t.changeID, nil
+}
+
+func TestNeedsFullCopy(t *testing.T) {
+	const snapshotChangeID = "52 7b 1c 2d-4e 5f 6a 7b/12"
+
+	tests := []struct {
+		name          string
+		exists        bool
+		changeID      string
+		fullCopy      bool
+		targetIsClean bool
+	}{
+		{name: "missing target", fullCopy: true, targetIsClean: true},
+		{name: "no change ID", exists: true, fullCopy: true},
+		{name: "invalid change ID", exists: true, changeID: "invalid", fullCopy: true},
+		{name: "other change tracking session", exists: true, changeID: "52 00 00 00-00 00 00 00/12", fullCopy: true},
+		{name: "earlier change", exists: true, changeID: "52 7b 1c 2d-4e 5f 6a 7b/4"},
+		{name: "same change", exists: true, changeID: snapshotChangeID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fullCopy, targetIsClean, err := needsFullCopy(context.Background(), &changeIDTarget{
+				disk:     &machine.Disk{ChangeID: snapshotChangeID},
+				exists:   tt.exists,
+				changeID: tt.changeID,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fullCopy != tt.fullCopy || targetIsClean != tt.targetIsClean {
+				t.Errorf("full copy: %t, target is clean: %t, expected %t, %t", fullCopy, targetIsClean, tt.fullCopy, tt.targetIsClean)
+			}
+		})
+	}
+}
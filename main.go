@@ -2,30 +2,31 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
 	"errors"
-	"net/url"
+	"fmt"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/erikgeiser/promptkit/confirmation"
-	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/flavors"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/thediveo/enumflag/v2"
 	"github.com/vexxhost/migratekit/cmd"
+	"github.com/vexxhost/migratekit/internal/changerate"
+	"github.com/vexxhost/migratekit/internal/config"
+	"github.com/vexxhost/migratekit/internal/inventory"
+	"github.com/vexxhost/migratekit/internal/machine"
+	"github.com/vexxhost/migratekit/internal/metrics"
 	"github.com/vexxhost/migratekit/internal/nbdkit"
-	"github.com/vexxhost/migratekit/internal/openstack"
+	"github.com/vexxhost/migratekit/internal/secret"
 	"github.com/vexxhost/migratekit/internal/target"
-	"github.com/vexxhost/migratekit/internal/vmware"
 	"github.com/vexxhost/migratekit/internal/vmware_nbdkit"
-	"github.com/vmware/govmomi/find"
-	"github.com/vmware/govmomi/object"
-	"github.com/vmware/govmomi/session"
-	"github.com/vmware/govmomi/session/keepalive"
-	"github.com/vmware/govmomi/vim25"
-	"github.com/vmware/govmomi/vim25/mo"
-	"github.com/vmware/govmomi/vim25/soap"
-	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vexxhost/migratekit/pkg/migratekit"
 )
 
 type BusTypeOpts enumflag.Flag
@@ -61,7 +62,12 @@ var (
 	endpoint             string
 	username             string
 	password             string
+	passwordFile         string
+	passwordCommand      string
 	path                 string
+	caBundle             string
+	thumbprintPin        string
+	insecure             bool
 	compressionMethod    CompressionMethodOpts = Skipz
 	flavorId             string
 	networkMapping       cmd.NetworkMappingFlag
@@ -72,137 +78,393 @@ var (
 	busType              BusTypeOpts
 	vzUnsafeVolumeByName bool
 	osType               string
-    enableQemuGuestAgent bool
+	enableQemuGuestAgent bool
+	metricsListen        string
+	listenAddress        string
+	stateDir             string
+	apiTokenFile         string
+	tlsCertFile          string
+	tlsKeyFile           string
+	tlsClientCAFile      string
+	bandwidthLimit       string
+	bandwidthSchedule    []string
+	hostBandwidthLimit   string
+	throttleDir          string
+	osCloud              string
+	conversionOsCloud    string
+	attachMode           string
+	connectorIP          string
+	syncInterval         time.Duration
+	syncCycles           int
+	estimateWindow       int
+	forceUnlock          bool
+	nbdkitSource         string
+	vddkLibDir           string
+	vddkTransports       string
+	vddkNfcHostPort      int
+	vddkCookie           string
+	vddkConfigFile       string
+	sshUser              string
+	sshIdentity          string
+	sshKnownHosts        string
+	datastoreDir         string
+	importSource         string
+	importID             string
+	importName           string
+	importFirmware       string
+	importGuestOS        string
+	importMacAddresses   []string
+	copyOnly             bool
+	configFile           string
+	profile              string
+	inventoryFormat      string
+	inventoryOutput      string
+	inventoryDatacenter  string
+	selectFolder         string
+	selectResourcePool   string
+	selectCluster        string
+	selectTags           []string
+	selectTagCategories  []string
+	selectNameRegex      string
+	concurrency          int
 )
 
+// migrator is closed once the command has completed, whether it failed or
+// not, which releases the run lock of the virtual machine
+var migrator *migratekit.Migrator
+
+// options are the options of the migration built from the flags
+var options *migratekit.Options
+
 var rootCmd = &cobra.Command{
 	Use:   "migratekit",
 	Short: "Near-live migration toolkit for VMware to OpenStack",
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := applyProfile(cmd); err != nil {
+			return err
+		}
+
 		if debug {
 			log.SetLevel(log.DebugLevel)
 		}
 
-		endpointUrl := &url.URL{
-			Scheme: "https",
-			Host:   endpoint,
-			User:   url.UserPassword(username, password),
-			Path:   "sdk",
+		if metricsListen != "" {
+			if err := metrics.Serve(metricsListen); err != nil {
+				return err
+			}
 		}
 
-		var err error
+		ctx := cmd.Context()
 
-		// validBuses := []string{"scsi", "virtio"}
-		// if !slices.Contains(validBuses, busType) {
-		// 	log.Fatal("Invalid bus type: ", busType, ". Valid options are: ", validBuses)
-		// }
+		log.Info("Setting Disk Bus: ", BusTypeOptsIds[busType][0])
 
-		thumbprint, err := vmware.GetEndpointThumbprint(endpointUrl)
+		var err error
+		options, err = newOptions(ctx, cmd.Name())
 		if err != nil {
 			return err
 		}
 
-		ctx := context.TODO()
+		// The daemon resolves the virtual machine of every job on its own and
+		// the inventory covers all of them
+		if slices.Contains(endpointCommands, cmd.Name()) || selecting(cmd.Name()) {
+			return nil
+		}
+
+		migrator, err = migratekit.New(ctx, options)
+		return vmwareError(err)
+	},
+}
+
+// endpointCommands run against the whole VMware endpoint instead of a single
+// virtual machine
+var endpointCommands = []string{"serve", "inventory"}
+
+// selectorOptions builds the selector of the virtual machines to migrate
+// from the flags
+func selectorOptions() *migratekit.SelectorOptions {
+	return &migratekit.SelectorOptions{
+		Folder:        selectFolder,
+		ResourcePool:  selectResourcePool,
+		Cluster:       selectCluster,
+		Tags:          selectTags,
+		TagCategories: selectTagCategories,
+		NameRegex:     selectNameRegex,
+	}
+}
+
+// selecting returns true if the command migrates the virtual machines of
+// selectors instead of the one of the path
+func selecting(command string) bool {
+	return command == "migrate" && !selectorOptions().Empty()
+}
+
+// profileEnv are the environment variables which take precedence over an
+// option of a profile, like they do over the default of its flag
+var profileEnv = map[string]string{
+	"vmware-username":         "VMWARE_USERNAME",
+	"vmware-password":         "VMWARE_PASSWORD",
+	"vmware-password-file":    "VMWARE_PASSWORD",
+	"vmware-password-command": "VMWARE_PASSWORD",
+	"os-cloud":                "OS_CLOUD",
+}
+
+// profileExclusive are flags of which only one is used, none of them is set
+// from a profile if one was given on the command line
+var profileExclusive = [][]string{
+	{"vmware-password", "vmware-password-file", "vmware-password-command"},
+}
+
+// applyProfile sets the flags which were not given on the command line to
+// the options of the selected profile of the configuration file, the options
+// which belong to other commands are ignored.
+func applyProfile(cmd *cobra.Command) error {
+	path := configFile
+	if path == "" {
+		path = os.Getenv("MIGRATEKIT_CONFIG")
+	}
 
-		soapClient := soap.NewClient(endpointUrl, true)
-		vimClient, err := vim25.NewClient(ctx, soapClient)
+	name := profile
+	if name == "" {
+		name = os.Getenv("MIGRATEKIT_PROFILE")
+	}
+
+	if path == "" {
+		var err error
+		path, err = config.Find()
 		if err != nil {
-			log.WithError(err).Error("Failed to create VMware client")
 			return err
 		}
 
-		vimClient.RoundTripper = keepalive.NewHandlerSOAP(
-			vimClient.RoundTripper,
-			15*time.Second,
-			nil,
-		)
+		if path == "" {
+			if name != "" {
+				return fmt.Errorf("profile %s selected but no configuration file found in %s", name, strings.Join(config.DefaultPaths(), " or "))
+			}
 
-		mgr := session.NewManager(vimClient)
-		err = mgr.Login(ctx, endpointUrl.User)
-		if err != nil {
-			log.WithError(err).Error("Failed to login to VMware")
-			return err
+			return nil
 		}
+	}
+
+	file, err := config.Load(path)
+	if err != nil {
+		return err
+	}
 
-		finder := find.NewFinder(vimClient)
-		vm, err := finder.VirtualMachine(ctx, path)
+	if name == "" {
+		name = file.DefaultProfile
+	}
 
-		if err != nil {
-			switch err.(type) {
-			case *find.NotFoundError:
-				log.WithError(err).Error("Virtual machine not found, list of all virtual machines:")
+	if name == "" {
+		return nil
+	}
 
-				vms, err := finder.VirtualMachineList(ctx, "*")
-				if err != nil {
-					return err
-				}
+	opts, err := file.Profile(name)
+	if err != nil {
+		return fmt.Errorf("%w in %s", err, path)
+	}
 
-				for _, vm := range vms {
-					log.Info(" - ", vm.InventoryPath)
-				}
+	// Recorded before any flag is set from the profile
+	given := map[string]bool{}
+	for _, opt := range opts {
+		given[opt.Name] = cmd.Flags().Changed(opt.Name)
+	}
 
-				os.Exit(1)
-			default:
-				return err
+	for _, group := range profileExclusive {
+		if slices.ContainsFunc(group, cmd.Flags().Changed) {
+			for _, name := range group {
+				given[name] = true
 			}
 		}
+	}
 
-		var o mo.VirtualMachine
-		err = vm.Properties(ctx, vm.Reference(), []string{"config"}, &o)
-		if err != nil {
-			return err
+	for _, opt := range opts {
+		if opt.Name == "config" || opt.Name == "profile" {
+			return fmt.Errorf("%s can not be set in profile %s", opt.Name, name)
 		}
 
-		if o.Config.ChangeTrackingEnabled == nil || !*o.Config.ChangeTrackingEnabled {
-			return errors.New("change tracking is not enabled on the virtual machine")
-		}
+		if cmd.Flags().Lookup(opt.Name) == nil {
+			if !knownFlag(cmd.Root(), opt.Name) {
+				return fmt.Errorf("unknown option %s in profile %s", opt.Name, name)
+			}
 
-		if snapshotRef, _ := vm.FindSnapshot(ctx, "migratekit"); snapshotRef != nil {
-			log.Info("Snapshot already exists")
+			continue
+		}
 
-			input := confirmation.New("Delete existing snapshot?", confirmation.Undecided)
-			delete, err := input.RunPrompt()
-			if err != nil {
-				return err
-			}
+		if given[opt.Name] || os.Getenv(profileEnv[opt.Name]) != "" {
+			continue
+		}
 
-			if delete {
-				consolidate := true
-				_, err := vm.RemoveSnapshot(ctx, snapshotRef.Value, false, &consolidate)
-				if err != nil {
-					return err
-				}
-			} else {
-				return errors.New("unable to continue without deleting existing snapshot")
+		for _, value := range opt.Values {
+			if err := cmd.Flags().Set(opt.Name, value); err != nil {
+				return fmt.Errorf("invalid value of %s in profile %s: %w", opt.Name, name, err)
 			}
 		}
+	}
 
-		ctx = context.WithValue(ctx, "vm", vm)
-		ctx = context.WithValue(ctx, "vddkConfig", &vmware_nbdkit.VddkConfig{
-			Debug:       debug,
-			Endpoint:    endpointUrl,
-			Thumbprint:  thumbprint,
-			Compression: nbdkit.CompressionMethod(CompressionMethodOptsIds[compressionMethod][0]),
-		})
+	log.WithFields(log.Fields{
+		"config":  path,
+		"profile": name,
+	}).Info("Using profile")
 
-		log.Info("Setting Disk Bus: ", BusTypeOptsIds[busType][0])
-		v := target.VolumeCreateOpts{
-			AvailabilityZone: availabilityZone,
-			VolumeType:       volumeType,
-			BusType:          BusTypeOptsIds[busType][0],
+	return nil
+}
+
+// knownFlag returns true if any command has a flag with the name
+func knownFlag(root *cobra.Command, name string) bool {
+	if root.PersistentFlags().Lookup(name) != nil {
+		return true
+	}
+
+	return slices.ContainsFunc(root.Commands(), func(c *cobra.Command) bool {
+		return c.Flags().Lookup(name) != nil
+	})
+}
+
+// newOptions builds the options of the migration from the flags, the VMware
+// options are left out for imports
+func newOptions(ctx context.Context, command string) (*migratekit.Options, error) {
+	opts := &migratekit.Options{
+		OpenStack: migratekit.OpenStackOptions{
+			Cloud:                osCloud,
+			ConversionCloud:      conversionOsCloud,
+			AttachMode:           attachMode,
+			ConnectorIP:          connectorIP,
+			AvailabilityZone:     availabilityZone,
+			VolumeType:           volumeType,
+			BusType:              BusTypeOptsIds[busType][0],
+			OSType:               osType,
+			EnableQemuGuestAgent: enableQemuGuestAgent,
+			VzUnsafeVolumeByName: vzUnsafeVolumeByName,
+		},
+		Command: command,
+		Debug:   debug,
+	}
+
+	// Imports read the virtual machine from files instead of VMware
+	if command == "import" {
+		opts.Import = &migratekit.ImportOptions{
+			Source:       importSource,
+			ID:           importID,
+			Name:         importName,
+			Firmware:     importFirmware,
+			GuestOS:      importGuestOS,
+			MacAddresses: importMacAddresses,
 		}
-		ctx = context.WithValue(ctx, "volumeCreateOpts", &v)
 
-		ctx = context.WithValue(ctx, "vzUnsafeVolumeByName", vzUnsafeVolumeByName)
+		return opts, nil
+	}
+
+	if endpoint == "" {
+		return nil, errors.New("required flag(s) \"vmware-endpoint\" not set")
+	}
 
-		ctx = context.WithValue(ctx, "osType", osType)
+	if selecting(command) && path != "" {
+		return nil, errors.New("--vmware-path can not be combined with the selector flags")
+	}
 
-		ctx = context.WithValue(ctx, "enableQemuGuestAgent", enableQemuGuestAgent)
+	if !slices.Contains(endpointCommands, command) && !selecting(command) && path == "" {
+		return nil, errors.New("required flag(s) \"vmware-path\" not set")
+	}
 
-		cmd.SetContext(ctx)
+	vmwareUsername, err := (&secret.Source{
+		Name:  "VMware username",
+		Value: username,
+		Env:   "VMWARE_USERNAME",
+	}).Resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-		return nil
-	},
+	vmwarePassword, err := (&secret.Source{
+		Name:    "VMware password",
+		Value:   password,
+		File:    passwordFile,
+		Command: passwordCommand,
+		Env:     "VMWARE_PASSWORD",
+	}).Resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !slices.Contains(vmware_nbdkit.Sources, nbdkitSource) {
+		return nil, fmt.Errorf("invalid nbdkit source: %s, valid options are: %s", nbdkitSource, strings.Join(vmware_nbdkit.Sources, ", "))
+	}
+
+	// validBuses := []string{"scsi", "virtio"}
+	// if !slices.Contains(validBuses, busType) {
+	// 	log.Fatal("Invalid bus type: ", busType, ". Valid options are: ", validBuses)
+	// }
+
+	opts.VMware = &migratekit.VMwareOptions{
+		Endpoint:       endpoint,
+		Username:       vmwareUsername,
+		Password:       vmwarePassword,
+		Path:           path,
+		CABundle:       caBundle,
+		Thumbprint:     thumbprintPin,
+		Insecure:       insecure,
+		ForceUnlock:    forceUnlock,
+		RemoveSnapshot: confirmSnapshotRemoval,
+		Compression:    CompressionMethodOptsIds[compressionMethod][0],
+
+		Source:          nbdkitSource,
+		VddkLibDir:      vddkLibDir,
+		VddkTransports:  strings.Split(vddkTransports, ":"),
+		VddkNfcHostPort: vddkNfcHostPort,
+		VddkCookie:      vddkCookie,
+		VddkConfigFile:  vddkConfigFile,
+		SSHUser:         sshUser,
+		SSHIdentity:     sshIdentity,
+		SSHKnownHosts:   sshKnownHosts,
+		DatastoreDir:    datastoreDir,
+
+		BandwidthLimit:     bandwidthLimit,
+		BandwidthSchedule:  bandwidthSchedule,
+		HostBandwidthLimit: hostBandwidthLimit,
+		ThrottleDir:        throttleDir,
+	}
+
+	// Prompts of concurrent migrations would get mixed up, a snapshot left
+	// over fails the migration of its virtual machine instead
+	if selecting(command) {
+		opts.VMware.RemoveSnapshot = nil
+	}
+
+	return opts, nil
+}
+
+// confirmSnapshotRemoval asks whether the snapshot left over by an earlier
+// run can be removed
+func confirmSnapshotRemoval() (bool, error) {
+	input := confirmation.New("Delete existing snapshot?", confirmation.Undecided)
+	return input.RunPrompt()
+}
+
+// vmwareError points at the flags to trust the certificate of the VMware
+// endpoint with if it could not be verified
+func vmwareError(err error) error {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostnameErr) {
+		return fmt.Errorf("%w (use --vmware-ca-bundle or --vmware-thumbprint to trust the certificate)", err)
+	}
+
+	return err
+}
+
+// cutoverOptions builds the options of a cutover from the flags
+func cutoverOptions() *migratekit.CutoverOptions {
+	opts := &migratekit.CutoverOptions{
+		FlavorID:         flavorId,
+		SecurityGroups:   securityGroups,
+		AvailabilityZone: availabilityZone,
+		RunV2V:           enablev2v,
+	}
+
+	for _, mapping := range networkMapping.Mappings {
+		opts.NetworkMappings = append(opts.NetworkMappings, mapping)
+	}
+
+	return opts
 }
 
 var migrateCmd = &cobra.Command{
@@ -215,15 +477,15 @@ var migrateCmd = &cobra.Command{
 
 It handles the following additional cases as well:
 
-- If VMware indicates the change tracking has reset, it will do a full copy.`,
-	RunE: func(cmd *cobra.Command, args []string) error {
-		ctx := cmd.Context()
+- If VMware indicates the change tracking has reset, it will do a full copy.
 
-		vm := ctx.Value("vm").(*object.VirtualMachine)
-		vddkConfig := ctx.Value("vddkConfig").(*vmware_nbdkit.VddkConfig)
+Instead of a single virtual machine with --vmware-path, a wave of virtual machines can be selected by folder, resource pool, cluster, tag, tag category or name, they must match every selector which is given.  Their migration cycles run with a bounded concurrency and a summary is logged at the end.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if migrator == nil {
+			return migrateSelected(cmd.Context())
+		}
 
-		servers := vmware_nbdkit.NewNbdkitServers(vddkConfig, vm)
-		err := servers.MigrationCycle(ctx, false)
+		_, err := migrator.MigrationCycle(cmd.Context())
 		if err != nil {
 			return err
 		}
@@ -233,6 +495,134 @@ It handles the following additional cases as well:
 	},
 }
 
+// migrateSelected runs a migration cycle on every virtual machine matched by
+// the selectors
+func migrateSelected(ctx context.Context) error {
+	if concurrency < 1 {
+		return fmt.Errorf("invalid concurrency: %d, it must be at least 1", concurrency)
+	}
+
+	paths, err := migratekit.Select(ctx, options, selectorOptions())
+	if err != nil {
+		return vmwareError(err)
+	}
+
+	if len(paths) == 0 {
+		return errors.New("no virtual machines match the selectors")
+	}
+
+	for _, path := range paths {
+		log.WithFields(log.Fields{
+			"path": path,
+		}).Info("Selected virtual machine")
+	}
+
+	log.WithFields(log.Fields{
+		"vms":         len(paths),
+		"concurrency": concurrency,
+	}).Info("Starting migration cycles")
+
+	results := migratekit.MigrateAll(ctx, options, paths, concurrency)
+
+	var failed int
+	for _, result := range results {
+		logger := log.WithFields(log.Fields{
+			"path": result.Path,
+		})
+
+		if result.Err != nil {
+			failed++
+			logger.WithError(result.Err).Error("Migration failed")
+			continue
+		}
+
+		logger.WithFields(log.Fields{
+			"duration":      result.Cycle.Duration.Round(time.Second),
+			"changed_bytes": result.Cycle.ChangedBytes,
+			"full_copy":     result.Cycle.FullCopy,
+		}).Info("Migration completed")
+	}
+
+	log.WithFields(log.Fields{
+		"vms":       len(results),
+		"succeeded": len(results) - failed,
+		"failed":    failed,
+	}).Info("Migration summary")
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d migrations failed", failed, len(results))
+	}
+
+	return nil
+}
+
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Run migration cycles on an interval",
+	Long: `This command will keep running migration cycles on the virtual machine without shutting off the source virtual machine.
+
+After every cycle, the amount of changed data and the duration of the cycle are recorded and used to estimate the rate at which data changes on the source as well as the expected downtime of the final sync during a cutover.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+
+		history := changerate.NewHistory(estimateWindow)
+		ticker := time.NewTicker(syncInterval)
+		defer ticker.Stop()
+
+		for cycle := 1; syncCycles == 0 || cycle <= syncCycles; cycle++ {
+			logger := log.WithFields(log.Fields{
+				"vm":    migrator.Name(),
+				"cycle": cycle,
+			})
+
+			startedAt := time.Now()
+			result, err := migrator.MigrationCycle(ctx)
+			if err != nil {
+				logger.WithError(err).Error("Migration cycle failed")
+			} else {
+				history.Add(changerate.Cycle{
+					StartedAt:    startedAt,
+					Duration:     result.Duration,
+					ChangedBytes: result.ChangedBytes,
+					FullCopy:     result.FullCopy,
+				})
+				metrics.LastCycleChangedBytes.WithLabelValues(migrator.Name()).Set(float64(result.ChangedBytes))
+
+				fields := log.Fields{
+					"duration":      result.Duration.Round(time.Second),
+					"changed_bytes": result.ChangedBytes,
+					"full_copy":     result.FullCopy,
+				}
+
+				if rate, ok := history.ChangeRate(); ok {
+					fields["change_rate"] = fmt.Sprintf("%.0f B/s", rate)
+					metrics.ChangeRate.WithLabelValues(migrator.Name()).Set(rate)
+				}
+
+				if downtime, ok := history.EstimateCutover(syncInterval); ok {
+					fields["estimated_cutover_downtime"] = downtime.Round(time.Second)
+					metrics.EstimatedCutoverDowntime.WithLabelValues(migrator.Name()).Set(downtime.Seconds())
+				}
+
+				logger.WithFields(fields).Info("Migration cycle completed")
+			}
+
+			if syncCycles != 0 && cycle == syncCycles {
+				break
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+		}
+
+		log.Info("Sync completed")
+		return nil
+	},
+}
+
 var cutoverCmd = &cobra.Command{
 	Use:   "cutover",
 	Short: "Cutover to the new virtual machine",
@@ -243,105 +633,232 @@ var cutoverCmd = &cobra.Command{
 - Run a final migration cycle to capture missing changes & run virt-v2v-in-place
 - Spin up the new OpenStack virtual machine with the migrated disk`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		ctx := cmd.Context()
-
-		vm := ctx.Value("vm").(*object.VirtualMachine)
-		vddkConfig := ctx.Value("vddkConfig").(*vmware_nbdkit.VddkConfig)
-
-		clients, err := openstack.NewClientSet(ctx)
+		err := migrator.Cutover(cmd.Context(), cutoverOptions())
 		if err != nil {
 			return err
 		}
 
-		log.Info("Ensuring OpenStack resources exist")
+		return nil
+	},
+}
 
-		flavor, err := flavors.Get(ctx, clients.Compute, flavorId).Extract()
-		if err != nil {
-			return err
-		}
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import a virtual machine from exported files or disk images",
+	Long: `This command imports a virtual machine into OpenStack without a running hypervisor by executing the following steps:
 
-		log.WithFields(log.Fields{
-			"flavor": flavor.Name,
-		}).Info("Flavor exists, ensuring network resources exist")
+- Read the hardware of the virtual machine from the OVF descriptor, the VMX file or the libvirt domain XML
+- Copy every disk to a new volume & run virt-v2v-in-place
+- Spin up the new OpenStack virtual machine with the imported disks
+
+The source can be an OVA, an OVF descriptor or a VMX file with the disks next to it, a libvirt domain XML, a VHDX, VHD, qcow2 or raw disk image, or a directory containing one of those such as a Hyper-V export.
+
+Disk images do not describe the virtual machine, so its name, firmware, guest operating system and network adapters are taken from the flags instead.
 
-		v := openstack.PortCreateOpts{}
-		if len(securityGroups) > 0 {
-			v.SecurityGroups = &securityGroups
+Only the areas changed since an earlier import are copied for qcow2 images with an enabled dirty bitmap, which allows copying the disks ahead of time with --copy-only.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+
+		if copyOnly {
+			_, err := migrator.MigrationCycle(ctx)
+			if err != nil {
+				return err
+			}
+
+			log.Info("Disks copied, run the import again without --copy-only to complete it")
+			return nil
 		}
-		ctx = context.WithValue(ctx, "portCreateOpts", &v)
 
-		networks, err := clients.EnsurePortsForVirtualMachine(ctx, vm, &networkMapping)
+		err := migrator.Cutover(ctx, cutoverOptions())
 		if err != nil {
 			return err
 		}
 
-		log.Info("Starting migration cycle")
+		log.Info("Import completed")
+		return nil
+	},
+}
 
-		servers := vmware_nbdkit.NewNbdkitServers(vddkConfig, vm)
-		err = servers.MigrationCycle(ctx, false)
-		if err != nil {
-			return err
+var preflightCmd = &cobra.Command{
+	Use:   "preflight",
+	Short: "Check that a virtual machine can be migrated",
+	Long: `This command checks that the virtual machine can be migrated without changing anything:
+
+- The tools the disks are copied with are installed
+- OpenStack is reachable with the given credentials
+- The flavor exists & every network adapter has a network mapping, if they are given`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var opts *migratekit.CutoverOptions
+		if flavorId != "" || len(networkMapping.Mappings) > 0 {
+			opts = cutoverOptions()
 		}
 
-		log.Info("Completed migration cycle, shutting down source VM")
+		checks, err := migrator.Preflight(cmd.Context(), opts)
+		for _, check := range checks {
+			logger := log.WithFields(log.Fields{
+				"check": check.Name,
+			})
+
+			if check.Err != nil {
+				logger.WithError(check.Err).Error("Check failed")
+			} else {
+				logger.Info("Check passed")
+			}
+		}
 
-		powerState, err := vm.PowerState(ctx)
 		if err != nil {
-			return err
+			return errors.New("preflight checks failed")
 		}
 
-		if powerState == types.VirtualMachinePowerStatePoweredOff {
-			log.Warn("Source VM is already off, skipping shutdown")
-		} else {
-			err := vm.ShutdownGuest(ctx)
-			if err != nil {
-				return err
-			}
+		log.Info("Preflight checks passed")
+		return nil
+	},
+}
 
-			err = vm.WaitForPowerState(ctx, types.VirtualMachinePowerStatePoweredOff)
-			if err != nil {
-				return err
-			}
+var inventoryCmd = &cobra.Command{
+	Use:   "inventory",
+	Short: "Report the virtual machines of the VMware endpoint and whether they can be migrated",
+	Long: `This command walks every datacenter of the VMware endpoint and reports the following for each virtual machine, without changing anything:
+
+- Its location: inventory path, datacenter, cluster and host
+- Its power state, guest operating system, firmware, CPUs & memory
+- Whether change tracking is enabled & VMware Tools are running
+- Its snapshots, disks with their sizes & backing types and network adapters with their port groups
 
-			log.Info("Source VM shut down, starting final migration cycle")
+Every virtual machine gets a readiness verdict: 'ready' can be migrated as is, 'warning' can be migrated but its issues should be reviewed and 'blocked' can not be migrated until its issues are resolved.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !slices.Contains(inventory.Formats, inventoryFormat) {
+			return fmt.Errorf("invalid format: %s, valid options are: %s", inventoryFormat, strings.Join(inventory.Formats, ", "))
 		}
 
-		servers = vmware_nbdkit.NewNbdkitServers(vddkConfig, vm)
-		err = servers.MigrationCycle(ctx, enablev2v)
+		vms, err := migratekit.Inventory(cmd.Context(), options, &migratekit.InventoryOptions{
+			Datacenter: inventoryDatacenter,
+		})
 		if err != nil {
-			return err
+			return vmwareError(err)
 		}
 
-		log.Info("Final migration cycle completed, spinning up new OpenStack VM")
+		counts := map[migratekit.Verdict]int{}
+		for _, vm := range vms {
+			counts[vm.Verdict]++
+		}
 
-		err = clients.CreateResourcesForVirtualMachine(ctx, vm, flavorId, networks, availabilityZone)
+		log.WithFields(log.Fields{
+			"vms":     len(vms),
+			"ready":   counts[migratekit.VerdictReady],
+			"warning": counts[migratekit.VerdictWarning],
+			"blocked": counts[migratekit.VerdictBlocked],
+		}).Info("Inventory completed")
+
+		if inventoryOutput == "" {
+			return inventory.Write(os.Stdout, inventoryFormat, vms)
+		}
+
+		file, err := os.Create(inventoryOutput)
 		if err != nil {
 			return err
 		}
 
-		log.Info("Cutover completed")
+		err = inventory.Write(file, inventoryFormat, vms)
+		return errors.Join(err, file.Close())
+	},
+}
 
-		return nil
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run the migration daemon",
+	Long: `This command runs a daemon which exposes an HTTP API to create migration jobs, queue migration cycles, schedule cutovers and follow their progress.
+
+Jobs are persisted inside of the state directory and operations are executed one at a time.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		token, err := (&secret.Source{
+			Name: "API token",
+			File: apiTokenFile,
+			Env:  "MIGRATEKIT_API_TOKEN",
+		}).Resolve(cmd.Context())
+		if err != nil && !errors.Is(err, secret.ErrNotFound) {
+			return err
+		}
+
+		err = migratekit.Serve(cmd.Context(), options, &migratekit.ServeOptions{
+			Listen:       listenAddress,
+			StateDir:     stateDir,
+			Token:        token,
+			TLSCertFile:  tlsCertFile,
+			TLSKeyFile:   tlsKeyFile,
+			ClientCAFile: tlsClientCAFile,
+		})
+		return vmwareError(err)
 	},
 }
 
 func init() {
 	rootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "Enable debug logging")
 
-	rootCmd.PersistentFlags().StringVar(&endpoint, "vmware-endpoint", "", "VMware endpoint (hostname or IP only)")
-	rootCmd.MarkPersistentFlagRequired("vmware-endpoint")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "Configuration file with vCenters, clouds and profiles (or MIGRATEKIT_CONFIG environment variable), defaults to ~/.config/migratekit/config.yaml or /etc/migratekit/config.yaml")
+
+	rootCmd.PersistentFlags().StringVar(&profile, "profile", "", "Profile of the configuration file to take options from (or MIGRATEKIT_PROFILE environment variable), defaults to its default-profile")
 
-	rootCmd.PersistentFlags().StringVar(&username, "vmware-username", "", "VMware username")
-	rootCmd.MarkPersistentFlagRequired("vmware-username")
+	rootCmd.PersistentFlags().StringVar(&metricsListen, "metrics-listen", "", "Address to expose Prometheus metrics on (e.g. ':9090')")
 
-	rootCmd.PersistentFlags().StringVar(&password, "vmware-password", "", "VMware password")
-	rootCmd.MarkPersistentFlagRequired("vmware-password")
+	rootCmd.PersistentFlags().StringVar(&endpoint, "vmware-endpoint", "", "VMware endpoint (hostname or IP only), required for all commands except 'import'")
 
-	rootCmd.PersistentFlags().StringVar(&path, "vmware-path", "", "VMware VM path (e.g. '/Datacenter/vm/VM')")
-	rootCmd.MarkPersistentFlagRequired("vmware-path")
+	rootCmd.PersistentFlags().StringVar(&username, "vmware-username", "", "VMware username (or VMWARE_USERNAME environment variable)")
+
+	rootCmd.PersistentFlags().StringVar(&password, "vmware-password", "", "VMware password (or VMWARE_PASSWORD environment variable), prefer --vmware-password-file or --vmware-password-command since it is visible in the process list")
+
+	rootCmd.PersistentFlags().StringVar(&passwordFile, "vmware-password-file", "", "File to read the VMware password from")
+
+	rootCmd.PersistentFlags().StringVar(&passwordCommand, "vmware-password-command", "", "Command which prints the VMware password (e.g. 'vault kv get -field=password secret/vmware')")
+
+	rootCmd.PersistentFlags().StringVar(&caBundle, "vmware-ca-bundle", "", "PEM file with the CA certificates used to verify the VMware endpoint, the system CAs are used by default")
+
+	rootCmd.PersistentFlags().StringVar(&thumbprintPin, "vmware-thumbprint", "", "SHA-1 thumbprint that the certificate of the VMware endpoint must match (e.g. 'AA:BB:...')")
+
+	rootCmd.PersistentFlags().BoolVar(&insecure, "vmware-insecure", false, "Skip certificate verification of the VMware endpoint (insecure)")
+
+	rootCmd.PersistentFlags().StringVar(&path, "vmware-path", "", "VMware VM path (e.g. '/Datacenter/vm/VM'), required for all commands except 'serve', 'inventory' and 'migrate' with selectors")
+
+	rootCmd.PersistentFlags().BoolVar(&forceUnlock, "force-unlock", false, "Take over the run lock of the virtual machine, only use it if the run holding the lock is no longer running")
 
 	rootCmd.PersistentFlags().Var(enumflag.New(&compressionMethod, "compression-method", CompressionMethodOptsIds, enumflag.EnumCaseInsensitive), "compression-method", "Specifies the compression method to use for the disk")
 
+	rootCmd.PersistentFlags().StringVar(&nbdkitSource, "nbdkit-source", vmware_nbdkit.SourceVddk, "nbdkit plugin to read the disks with: 'vddk', 'ssh' to the ESXi host, 'curl' through the vCenter datastore browser or 'file' from datastores mounted on this host")
+
+	rootCmd.PersistentFlags().StringVar(&vddkLibDir, "vddk-libdir", nbdkit.DefaultVddkLibDir, "Directory the VDDK is installed in")
+
+	rootCmd.PersistentFlags().StringVar(&vddkTransports, "vddk-transports", strings.Join(nbdkit.DefaultVddkTransports, ":"), "Colon separated VDDK transport modes in the order they are tried")
+
+	rootCmd.PersistentFlags().IntVar(&vddkNfcHostPort, "vddk-nfc-host-port", 0, "Port of the NFC service of the ESXi hosts, if it is not the default one")
+
+	rootCmd.PersistentFlags().StringVar(&vddkCookie, "vddk-cookie", "", "Cookie of an existing vCenter session for VDDK to use instead of the username and password")
+
+	rootCmd.PersistentFlags().StringVar(&vddkConfigFile, "vddk-config", "", "VDDK configuration file with advanced settings")
+
+	rootCmd.PersistentFlags().StringVar(&sshUser, "ssh-user", "root", "User to connect to the ESXi hosts as with --nbdkit-source=ssh")
+
+	rootCmd.PersistentFlags().StringVar(&sshIdentity, "ssh-identity", "", "Private key to connect to the ESXi hosts with, the SSH agent is used if unset")
+
+	rootCmd.PersistentFlags().StringVar(&sshKnownHosts, "ssh-known-hosts", "", "Known hosts file to verify the ESXi hosts with")
+
+	rootCmd.PersistentFlags().StringVar(&datastoreDir, "datastore-dir", vmware_nbdkit.DefaultDatastoreDir, "Directory the datastores are mounted in, each named after the datastore, with --nbdkit-source=file")
+
+	rootCmd.PersistentFlags().StringVar(&bandwidthLimit, "bandwidth-limit", "", "Limit the rate at which disks are copied in bytes per second (e.g. '50M'), unlimited by default")
+
+	rootCmd.PersistentFlags().StringArrayVar(&bandwidthSchedule, "bandwidth-schedule", nil, "Limit the copy rate during a time of day window, overriding --bandwidth-limit (e.g. 'mon-fri 08:00-18:00=20M'), can be repeated")
+
+	rootCmd.PersistentFlags().StringVar(&hostBandwidthLimit, "host-bandwidth-limit", "", "Limit the aggregate copy rate of all migrations reading from the same ESXi host in bytes per second (e.g. '200M')")
+
+	rootCmd.PersistentFlags().StringVar(&throttleDir, "throttle-dir", "/run/migratekit/throttle", "Directory shared between migratekit processes to coordinate --host-bandwidth-limit")
+
+	rootCmd.PersistentFlags().StringVar(&osCloud, "os-cloud", "", "Cloud from clouds.yaml to use (or OS_CLOUD environment variable), the OS_* environment variables are used if unset")
+
+	rootCmd.PersistentFlags().StringVar(&conversionOsCloud, "conversion-os-cloud", "", "Cloud from clouds.yaml for the project of the conversion host, if it differs from the destination project")
+
+	rootCmd.PersistentFlags().StringVar(&attachMode, "attach-mode", target.AttachModeNova, "How volumes are attached to this host: 'nova' attaches them to the instance migratekit runs in, 'cinder' connects them over iSCSI or RBD without an instance")
+
+	rootCmd.PersistentFlags().StringVar(&connectorIP, "connector-ip", "", "IP address of this host passed to Cinder with --attach-mode=cinder, defaults to the address used to reach Cinder")
+
 	rootCmd.PersistentFlags().StringVar(&availabilityZone, "availability-zone", "", "Openstack availability zone for blockdevice & server")
 
 	rootCmd.PersistentFlags().StringVar(&volumeType, "volume-type", "", "Openstack volume type")
@@ -350,9 +867,9 @@ func init() {
 
 	rootCmd.PersistentFlags().BoolVar(&vzUnsafeVolumeByName, "vz-unsafe-volume-by-name", false, "Only use the name to find a volume - workaround for virtuozzu - dangerous option")
 
-    rootCmd.PersistentFlags().StringVar(&osType, "os-type", "", "Set os_type in the volume (image) metadata, (if set to \"auto\", it tries to detect the type from VMware GuestId)")
+	rootCmd.PersistentFlags().StringVar(&osType, "os-type", "", "Set os_type in the volume (image) metadata, (if set to \"auto\", it tries to detect the type from VMware GuestId)")
 
-    rootCmd.PersistentFlags().BoolVar(&enableQemuGuestAgent, "enable-qemu-guest-agent", false, "Sets the hw_qemu_guest_agent metadata parameter to yes")
+	rootCmd.PersistentFlags().BoolVar(&enableQemuGuestAgent, "enable-qemu-guest-agent", false, "Sets the hw_qemu_guest_agent metadata parameter to yes")
 
 	cutoverCmd.Flags().StringVar(&flavorId, "flavor", "", "OpenStack Flavor ID")
 	cutoverCmd.MarkFlagRequired("flavor")
@@ -367,12 +884,111 @@ func init() {
 	cutoverCmd.Flags().StringVar(&availabilityZone, "availability-zone", "", "OpenStack availability zone for blockdevice & server")
 	cutoverCmd.MarkFlagRequired("availability-zone")
 
+	importCmd.Flags().StringVar(&importSource, "source", "", "OVA, OVF, VMX, libvirt domain XML or disk image file to import, or a directory containing one")
+	importCmd.MarkFlagRequired("source")
+
+	importCmd.Flags().StringVar(&importID, "id", "", "ID to find the volumes of the virtual machine by, derived from the path of the source unless it has a unique ID such as a BIOS UUID, set it if the source is moved between imports")
+
+	importCmd.Flags().StringVar(&importName, "name", "", "Name of a virtual machine imported from disk images, defaults to the name of the image or directory")
+
+	importCmd.Flags().StringVar(&importFirmware, "firmware", string(machine.FirmwareBIOS), "Firmware of a virtual machine imported from disk images, 'bios' or 'efi' (Hyper-V generation 2 virtual machines use 'efi')")
+
+	importCmd.Flags().StringVar(&importGuestOS, "guest-os", "", "Guest operating system of a virtual machine imported from disk images, Linux is assumed unless it contains 'windows'")
+
+	importCmd.Flags().StringSliceVar(&importMacAddresses, "mac-addresses", nil, "MAC addresses of the network adapters of a virtual machine imported from disk images, comma separated, used with --network-mapping")
+
+	importCmd.Flags().BoolVar(&copyOnly, "copy-only", false, "Copy the disks without completing the import, a later import only copies the areas changed since for qcow2 images with a dirty bitmap")
+
+	importCmd.Flags().StringVar(&flavorId, "flavor", "", "OpenStack Flavor ID")
+	importCmd.MarkFlagRequired("flavor")
+
+	importCmd.Flags().Var(&networkMapping, "network-mapping", "Network mapping (e.g. 'mac=00:11:22:33:44:55,network-id=6bafb3d3-9d4d-4df1-86bb-bb7403403d24,subnet-id=47ed1da7-82d4-4e67-9bdd-5cb4993e06ff[,ip=1.2.3.4]')")
+
+	importCmd.Flags().StringSliceVar(&securityGroups, "security-groups", nil, "Openstack security groups, comma separated (e.g. '42c5a89e-4034-4f2a-adea-b33adc9614f4,6647122c-2d46-42f1-bb26-f38007730fdc')")
+
+	importCmd.Flags().BoolVar(&enablev2v, "run-v2v", true, "Run virt2v-inplace on destination VM")
+
+	importCmd.Flags().StringVar(&availabilityZone, "availability-zone", "", "OpenStack availability zone for blockdevice & server")
+	importCmd.MarkFlagRequired("availability-zone")
+
+	preflightCmd.Flags().StringVar(&flavorId, "flavor", "", "OpenStack Flavor ID to check")
+
+	preflightCmd.Flags().Var(&networkMapping, "network-mapping", "Network mapping to check (e.g. 'mac=00:11:22:33:44:55,network-id=6bafb3d3-9d4d-4df1-86bb-bb7403403d24,subnet-id=47ed1da7-82d4-4e67-9bdd-5cb4993e06ff[,ip=1.2.3.4]')")
+
+	preflightCmd.Flags().BoolVar(&enablev2v, "run-v2v", true, "Check that virt-v2v-in-place is installed")
+
+	migrateCmd.Flags().StringVar(&selectFolder, "vmware-folder", "", "Migrate the virtual machines of an inventory folder and its subfolders (e.g. '/Datacenter/vm/wave1') instead of --vmware-path")
+
+	migrateCmd.Flags().StringVar(&selectResourcePool, "vmware-resource-pool", "", "Migrate the virtual machines of a resource pool and its child pools (e.g. '/Datacenter/host/Cluster/Resources/wave1')")
+
+	migrateCmd.Flags().StringVar(&selectCluster, "vmware-cluster", "", "Migrate the virtual machines running on the hosts of a cluster (e.g. '/Datacenter/host/Cluster')")
+
+	migrateCmd.Flags().StringArrayVar(&selectTags, "vmware-tag", nil, "Migrate the virtual machines with a vSphere tag, optionally qualified with its category as 'category:tag', can be repeated to select any of the tags")
+
+	migrateCmd.Flags().StringArrayVar(&selectTagCategories, "vmware-tag-category", nil, "Migrate the virtual machines with any tag of a vSphere tag category, can be repeated")
+
+	migrateCmd.Flags().StringVar(&selectNameRegex, "vmware-name-regex", "", "Migrate the virtual machines whose name matches a regular expression (e.g. '^web-')")
+
+	migrateCmd.Flags().IntVar(&concurrency, "concurrency", 1, "Number of virtual machines selected with the selector flags to migrate at the same time")
+
+	syncCmd.Flags().DurationVar(&syncInterval, "interval", time.Hour, "Interval between the start of two migration cycles")
+
+	syncCmd.Flags().IntVar(&syncCycles, "cycles", 0, "Number of migration cycles to run before exiting (0 runs until interrupted)")
+
+	syncCmd.Flags().IntVar(&estimateWindow, "estimate-window", 6, "Number of recent cycles used to estimate the change rate and cutover downtime")
+
+	inventoryCmd.Flags().StringVar(&inventoryFormat, "format", inventory.FormatCSV, "Format of the report: 'csv' or 'json'")
+
+	inventoryCmd.Flags().StringVar(&inventoryOutput, "output", "", "File to write the report to, stdout by default")
+
+	inventoryCmd.Flags().StringVar(&inventoryDatacenter, "datacenter", "", "Only report the virtual machines of this datacenter")
+
+	serveCmd.Flags().StringVar(&listenAddress, "listen", "127.0.0.1:8080", "Address for the HTTP API to listen on, or a unix socket as 'unix:/run/migratekit.sock'")
+
+	serveCmd.Flags().StringVar(&apiTokenFile, "api-token-file", "", "File to read the bearer token which authenticates requests from (or MIGRATEKIT_API_TOKEN environment variable)")
+
+	serveCmd.Flags().StringVar(&tlsCertFile, "tls-cert", "", "Certificate to serve the HTTP API over TLS with")
+
+	serveCmd.Flags().StringVar(&tlsKeyFile, "tls-key", "", "Private key of the TLS certificate")
+
+	serveCmd.Flags().StringVar(&tlsClientCAFile, "tls-client-ca", "", "CA bundle to verify client certificates with, which authenticate requests instead of the token")
+
+	serveCmd.Flags().StringVar(&stateDir, "state-dir", "/var/lib/migratekit", "Directory to persist jobs and their logs in")
+
 	rootCmd.AddCommand(migrateCmd)
+	rootCmd.AddCommand(syncCmd)
 	rootCmd.AddCommand(cutoverCmd)
+	rootCmd.AddCommand(serveCmd)
+	rootCmd.AddCommand(importCmd)
+	rootCmd.AddCommand(preflightCmd)
+	rootCmd.AddCommand(inventoryCmd)
 }
 
 func main() {
-	if err := rootCmd.Execute(); err != nil {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+
+		// Restore the default behaviour so a second signal exits immediately
+		signal.Stop(signals)
+
+		log.Warn("Received interrupt signal, cleaning up (interrupt again to exit immediately)")
+		cancel()
+	}()
+
+	err := rootCmd.ExecuteContext(ctx)
+
+	if migrator != nil {
+		if err := migrator.Close(ctx); err != nil {
+			log.WithError(err).Warn("Failed to release run lock")
+		}
+	}
+
+	if err != nil {
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/vexxhost/migratekit/internal/harness"
+)
+
+// preRun parses the flags of a command and runs the persistent pre-run of
+// the root command for it, like executing the command would.  The flags and
+// the options are reset once the test is done.
+func preRun(t *testing.T, command *cobra.Command, args ...string) error {
+	t.Helper()
+
+	t.Cleanup(func() {
+		command.Flags().VisitAll(func(flag *pflag.Flag) {
+			if !flag.Changed {
+				return
+			}
+
+			if value, ok := flag.Value.(pflag.SliceValue); ok {
+				value.Replace(nil)
+			} else {
+				flag.Value.Set(flag.DefValue)
+			}
+			flag.Changed = false
+		})
+
+		if migrator != nil {
+			migrator.Close(context.Background())
+		}
+		migrator = nil
+		options = nil
+	})
+
+	for _, name := range []string{"MIGRATEKIT_CONFIG", "MIGRATEKIT_PROFILE", "VMWARE_USERNAME", "VMWARE_PASSWORD"} {
+		if _, ok := os.LookupEnv(name); !ok {
+			t.Setenv(name, "")
+		}
+	}
+
+	// No configuration file is looked up in the home directory of the user
+	t.Setenv("HOME", t.TempDir())
+
+	if err := command.ParseFlags(args); err != nil {
+		t.Fatal(err)
+	}
+
+	command.SetContext(context.Background())
+
+	return rootCmd.PersistentPreRunE(command, nil)
+}
+
+func TestPreRunRequiredFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		command *cobra.Command
+		args    []string
+		err     string
+	}{
+		{
+			name:    "endpoint",
+			command: migrateCmd,
+			args:    []string{"--vmware-path", "/DC0/vm/DC0_H0_VM0"},
+			err:     `"vmware-endpoint" not set`,
+		},
+		{
+			name:    "path",
+			command: migrateCmd,
+			args:    []string{"--vmware-endpoint", "vcenter.example.com"},
+			err:     `"vmware-path" not set`,
+		},
+		{
+			name:    "path with selectors",
+			command: migrateCmd,
+			args:    []string{"--vmware-endpoint", "vcenter.example.com", "--vmware-path", "/DC0/vm/DC0_H0_VM0", "--vmware-folder", "/DC0/vm"},
+			err:     "can not be combined with the selector flags",
+		},
+		{
+			name:    "credentials",
+			command: inventoryCmd,
+			args:    []string{"--vmware-endpoint", "vcenter.example.com"},
+			err:     "VMware username",
+		},
+		{
+			name:    "nbdkit source",
+			command: inventoryCmd,
+			args:    []string{"--vmware-endpoint", "vcenter.example.com", "--vmware-username", "user", "--vmware-password", "pass", "--nbdkit-source", "nfs"},
+			err:     "invalid nbdkit source",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := preRun(t, tt.command, tt.args...)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("pre-run failed with %v, expected %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestPreRunProfile(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(config, []byte(`
+default-profile: production
+
+vcenters:
+  vcenter-a:
+    vmware-endpoint: vcenter-a.example.com
+    vmware-username: profile@vsphere.local
+    vmware-password: profile
+
+clouds:
+  production:
+    volume-type: ssd
+    disk-bus-type: scsi
+
+profiles:
+  production:
+    vcenter: vcenter-a
+    cloud: production
+    availability-zone: nova
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The command line and the environment take precedence over the profile
+	t.Setenv("VMWARE_PASSWORD", "environment")
+
+	err = preRun(t, inventoryCmd, "--config", config, "--vmware-username", "flag@vsphere.local", "--availability-zone", "az1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if options.VMware.Endpoint != "vcenter-a.example.com" || options.OpenStack.VolumeType != "ssd" || options.OpenStack.BusType != "scsi" {
+		t.Errorf("options of the profile were not applied: %+v, %+v", options.VMware, options.OpenStack)
+	}
+
+	if options.VMware.Username != "flag@vsphere.local" || options.OpenStack.AvailabilityZone != "az1" {
+		t.Errorf("profile overrode the command line: %s, %s", options.VMware.Username, options.OpenStack.AvailabilityZone)
+	}
+
+	if options.VMware.Password != "environment" {
+		t.Errorf("profile overrode the environment, password is %q", options.VMware.Password)
+	}
+
+	if migrator != nil {
+		t.Error("inventory opened a virtual machine")
+	}
+}
+
+func TestPreRunVirtualMachine(t *testing.T) {
+	ctx := context.Background()
+
+	h, err := harness.New(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+
+	password, _ := h.VCenter.Server.URL.User.Password()
+
+	err = preRun(t, migrateCmd,
+		"--vmware-endpoint", h.VCenter.Server.URL.Host,
+		"--vmware-username", h.VCenter.Server.URL.User.Username(),
+		"--vmware-password", password,
+		"--vmware-insecure",
+		"--vmware-path", "/DC0/vm/DC0_H0_VM0",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if migrator == nil {
+		t.Fatal("virtual machine was not opened")
+	}
+}
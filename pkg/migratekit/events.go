@@ -0,0 +1,49 @@
+package migratekit
+
+import "time"
+
+type EventType string
+
+const (
+	EventCycleStarted     EventType = "cycle_started"
+	EventCycleCompleted   EventType = "cycle_completed"
+	EventCycleFailed      EventType = "cycle_failed"
+	EventCutoverStarted   EventType = "cutover_started"
+	EventCutoverCompleted EventType = "cutover_completed"
+	EventCutoverFailed    EventType = "cutover_failed"
+	EventPreflightCheck   EventType = "preflight_check"
+)
+
+type Event struct {
+	Type           EventType
+	Time           time.Time
+	VirtualMachine string
+
+	// Cycle is the result of a completed migration cycle
+	Cycle *CycleResult
+
+	// Check is the result of a preflight check
+	Check *Check
+
+	// Err is why the operation failed
+	Err error
+}
+
+type CycleResult struct {
+	Duration time.Duration
+
+	// ChangedBytes is the amount of data copied and FullCopy is true if any
+	// disk needed a full copy, both are only known for VMware
+	ChangedBytes int64
+	FullCopy     bool
+}
+
+func (m *Migrator) emit(event Event) {
+	if m.opts.OnEvent == nil {
+		return
+	}
+
+	event.Time = time.Now()
+	event.VirtualMachine = m.machine.Name
+	m.opts.OnEvent(event)
+}
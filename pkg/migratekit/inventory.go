@@ -0,0 +1,48 @@
+package migratekit
+
+import (
+	"context"
+	"errors"
+
+	"github.com/vexxhost/migratekit/internal/inventory"
+)
+
+// InventoryVirtualMachine is a virtual machine of the inventory with the
+// assessment of whether it can be migrated
+type InventoryVirtualMachine = inventory.VirtualMachine
+
+type Verdict = inventory.Verdict
+
+const (
+	VerdictReady   = inventory.VerdictReady
+	VerdictWarning = inventory.VerdictWarning
+	VerdictBlocked = inventory.VerdictBlocked
+)
+
+type InventoryOptions struct {
+	// Datacenter is the name of the only datacenter to walk, all of them are
+	// walked if it is empty
+	Datacenter string
+}
+
+// Inventory walks every datacenter of the VMware endpoint of the options,
+// whose path is not used, and assesses whether each of its virtual machines
+// can be migrated.  Nothing is changed on the virtual machines.
+func Inventory(ctx context.Context, opts *Options, inv *InventoryOptions) ([]*InventoryVirtualMachine, error) {
+	if opts.VMware == nil {
+		return nil, errors.New("VMware options are required")
+	}
+
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	client, _, err := connect(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return inventory.Collect(ctx, client, &inventory.Options{
+		Datacenter: inv.Datacenter,
+	})
+}
@@ -0,0 +1,470 @@
+// Package migratekit migrates virtual machines from VMware, or imports them
+// from exported files and disk images, into OpenStack.  It is what the
+// migratekit command is built on and allows embedding migrations in other
+// tools.
+//
+// A Migrator is opened for a single virtual machine, its migration cycles
+// copy the disks to volumes while the virtual machine keeps running and the
+// cutover creates the server on OpenStack:
+//
+//	m, err := migratekit.New(ctx, &migratekit.Options{
+//		VMware: &migratekit.VMwareOptions{
+//			Endpoint: "vcenter.example.com",
+//			Username: "administrator@vsphere.local",
+//			Password: password,
+//			Path:     "/Datacenter/vm/web01",
+//		},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer m.Close(ctx)
+//
+//	_, err = m.MigrationCycle(ctx)
+package migratekit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vexxhost/migratekit/internal/appliance"
+	"github.com/vexxhost/migratekit/internal/cutover"
+	"github.com/vexxhost/migratekit/internal/machine"
+	"github.com/vexxhost/migratekit/internal/nbdkit"
+	"github.com/vexxhost/migratekit/internal/openstack"
+	"github.com/vexxhost/migratekit/internal/source"
+	"github.com/vexxhost/migratekit/internal/target"
+	"github.com/vexxhost/migratekit/internal/throttle"
+	"github.com/vexxhost/migratekit/internal/vmware"
+	"github.com/vexxhost/migratekit/internal/vmware_nbdkit"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25"
+)
+
+var (
+	ErrNoSource        = errors.New("either VMware or import options are required")
+	ErrSnapshotExists  = errors.New("unable to continue without deleting existing snapshot")
+	ErrInvalidBusType  = errors.New("invalid disk bus type, valid options are: virtio, scsi")
+	ErrInvalidFirmware = errors.New("invalid firmware, valid options are: bios, efi")
+)
+
+// Migrator migrates a single virtual machine, it holds the run lock of a
+// VMware virtual machine until it is closed.
+type Migrator struct {
+	opts    *Options
+	config  *target.Config
+	machine *machine.VirtualMachine
+
+	client     *vim25.Client
+	vm         *object.VirtualMachine
+	vddkConfig *vmware_nbdkit.VddkConfig
+	lock       *vmware.Lock
+
+	appliance *appliance.Appliance
+}
+
+// New connects to VMware and finds the virtual machine, or reads the files
+// of the virtual machine to import.
+func New(ctx context.Context, opts *Options) (*Migrator, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	m := &Migrator{opts: opts, config: opts.config()}
+
+	if opts.Import != nil {
+		a, err := appliance.Open(ctx, opts.Import.Source, &appliance.Options{
+			ID:           opts.Import.ID,
+			Name:         opts.Import.Name,
+			Firmware:     machine.Firmware(opts.Import.Firmware),
+			GuestID:      opts.Import.GuestOS,
+			MacAddresses: opts.Import.MacAddresses,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		m.appliance = a
+		m.machine = a.VirtualMachine()
+
+		log.WithFields(log.Fields{
+			"vm":     m.machine.Name,
+			"disks":  len(m.machine.Disks),
+			"nics":   len(m.machine.NICs),
+			"cpus":   m.machine.CPUs,
+			"memory": m.machine.MemoryMB,
+		}).Info("Read virtual machine")
+
+		return m, nil
+	}
+
+	var err error
+	m.client, m.vddkConfig, err = connect(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.openVirtualMachine(ctx); err != nil {
+		m.Close(ctx)
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (o *Options) validate() error {
+	if (o.VMware == nil) == (o.Import == nil) {
+		return ErrNoSource
+	}
+
+	switch o.OpenStack.BusType {
+	case "", target.BusTypeVirtio, target.BusTypeSCSI:
+	default:
+		return ErrInvalidBusType
+	}
+
+	if err := o.config().Validate(); err != nil {
+		return err
+	}
+
+	if o.Import != nil {
+		switch machine.Firmware(o.Import.Firmware) {
+		case "", machine.FirmwareBIOS, machine.FirmwareEFI:
+		default:
+			return ErrInvalidFirmware
+		}
+	}
+
+	if o.VMware != nil {
+		if o.VMware.Endpoint == "" {
+			return errors.New("VMware endpoint is required")
+		}
+
+		if o.VMware.Source != "" && !slices.Contains(vmware_nbdkit.Sources, o.VMware.Source) {
+			return fmt.Errorf("invalid nbdkit source: %s", o.VMware.Source)
+		}
+
+		switch nbdkit.CompressionMethod(o.VMware.Compression) {
+		case "", nbdkit.NoCompression, nbdkit.ZlibCompression, nbdkit.FastLzCompression, nbdkit.SkipzCompression:
+		default:
+			return fmt.Errorf("invalid compression method: %s", o.VMware.Compression)
+		}
+	}
+
+	return nil
+}
+
+// config returns the configuration of the volumes, with the defaults of the
+// unset options
+func (o *Options) config() *target.Config {
+	config := &target.Config{
+		OpenStack: &openstack.Config{
+			Client: openstack.ClientOptions{
+				Cloud: o.OpenStack.Cloud,
+			},
+			VzUnsafeVolumeByName: o.OpenStack.VzUnsafeVolumeByName,
+		},
+		Volume: target.VolumeCreateOpts{
+			AvailabilityZone: o.OpenStack.AvailabilityZone,
+			VolumeType:       o.OpenStack.VolumeType,
+			BusType:          o.OpenStack.BusType,
+		},
+		Attach: target.AttachOpts{
+			Mode:        o.OpenStack.AttachMode,
+			ConnectorIP: o.OpenStack.ConnectorIP,
+		},
+		OSType:               o.OpenStack.OSType,
+		EnableQemuGuestAgent: o.OpenStack.EnableQemuGuestAgent,
+	}
+
+	if config.Volume.BusType == "" {
+		config.Volume.BusType = target.BusTypeVirtio
+	}
+
+	if config.Attach.Mode == "" {
+		config.Attach.Mode = target.AttachModeNova
+	}
+
+	if o.OpenStack.ConversionCloud != "" {
+		config.OpenStack.ConversionClient = &openstack.ClientOptions{
+			Cloud: o.OpenStack.ConversionCloud,
+		}
+	}
+
+	return config
+}
+
+// connect logs into VMware and returns the configuration the disks are read
+// with
+func connect(ctx context.Context, opts *Options) (*vim25.Client, *vmware_nbdkit.VddkConfig, error) {
+	o := opts.VMware
+
+	endpointUrl := &url.URL{
+		Scheme: "https",
+		Host:   o.Endpoint,
+		User:   url.UserPassword(o.Username, o.Password),
+		Path:   "sdk",
+	}
+
+	tlsOptions := &vmware.TLSOptions{
+		CABundle:   o.CABundle,
+		Thumbprint: o.Thumbprint,
+		Insecure:   o.Insecure,
+	}
+
+	if o.Insecure {
+		log.Warn("Certificate verification of the VMware endpoint is disabled")
+	}
+
+	thumbprint, err := vmware.GetEndpointThumbprint(endpointUrl, tlsOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	throttleConfig, err := o.throttle()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vimClient, err := vmware.NewClient(ctx, endpointUrl, tlsOptions)
+	if err != nil {
+		log.WithError(err).Error("Failed to connect to VMware")
+		return nil, nil, err
+	}
+
+	compression := nbdkit.SkipzCompression
+	if o.Compression != "" {
+		compression = nbdkit.CompressionMethod(o.Compression)
+	}
+
+	source := o.Source
+	if source == "" {
+		source = vmware_nbdkit.SourceVddk
+	}
+
+	return vimClient, &vmware_nbdkit.VddkConfig{
+		Debug:       opts.Debug,
+		Endpoint:    endpointUrl,
+		Thumbprint:  thumbprint,
+		Compression: compression,
+		Throttle:    throttleConfig,
+
+		Source:        source,
+		Transports:    o.VddkTransports,
+		LibDir:        o.VddkLibDir,
+		NfcHostPort:   o.VddkNfcHostPort,
+		Cookie:        o.VddkCookie,
+		ConfigFile:    o.VddkConfigFile,
+		SSHUser:       o.SSHUser,
+		SSHIdentity:   o.SSHIdentity,
+		SSHKnownHosts: o.SSHKnownHosts,
+		CABundle:      o.CABundle,
+		Insecure:      o.Insecure,
+		DatastoreDir:  o.DatastoreDir,
+	}, nil
+}
+
+func (o *VMwareOptions) throttle() (*throttle.Throttle, error) {
+	t := &throttle.Throttle{
+		Dir: o.ThrottleDir,
+	}
+
+	var err error
+	if o.BandwidthLimit != "" {
+		t.Schedule.Default, err = throttle.ParseRate(o.BandwidthLimit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, value := range o.BandwidthSchedule {
+		window, err := throttle.ParseWindow(value)
+		if err != nil {
+			return nil, err
+		}
+
+		t.Schedule.Windows = append(t.Schedule.Windows, window)
+	}
+
+	if o.HostBandwidthLimit != "" {
+		t.HostLimit, err = throttle.ParseRate(o.HostBandwidthLimit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// openVirtualMachine finds the virtual machine, takes its run lock and
+// removes the snapshot left over by an earlier run
+func (m *Migrator) openVirtualMachine(ctx context.Context) error {
+	o := m.opts.VMware
+	if o.Path == "" {
+		return errors.New("VMware path is required")
+	}
+
+	vm, err := vmware.FindVirtualMachine(ctx, m.client, o.Path)
+	if err != nil {
+		var notFound *find.NotFoundError
+		if errors.As(err, &notFound) {
+			return fmt.Errorf("%w, the inventory command lists the paths of all virtual machines", err)
+		}
+
+		return err
+	}
+
+	err = vmware.EnsureChangeTracking(ctx, vm)
+	if err != nil {
+		return err
+	}
+
+	command := m.opts.Command
+	if command == "" {
+		command = "migratekit"
+	}
+
+	m.lock, err = vmware.AcquireLock(ctx, vm, command, o.ForceUnlock)
+	if errors.Is(err, vmware.ErrLockNotUsable) {
+		log.Warn("Run locks are not supported by standalone ESXi hosts, make sure no other migratekit run uses this virtual machine")
+	} else if err != nil {
+		return err
+	}
+
+	if snapshotRef, _ := vm.FindSnapshot(ctx, "migratekit"); snapshotRef != nil {
+		log.Info("Snapshot already exists")
+
+		if o.RemoveSnapshot == nil {
+			return ErrSnapshotExists
+		}
+
+		remove, err := o.RemoveSnapshot()
+		if err != nil {
+			return err
+		}
+
+		if !remove {
+			return ErrSnapshotExists
+		}
+
+		consolidate := true
+		_, err = vm.RemoveSnapshot(ctx, snapshotRef.Value, false, &consolidate)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.vm = vm
+	m.machine, err = vmware.NewMachine(ctx, vm)
+	return err
+}
+
+// Close releases the run lock of the virtual machine.
+func (m *Migrator) Close(ctx context.Context) error {
+	var err error
+	if m.lock != nil {
+		err = m.lock.Release(context.WithoutCancel(ctx))
+		m.lock = nil
+	}
+
+	// Sessions are only ended by vCenter once they are idle for a while, so
+	// migrating a wave of virtual machines would pile them up otherwise
+	if m.client != nil {
+		err = errors.Join(err, vmware.Logout(context.WithoutCancel(ctx), m.client))
+		m.client = nil
+	}
+
+	return err
+}
+
+// guarded runs an operation against the VMware virtual machine, which is
+// interrupted if the run lock is lost in the meantime.
+func (m *Migrator) guarded(ctx context.Context, operation func(ctx context.Context) error) error {
+	ctx, cancel := m.lock.Guard(ctx)
+	defer cancel()
+
+	err := operation(ctx)
+	if cause := context.Cause(ctx); errors.Is(cause, vmware.ErrLockLost) {
+		err = errors.Join(err, cause)
+	}
+
+	return err
+}
+
+// MigrationCycle copies the disks of the virtual machine to their volumes
+// without shutting it down, only the changes since the last cycle are
+// copied if the source tracks them.
+func (m *Migrator) MigrationCycle(ctx context.Context) (*CycleResult, error) {
+	m.emit(Event{Type: EventCycleStarted})
+
+	start := time.Now()
+	result := &CycleResult{}
+
+	var err error
+	if m.appliance != nil {
+		err = source.MigrationCycle(ctx, m.config, m.appliance, false, m.opts.Debug)
+	} else {
+		servers := vmware_nbdkit.NewNbdkitServers(m.vddkConfig, m.config, m.vm)
+		err = m.guarded(ctx, func(ctx context.Context) error {
+			return servers.MigrationCycle(ctx, false)
+		})
+
+		result.ChangedBytes = servers.ChangedBytes()
+		result.FullCopy = servers.FullCopy()
+	}
+
+	if err != nil {
+		m.emit(Event{Type: EventCycleFailed, Err: err})
+		return nil, err
+	}
+
+	result.Duration = time.Since(start)
+	m.emit(Event{Type: EventCycleCompleted, Cycle: result})
+
+	return result, nil
+}
+
+// Cutover runs the final migration cycle and creates the server on
+// OpenStack.  A VMware virtual machine is shut down after a first cycle so
+// that the final one captures every change.
+func (m *Migrator) Cutover(ctx context.Context, opts *CutoverOptions) error {
+	m.emit(Event{Type: EventCutoverStarted})
+
+	cutoverOpts := &cutover.Options{
+		FlavorID:         opts.FlavorID,
+		NetworkMapping:   opts.networkMapping(),
+		SecurityGroups:   opts.SecurityGroups,
+		AvailabilityZone: opts.AvailabilityZone,
+		RunV2V:           opts.RunV2V,
+	}
+
+	var err error
+	if m.appliance != nil {
+		err = cutover.Complete(ctx, m.config.OpenStack, m.machine, cutoverOpts, func(ctx context.Context) error {
+			return source.MigrationCycle(ctx, m.config, m.appliance, opts.RunV2V, m.opts.Debug)
+		})
+	} else {
+		err = m.guarded(ctx, func(ctx context.Context) error {
+			return vmware_nbdkit.Cutover(ctx, m.vm, m.vddkConfig, m.config, cutoverOpts, nil)
+		})
+	}
+
+	if err != nil {
+		m.emit(Event{Type: EventCutoverFailed, Err: err})
+		return err
+	}
+
+	m.emit(Event{Type: EventCutoverCompleted})
+	return nil
+}
+
+// Name returns the name of the virtual machine
+func (m *Migrator) Name() string {
+	return m.machine.Name
+}
@@ -0,0 +1,170 @@
+package migratekit
+
+import (
+	"github.com/vexxhost/migratekit/cmd"
+)
+
+type Options struct {
+	// VMware is the virtual machine to migrate, Import is set instead to
+	// import a virtual machine from exported files or disk images
+	VMware *VMwareOptions
+	Import *ImportOptions
+
+	OpenStack OpenStackOptions
+
+	// Command describes what the virtual machine is migrated by in its run
+	// lock, such as the name of the command of a CLI
+	Command string
+
+	// Debug enables the debug output of nbdkit and virt-v2v
+	Debug bool
+
+	// OnEvent is called for every event of the migration, from the goroutine
+	// running the operation.  MigrateAll serializes its calls, other
+	// functions called from several goroutines with the same options do not.
+	OnEvent func(Event)
+}
+
+type VMwareOptions struct {
+	// Endpoint is the hostname or IP address of the vCenter or ESXi host
+	Endpoint string
+	Username string
+	Password string
+
+	// Path is the inventory path of the virtual machine, such as
+	// "/Datacenter/vm/VM"
+	Path string
+
+	// CABundle is a PEM file with the CA certificates used to verify the
+	// endpoint, the system CAs are used if empty.  Thumbprint pins the SHA-1
+	// thumbprint of its certificate instead.
+	CABundle   string
+	Thumbprint string
+	Insecure   bool
+
+	// ForceUnlock takes over the run lock of the virtual machine
+	ForceUnlock bool
+
+	// RemoveSnapshot is called if a snapshot left over by an earlier run
+	// exists, it is removed if true is returned.  The migration can not
+	// continue otherwise, which is also the case if it is nil.
+	RemoveSnapshot func() (bool, error)
+
+	// Compression is the compression method of VDDK, "skipz" if empty
+	Compression string
+
+	// Source is the nbdkit plugin the disks are read with, "vddk" if empty
+	Source string
+
+	// VDDK tunables, the defaults of nbdkit are used if unset
+	VddkLibDir      string
+	VddkTransports  []string
+	VddkNfcHostPort int
+	VddkCookie      string
+	VddkConfigFile  string
+
+	// SSH options of the "ssh" source, the user migratekit runs as is used if
+	// no user is set and the SSH agent if no identity is set
+	SSHUser       string
+	SSHIdentity   string
+	SSHKnownHosts string
+
+	// DatastoreDir is where the datastores are mounted for the "file"
+	// source, each in a directory named after it, "/vmfs/volumes" if empty
+	DatastoreDir string
+
+	// BandwidthLimit limits the rate disks are copied at (e.g. "50M"), it is
+	// overridden during the windows of the BandwidthSchedule (e.g.
+	// "mon-fri 08:00-18:00=20M").  HostBandwidthLimit limits the aggregate
+	// rate of all migrations reading from the same ESXi host, which are
+	// coordinated through ThrottleDir.
+	BandwidthLimit     string
+	BandwidthSchedule  []string
+	HostBandwidthLimit string
+	ThrottleDir        string
+}
+
+type ImportOptions struct {
+	// Source is an OVA, OVF, VMX, libvirt domain XML or disk image file, or a
+	// directory containing one
+	Source string
+
+	// ID identifies the virtual machine in the metadata of its volumes, it
+	// is derived from the path of the source if empty and the source has
+	// no unique ID of its own
+	ID string
+
+	// Hardware of a virtual machine imported from disk images, which do not
+	// describe it
+	Name         string
+	Firmware     string
+	GuestOS      string
+	MacAddresses []string
+}
+
+type OpenStackOptions struct {
+	// Cloud is the cloud from clouds.yaml to use, the OS_* environment
+	// variables are used if empty.  ConversionCloud is the cloud of the
+	// project of the conversion host, if it differs from the destination.
+	Cloud           string
+	ConversionCloud string
+
+	// AttachMode is how volumes are attached to this host, "nova" if empty
+	AttachMode  string
+	ConnectorIP string
+
+	AvailabilityZone string
+	VolumeType       string
+
+	// BusType is the disk bus of the volumes, "virtio" if empty
+	BusType string
+
+	// OSType is set as the os_type of the volumes, "auto" detects it from
+	// the guest operating system
+	OSType               string
+	EnableQemuGuestAgent bool
+
+	// VzUnsafeVolumeByName only uses the name to find volumes, which is a
+	// dangerous workaround for Virtuozzo
+	VzUnsafeVolumeByName bool
+}
+
+type CutoverOptions struct {
+	FlavorID         string
+	NetworkMappings  []NetworkMapping
+	SecurityGroups   []string
+	AvailabilityZone string
+	RunV2V           bool
+}
+
+// NetworkMapping maps the network adapter with a MAC address to a network
+// and subnet, with an optional fixed IP address
+type NetworkMapping = cmd.NetworkMapping
+
+// ParseNetworkMapping parses a network mapping in the format of the
+// --network-mapping flag, such as
+// "mac=00:11:22:33:44:55,network-id=<uuid>,subnet-id=<uuid>[,ip=1.2.3.4]"
+func ParseNetworkMapping(value string) (NetworkMapping, error) {
+	var flag cmd.NetworkMappingFlag
+	if err := flag.Set(value); err != nil {
+		return NetworkMapping{}, err
+	}
+
+	for _, mapping := range flag.Mappings {
+		return mapping, nil
+	}
+
+	return NetworkMapping{}, nil
+}
+
+func (o *CutoverOptions) networkMapping() *cmd.NetworkMappingFlag {
+	flag := &cmd.NetworkMappingFlag{
+		Mappings: map[string]cmd.NetworkMapping{},
+	}
+
+	for _, mapping := range o.NetworkMappings {
+		flag.Mappings[mapping.MACAddr.String()] = mapping
+	}
+
+	return flag
+}
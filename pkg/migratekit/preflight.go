@@ -0,0 +1,113 @@
+package migratekit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/flavors"
+	"github.com/vexxhost/migratekit/internal/nbdkit"
+	"github.com/vexxhost/migratekit/internal/openstack"
+	"github.com/vexxhost/migratekit/internal/vmware_nbdkit"
+)
+
+// Check is the result of a preflight check, Err is nil if it passed
+type Check struct {
+	Name string
+	Err  error
+}
+
+// Preflight checks that the virtual machine can be migrated without changing
+// anything: the tools the disks are copied with are installed and OpenStack
+// is reachable.  The flavor and the network mappings are checked as well if
+// cutover options are given.  An error joining the failed checks is returned
+// if any failed.
+func (m *Migrator) Preflight(ctx context.Context, opts *CutoverOptions) ([]Check, error) {
+	var checks []Check
+	check := func(name string, err error) {
+		c := Check{Name: name, Err: err}
+		checks = append(checks, c)
+		m.emit(Event{Type: EventPreflightCheck, Check: &c})
+	}
+
+	check("tools", m.checkTools(opts))
+
+	if m.vddkConfig != nil && m.vddkConfig.Source == vmware_nbdkit.SourceVddk {
+		check("vddk", checkVddk(m.vddkConfig.LibDir))
+	}
+
+	clients, err := openstack.NewClientSet(ctx, m.config.OpenStack)
+	if err == nil {
+		_, err = openstack.NewConversionClientSet(ctx, m.config.OpenStack)
+	}
+	check("openstack", err)
+
+	if opts != nil && clients != nil {
+		_, err := flavors.Get(ctx, clients.Compute, opts.FlavorID).Extract()
+		check("flavor", err)
+	}
+
+	if opts != nil {
+		check("network-mapping", m.checkNetworkMapping(opts))
+	}
+
+	var failed []error
+	for _, c := range checks {
+		if c.Err != nil {
+			failed = append(failed, fmt.Errorf("%s: %w", c.Name, c.Err))
+		}
+	}
+
+	return checks, errors.Join(failed...)
+}
+
+// checkTools checks that the commands the migration runs are installed
+func (m *Migrator) checkTools(opts *CutoverOptions) error {
+	commands := []string{"nbdkit"}
+	if m.appliance != nil {
+		commands = append(commands, "qemu-img", "qemu-nbd")
+	}
+
+	if opts != nil && opts.RunV2V {
+		commands = append(commands, "virt-v2v-in-place")
+	}
+
+	var missing []error
+	for _, command := range commands {
+		if _, err := exec.LookPath(command); err != nil {
+			missing = append(missing, err)
+		}
+	}
+
+	return errors.Join(missing...)
+}
+
+func checkVddk(libDir string) error {
+	if libDir == "" {
+		libDir = nbdkit.DefaultVddkLibDir
+	}
+
+	_, err := os.Stat(libDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("VDDK is not installed in %s", libDir)
+	}
+
+	return err
+}
+
+// checkNetworkMapping checks that every network adapter is mapped to a
+// network
+func (m *Migrator) checkNetworkMapping(opts *CutoverOptions) error {
+	mapping := opts.networkMapping()
+
+	var missing []error
+	for _, nic := range m.machine.NICs {
+		if _, ok := mapping.Mappings[nic.MacAddress]; !ok {
+			missing = append(missing, fmt.Errorf("no network mapping found for MAC address %s", nic.MacAddress))
+		}
+	}
+
+	return errors.Join(missing...)
+}
@@ -0,0 +1,179 @@
+package migratekit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sync"
+
+	"github.com/vexxhost/migratekit/internal/progress"
+	"github.com/vexxhost/migratekit/internal/vmware"
+)
+
+// SelectorOptions select virtual machines by where they are in the inventory,
+// by their tags and by their name.  The virtual machines must match every
+// option which is set.
+type SelectorOptions struct {
+	// Folder is the inventory path of a folder, such as
+	// "/Datacenter/vm/wave1", whose virtual machines are selected including
+	// the ones of its subfolders
+	Folder string
+
+	// ResourcePool is the inventory path of a resource pool whose virtual
+	// machines are selected, including the ones of its child pools
+	ResourcePool string
+
+	// Cluster is the inventory path of a cluster whose hosts the selected
+	// virtual machines run on
+	Cluster string
+
+	// Tags select the virtual machines with any of the tags, a tag can be
+	// qualified with its category as "category:tag"
+	Tags []string
+
+	// TagCategories select the virtual machines with any tag of any of the
+	// categories
+	TagCategories []string
+
+	// NameRegex is a regular expression the name of the selected virtual
+	// machines matches
+	NameRegex string
+}
+
+// Empty returns true if no option is set
+func (o *SelectorOptions) Empty() bool {
+	return o.Folder == "" && o.ResourcePool == "" && o.Cluster == "" &&
+		len(o.Tags) == 0 && len(o.TagCategories) == 0 && o.NameRegex == ""
+}
+
+// Select returns the inventory paths of the virtual machines of the VMware
+// endpoint of the options matched by the selector, the path of the options
+// is not used.
+func Select(ctx context.Context, opts *Options, sel *SelectorOptions) ([]string, error) {
+	if opts.VMware == nil {
+		return nil, errors.New("VMware options are required")
+	}
+
+	if sel.Empty() {
+		return nil, errors.New("at least one selector is required")
+	}
+
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	selector := &vmware.Selector{
+		Folder:        sel.Folder,
+		ResourcePool:  sel.ResourcePool,
+		Cluster:       sel.Cluster,
+		Tags:          sel.Tags,
+		TagCategories: sel.TagCategories,
+	}
+
+	if sel.NameRegex != "" {
+		var err error
+		selector.Name, err = regexp.Compile(sel.NameRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name regular expression: %w", err)
+		}
+	}
+
+	client, _, err := connect(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer vmware.Logout(context.WithoutCancel(ctx), client)
+
+	vms, err := selector.Select(ctx, client, url.UserPassword(opts.VMware.Username, opts.VMware.Password))
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, len(vms))
+	for i, vm := range vms {
+		paths[i] = vm.InventoryPath
+	}
+
+	return paths, nil
+}
+
+// MigrationResult is the outcome of the migration cycle of one of several
+// virtual machines, Cycle is nil if it failed
+type MigrationResult struct {
+	Path  string
+	Cycle *CycleResult
+	Err   error
+}
+
+// MigrateAll runs a migration cycle on every virtual machine of the paths,
+// with at most concurrency of them at the same time.  Every virtual machine
+// is opened with the options and its path, a failure does not stop the
+// others.  The results are in the order of the paths.  The calls of OnEvent
+// are serialized, and the progress bars are hidden while several virtual
+// machines are migrated at the same time.
+func MigrateAll(ctx context.Context, opts *Options, paths []string, concurrency int) []MigrationResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	if concurrency > 1 && len(paths) > 1 {
+		defer progress.Hide()()
+	}
+
+	o := *opts
+	if opts.OnEvent != nil {
+		var mu sync.Mutex
+		o.OnEvent = func(event Event) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			opts.OnEvent(event)
+		}
+	}
+
+	results := make([]MigrationResult, len(paths))
+	slots := make(chan struct{}, concurrency)
+
+	// Slots are taken in order so that the virtual machines are started in
+	// the order of the paths
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		results[i].Path = path
+
+		select {
+		case <-ctx.Done():
+			results[i].Err = ctx.Err()
+			continue
+		case slots <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			results[i].Cycle, results[i].Err = migrateOne(ctx, &o, path)
+		}()
+	}
+
+	wg.Wait()
+	return results
+}
+
+func migrateOne(ctx context.Context, opts *Options, path string) (*CycleResult, error) {
+	vmwareOpts := *opts.VMware
+	vmwareOpts.Path = path
+
+	o := *opts
+	o.VMware = &vmwareOpts
+
+	m, err := New(ctx, &o)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := m.MigrationCycle(ctx)
+	return result, errors.Join(err, m.Close(ctx))
+}
@@ -0,0 +1,178 @@
+package migratekit
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vexxhost/migratekit/internal/daemon"
+)
+
+type ServeOptions struct {
+	// Listen is the address of the HTTP API, or the path of a unix socket
+	// prefixed with "unix:"
+	Listen string
+
+	// StateDir is where jobs and their logs are persisted
+	StateDir string
+
+	// Token authenticates the requests as a bearer token
+	Token string
+
+	// TLSCertFile and TLSKeyFile serve the HTTP API over TLS
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// ClientCAFile is the CA bundle which verifies the certificates of
+	// clients, they authenticate the requests instead of the token
+	ClientCAFile string
+}
+
+func (s *ServeOptions) validate() error {
+	if s.Token == "" && s.ClientCAFile == "" {
+		return errors.New("an API token or a client CA is required to authenticate requests")
+	}
+
+	if (s.TLSCertFile == "") != (s.TLSKeyFile == "") {
+		return errors.New("both the TLS certificate and key are required")
+	}
+
+	if s.ClientCAFile != "" && s.TLSCertFile == "" {
+		return errors.New("a TLS certificate and key are required to verify client certificates")
+	}
+
+	return nil
+}
+
+// listen listens on a unix socket which only the user can connect to if the
+// address is prefixed with "unix:", otherwise on a TCP address.
+func (s *ServeOptions) listen() (net.Listener, error) {
+	path, ok := strings.CutPrefix(s.Listen, "unix:")
+	if !ok {
+		return net.Listen("tcp", s.Listen)
+	}
+
+	// A socket is left behind if the daemon did not stop cleanly
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+func (s *ServeOptions) tlsConfig() (*tls.Config, error) {
+	if s.ClientCAFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(s.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", s.ClientCAFile)
+	}
+
+	// Clients without a certificate can still authenticate with the token
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}, nil
+}
+
+// Serve runs the migration daemon until the context is cancelled, which
+// shuts it down cleanly and returns nil.  It migrates the virtual machines of
+// its jobs from the VMware endpoint of the options, whose path is not used.
+func Serve(ctx context.Context, opts *Options, serve *ServeOptions) error {
+	if opts.VMware == nil {
+		return errors.New("VMware options are required")
+	}
+
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	if err := serve.validate(); err != nil {
+		return err
+	}
+
+	tlsConfig, err := serve.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	vimClient, vddkConfig, err := connect(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	store, err := daemon.OpenStore(serve.StateDir)
+	if err != nil {
+		return err
+	}
+
+	manager := daemon.NewManager(ctx, vimClient, vddkConfig, opts.config(), store)
+	if err := manager.Recover(); err != nil {
+		return err
+	}
+
+	// The running operation is cancelled and cleans up before returning
+	stopped := make(chan struct{})
+	go func() {
+		manager.Run(ctx)
+		close(stopped)
+	}()
+
+	listener, err := serve.listen()
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:   daemon.NewServer(manager, serve.Token),
+		TLSConfig: tlsConfig,
+	}
+
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.WithoutCancel(ctx))
+	}()
+
+	log.WithFields(log.Fields{
+		"address":   serve.Listen,
+		"state_dir": serve.StateDir,
+		"tls":       serve.TLSCertFile != "",
+	}).Info("Starting migration daemon")
+
+	if serve.TLSCertFile != "" {
+		err = server.ServeTLS(listener, serve.TLSCertFile, serve.TLSKeyFile)
+	} else {
+		err = server.Serve(listener)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	// Cancelling the context is how the daemon is shut down, not an error
+	<-stopped
+	return nil
+}